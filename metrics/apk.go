@@ -0,0 +1,168 @@
+package metrics
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// apkPackage is a package in the apk installed database or an APKINDEX.
+type apkPackage struct {
+	name         string
+	version      string
+	architecture string
+	// origin is the aport the package was built from.
+	origin string
+}
+
+// sourceName returns the origin of the package, or its name for packages
+// that are their own origin.
+func (p apkPackage) sourceName() string {
+	if p.origin != "" {
+		return p.origin
+	}
+	return p.name
+}
+
+// readAPKDatabase calls fn for every package record of the apk installed
+// database or of an APKINDEX. Records are separated by blank lines and
+// every line is a one-letter field name, a colon and the value; P is the
+// name, V the version, A the architecture and o the origin.
+func readAPKDatabase(r io.Reader, fn func(apkPackage)) error {
+	var pkg apkPackage
+	flush := func() {
+		if pkg.name != "" && pkg.version != "" {
+			fn(pkg)
+		}
+		pkg = apkPackage{}
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			flush()
+			continue
+		}
+		if len(line) < 2 || line[1] != ':' {
+			continue
+		}
+		switch line[0] {
+		case 'P':
+			pkg.name = line[2:]
+		case 'V':
+			pkg.version = line[2:]
+		case 'A':
+			pkg.architecture = line[2:]
+		case 'o':
+			pkg.origin = line[2:]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	flush()
+	return nil
+}
+
+// readInstalledAPKs reads /lib/apk/db/installed.
+func readInstalledAPKs(paths Paths) ([]apkPackage, error) {
+	file, err := os.Open(paths.rootfs("/lib/apk/db/installed"))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var packages []apkPackage
+	err = readAPKDatabase(file, func(pkg apkPackage) {
+		packages = append(packages, pkg)
+	})
+	return packages, err
+}
+
+// readAPKIndex calls fn for every package of a cached APKINDEX.tar.gz. The
+// file is the signature and the index as two concatenated gzip streams of
+// one tar archive, which gzip and tar read as a single stream.
+func readAPKIndex(path string, fn func(apkPackage)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return errors.New("no APKINDEX in archive")
+		}
+		if err != nil {
+			return err
+		}
+		if header.Name == "APKINDEX" {
+			return readAPKDatabase(tr, fn)
+		}
+	}
+}
+
+// apkUpdate is an installed package with a newer version in a repository.
+type apkUpdate struct {
+	pkg       apkPackage
+	candidate string
+}
+
+// findAPKUpdates compares the installed packages with the repository indexes
+// apk keeps in /var/cache/apk after apk update, like apk version -l '<'. The
+// newest version in any repository is the candidate.
+func findAPKUpdates(paths Paths) ([]apkUpdate, error) {
+	installed, err := readInstalledAPKs(paths)
+	if err != nil {
+		return nil, err
+	}
+	indexes, err := filepath.Glob(paths.rootfs("/var/cache/apk/APKINDEX.*.tar.gz"))
+	if err != nil {
+		return nil, err
+	}
+	if len(indexes) == 0 {
+		return nil, errors.New("no APK indexes found, run apk update")
+	}
+
+	candidates := map[string]string{}
+	for _, pkg := range installed {
+		candidates[pkg.name] = pkg.version
+	}
+	for _, index := range indexes {
+		err := readAPKIndex(index, func(pkg apkPackage) {
+			if current, ok := candidates[pkg.name]; ok && CompareAPKVersions(pkg.version, current) > 0 {
+				candidates[pkg.name] = pkg.version
+			}
+		})
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", filepath.Base(index), err)
+		}
+	}
+
+	var updates []apkUpdate
+	for _, pkg := range installed {
+		if candidate := candidates[pkg.name]; candidate != pkg.version {
+			updates = append(updates, apkUpdate{pkg: pkg, candidate: candidate})
+		}
+	}
+	sort.Slice(updates, func(i, j int) bool {
+		return updates[i].pkg.name < updates[j].pkg.name
+	})
+	return updates, nil
+}
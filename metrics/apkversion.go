@@ -0,0 +1,166 @@
+package metrics
+
+import "strings"
+
+// Token types of an apk version, in the order they may follow each other.
+const (
+	apkTokenInvalid = iota - 1
+	apkTokenDigitOrZero
+	apkTokenDigit
+	apkTokenLetter
+	apkTokenSuffix
+	apkTokenSuffixNo
+	apkTokenRevisionNo
+	apkTokenEnd
+)
+
+// apkPreSuffixes sort before the plain version, apkPostSuffixes after it.
+var (
+	apkPreSuffixes  = []string{"alpha", "beta", "pre", "rc"}
+	apkPostSuffixes = []string{"cvs", "svn", "git", "hg", "p"}
+)
+
+// CompareAPKVersions compares two Alpine package versions the way
+// apk version -t does. It returns a negative number when a is older than b,
+// zero when they are equal and a positive number when a is newer.
+//
+// Versions are numbers separated by dots, an optional letter, suffixes such
+// as _rc1 or _p2, and a -rN package revision. Pre-release suffixes (_alpha,
+// _beta, _pre, _rc) are older than the plain version, others are newer.
+// Components after the first one with a leading zero compare as fractions,
+// so 1.01 is older than 1.1.
+func CompareAPKVersions(a, b string) int {
+	at, bt := apkTokenDigit, apkTokenDigit
+	av, bv := 0, 0
+	for at == bt && at != apkTokenEnd && at != apkTokenInvalid && av == bv {
+		av = apkNextValue(&at, &a)
+		bv = apkNextValue(&bt, &b)
+	}
+
+	switch {
+	case av < bv:
+		return -1
+	case av > bv:
+		return 1
+	case at == bt:
+		return 0
+	}
+
+	// The common components are equal; the longer version is newer unless
+	// it continues with a pre-release suffix
+	if at == apkTokenSuffix && apkNextValue(&at, &a) < 0 {
+		return -1
+	}
+	if bt == apkTokenSuffix && apkNextValue(&bt, &b) < 0 {
+		return 1
+	}
+	switch {
+	case at > bt:
+		return -1
+	case bt > at:
+		return 1
+	}
+	return 0
+}
+
+// apkNextValue is apk's get_token: it consumes the component of type *typ
+// at the start of *s, returns its value and sets *typ to the type of the
+// next component.
+func apkNextValue(typ *int, s *string) int {
+	if *s == "" {
+		*typ = apkTokenEnd
+		return 0
+	}
+
+	v, i, next := 0, 0, apkTokenInvalid
+	switch *typ {
+	case apkTokenDigitOrZero:
+		// Leading zeros make the component compare as a fraction
+		if (*s)[0] == '0' {
+			for i < len(*s) && (*s)[i] == '0' {
+				i++
+			}
+			next = apkTokenDigit
+			v = -i
+			break
+		}
+		fallthrough
+	case apkTokenDigit, apkTokenSuffixNo, apkTokenRevisionNo:
+		for i < len(*s) && isDigit((*s)[i]) {
+			v = v*10 + int((*s)[i]-'0')
+			i++
+		}
+	case apkTokenLetter:
+		v = int((*s)[i])
+		i++
+	case apkTokenSuffix:
+		if n, ok := apkSuffix(*s, apkPreSuffixes); ok {
+			v, i = n-len(apkPreSuffixes), len(apkPreSuffixes[n])
+		} else if n, ok := apkSuffix(*s, apkPostSuffixes); ok {
+			v, i = n, len(apkPostSuffixes[n])
+		} else {
+			*typ = apkTokenInvalid
+			return -1
+		}
+	default:
+		*typ = apkTokenInvalid
+		return -1
+	}
+
+	*s = (*s)[i:]
+	switch {
+	case *s == "":
+		*typ = apkTokenEnd
+	case next != apkTokenInvalid:
+		*typ = next
+	default:
+		apkNextType(typ, s)
+	}
+	return v
+}
+
+func apkSuffix(s string, suffixes []string) (int, bool) {
+	for n, suffix := range suffixes {
+		if strings.HasPrefix(s, suffix) {
+			return n, true
+		}
+	}
+	return 0, false
+}
+
+// apkNextType is apk's next_token: it sets *typ to the type of the
+// component at the start of *s, consuming its separator.
+func apkNextType(typ *int, s *string) {
+	next := apkTokenInvalid
+	c := (*s)[0]
+	switch {
+	case (*typ == apkTokenDigit || *typ == apkTokenDigitOrZero) && c >= 'a' && c <= 'z':
+		next = apkTokenLetter
+	case *typ == apkTokenLetter && isDigit(c):
+		next = apkTokenDigit
+	case *typ == apkTokenSuffix && isDigit(c):
+		next = apkTokenSuffixNo
+	default:
+		switch c {
+		case '.':
+			next = apkTokenDigitOrZero
+		case '_':
+			next = apkTokenSuffix
+		case '-':
+			if len(*s) > 1 && (*s)[1] == 'r' {
+				next = apkTokenRevisionNo
+				*s = (*s)[1:]
+			}
+		}
+		*s = (*s)[1:]
+	}
+
+	// Components may only repeat or follow in order
+	if next < *typ &&
+		!(next == apkTokenDigitOrZero && *typ == apkTokenDigit) &&
+		!(next == apkTokenSuffix && *typ == apkTokenSuffixNo) &&
+		!(next == apkTokenDigit && *typ == apkTokenLetter) {
+		next = apkTokenInvalid
+	}
+	*typ = next
+}
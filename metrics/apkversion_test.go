@@ -0,0 +1,54 @@
+package metrics
+
+import "testing"
+
+// The first vectors are from apk-tools' test/version.data, the rest cover
+// each suffix and the fractional comparison of leading zeros.
+func TestCompareAPKVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"2.34", "0.1.0_alpha", 1},
+		{"23_foo", "4_beta", 1},
+		{"1.0", "1.0bc", -1},
+		{"0.1.0_alpha", "0.1.0_alpha", 0},
+		{"0.1.0_alpha", "0.1.3_alpha", -1},
+		{"0.1.0_alpha2", "0.1.0_alpha", 1},
+		{"0.1.0_alpha", "2.2.39-r1", -1},
+		{"2.2.39-r1", "1.0.4-r3", 1},
+		{"1.0.4-r3", "1.0.4-r4", -1},
+		{"1.0.4-r4", "1.6", -1},
+		{"1.6", "1.0.2", 1},
+		{"0.10.0", "0.10.1_rc1", -1},
+		{"0.20070207_rc1", "1.0", -1},
+		{"4.5_p1-r1", "4.5_p1", 1},
+		{"4.3_p2-r1", "4.3_p2-r5", -1},
+		{"1.8.5", "1.8.5_p2", -1},
+		{"3.9.8-r5", "2.01.01_alpha10", 1},
+		{"1.0", "1.0_p1", -1},
+		{"1.0_p1", "1.0.1", -1},
+		{"1.0a", "1.0", 1},
+		{"1.0a", "1.0b", -1},
+		{"1.0_alpha", "1.0_beta", -1},
+		{"1.0_beta", "1.0_pre", -1},
+		{"1.0_pre", "1.0_rc", -1},
+		{"1.0_cvs", "1.0_svn", -1},
+		{"1.0_git", "1.0_hg", -1},
+		{"1.0_hg", "1.0_p", -1},
+		{"1.01", "1.1", -1},
+		{"1.001", "1.01", -1},
+		{"3.0.12-r0", "3.0.12-r1", -1},
+		{"1.2.3_git20230101-r0", "1.2.3-r0", 1},
+		{"6.6.4_p20231125-r0", "6.6.4_p20231125-r1", -1},
+	}
+
+	for _, tt := range tests {
+		if got := CompareAPKVersions(tt.a, tt.b); got != tt.want {
+			t.Errorf("CompareAPKVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+		if got := CompareAPKVersions(tt.b, tt.a); got != -tt.want {
+			t.Errorf("CompareAPKVersions(%q, %q) = %d, want %d", tt.b, tt.a, got, -tt.want)
+		}
+	}
+}
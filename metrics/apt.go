@@ -0,0 +1,574 @@
+package metrics
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Default pin priorities from apt_preferences(5).
+const (
+	aptInstalledPriority         = 100
+	aptDefaultPriority           = 500
+	aptNotAutomaticPriority      = 1
+	aptAutomaticUpgradesPriority = 100
+	// aptDowngradePriority is the priority from which apt installs a version
+	// older than the installed one.
+	aptDowngradePriority = 1000
+)
+
+// dpkgPackage is a package recorded in /var/lib/dpkg/status.
+type dpkgPackage struct {
+	name         string
+	architecture string
+	version      string
+	status       string
+	// source is the source package the package was built from, which dpkg
+	// only records when it differs from the package name.
+	source string
+	// conffiles is the Conffiles field: one "path md5 [obsolete]" line per
+	// configuration file.
+	conffiles string
+}
+
+// key identifies the package among the co-installable architectures of a
+// Multi-Arch: same package.
+func (p dpkgPackage) key() string {
+	return p.name + ":" + p.architecture
+}
+
+// sourceName returns the name of the source package. The Source field may
+// carry the source version in parentheses when it differs from the binary
+// version.
+func (p dpkgPackage) sourceName() string {
+	if name, _, _ := strings.Cut(p.source, " "); name != "" {
+		return name
+	}
+	return p.name
+}
+
+// isInstalled reports whether the package files are on disk. Removed
+// packages whose configuration files remain are not installed.
+func (p dpkgPackage) isInstalled() bool {
+	fields := strings.Fields(p.status)
+	if len(fields) != 3 {
+		return false
+	}
+	switch fields[2] {
+	case "installed", "unpacked", "half-configured", "triggers-awaited", "triggers-pending":
+		return true
+	}
+	return false
+}
+
+// dpkgAbnormalStates are the states of packages whose installation,
+// configuration or trigger processing did not finish, and reinst-required
+// for packages dpkg marked as needing a reinstall.
+var dpkgAbnormalStates = []string{"half-installed", "unpacked", "half-configured", "triggers-awaited", "triggers-pending", "reinst-required"}
+
+// abnormalState returns the entry of dpkgAbnormalStates the package is in,
+// or "" for packages that are installed or removed cleanly.
+func (p dpkgPackage) abnormalState() string {
+	fields := strings.Fields(p.status)
+	if len(fields) != 3 {
+		return ""
+	}
+	if fields[1] == "reinstreq" {
+		return "reinst-required"
+	}
+	switch fields[2] {
+	case "half-installed", "unpacked", "half-configured", "triggers-awaited", "triggers-pending":
+		return fields[2]
+	}
+	return ""
+}
+
+// readDpkgStatus returns every package in a dpkg status file.
+func readDpkgStatus(statusPath string) ([]dpkgPackage, error) {
+	file, err := os.Open(statusPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var packages []dpkgPackage
+	err = readControlFile(file, []string{"Package", "Architecture", "Version", "Status", "Source", "Conffiles"}, func(p controlParagraph) {
+		if p["Package"] == "" || p["Version"] == "" {
+			return
+		}
+		packages = append(packages, dpkgPackage{
+			name:         p["Package"],
+			architecture: p["Architecture"],
+			version:      p["Version"],
+			status:       p["Status"],
+			source:       p["Source"],
+			conffiles:    p["Conffiles"],
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading dpkg status file: %w", err)
+	}
+	return packages, nil
+}
+
+// aptRelease describes the suite a Packages index belongs to, as matched by
+// "Pin: release" and "Pin: origin" records.
+type aptRelease struct {
+	origin       string // o=
+	label        string // l=
+	archive      string // a=, the Suite field
+	codename     string // n=
+	version      string // v=
+	component    string // c=
+	architecture string // b=
+	// site is the host the index was downloaded from.
+	site string
+	// date is when the suite was last published, or zero when the Release
+	// file does not say.
+	date time.Time
+
+	notAutomatic         bool
+	butAutomaticUpgrades bool
+}
+
+// defaultPriority is the priority of versions from the release when no pin
+// applies.
+func (r aptRelease) defaultPriority() int {
+	switch {
+	case r.notAutomatic && r.butAutomaticUpgrades:
+		return aptAutomaticUpgradesPriority
+	case r.notAutomatic:
+		return aptNotAutomaticPriority
+	}
+	return aptDefaultPriority
+}
+
+// isSecurity reports whether the release is a security suite such as
+// bookworm-security or jammy-security, or the Debian security archive before
+// bullseye, whose suites were named <codename>/updates.
+func (r aptRelease) isSecurity() bool {
+	for _, suite := range []string{r.archive, r.codename} {
+		if strings.HasSuffix(suite, "-security") || strings.HasSuffix(suite, "/updates") {
+			return true
+		}
+	}
+	return r.label == "Debian-Security"
+}
+
+// aptIndex is one downloaded Packages index under /var/lib/apt/lists.
+type aptIndex struct {
+	path    string
+	release aptRelease
+}
+
+// findAptIndexes lists the Packages indexes in listsDir along with the
+// release each one belongs to. Index file names encode the URI they were
+// downloaded from, e.g. deb.debian.org_debian_dists_bookworm_main_binary-amd64_Packages.
+func findAptIndexes(listsDir string) ([]aptIndex, error) {
+	entries, err := os.ReadDir(listsDir)
+	if err != nil {
+		return nil, err
+	}
+
+	releases := map[string]aptRelease{}
+	var indexes []aptIndex
+	for _, entry := range entries {
+		name := entry.Name()
+		base := strings.TrimSuffix(name, ".gz")
+		if entry.IsDir() || !strings.HasSuffix(base, "_Packages") {
+			continue
+		}
+
+		var release aptRelease
+		site, _, _ := strings.Cut(base, "_")
+		if prefix, rest, ok := strings.Cut(base, "_dists_"); ok {
+			// <site>_<path>_dists_<suite>_<component>_binary-<arch>_Packages;
+			// the suite itself may contain underscores for nested suites
+			parts := strings.Split(strings.TrimSuffix(rest, "_Packages"), "_")
+			if len(parts) >= 3 {
+				suite := strings.Join(parts[:len(parts)-2], "_")
+				releasePrefix := filepath.Join(listsDir, prefix+"_dists_"+suite)
+				cached, ok := releases[releasePrefix]
+				if !ok {
+					cached = readAptRelease(releasePrefix)
+					releases[releasePrefix] = cached
+				}
+				release = cached
+				release.component = parts[len(parts)-2]
+				release.architecture = strings.TrimPrefix(parts[len(parts)-1], "binary-")
+			}
+		} else {
+			// Flat repositories keep Release next to Packages
+			release = readAptRelease(filepath.Join(listsDir, strings.TrimSuffix(base, "_Packages")))
+		}
+		release.site = site
+
+		indexes = append(indexes, aptIndex{path: filepath.Join(listsDir, name), release: release})
+	}
+	return indexes, nil
+}
+
+// readAptRelease reads prefix_InRelease or prefix_Release. A missing file
+// leaves only the defaults, as apt does for repositories without one.
+func readAptRelease(prefix string) aptRelease {
+	var data []byte
+	var err error
+	for _, suffix := range []string{"_InRelease", "_Release"} {
+		if data, err = os.ReadFile(prefix + suffix); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return aptRelease{}
+	}
+
+	var release aptRelease
+	fields := []string{"Origin", "Label", "Suite", "Codename", "Version", "Date", "NotAutomatic", "ButAutomaticUpgrades"}
+	first := true
+	readControlFile(strings.NewReader(stripPGPSignature(string(data))), fields, func(p controlParagraph) {
+		if !first {
+			return
+		}
+		first = false
+		release = aptRelease{
+			origin:               p["Origin"],
+			label:                p["Label"],
+			archive:              p["Suite"],
+			codename:             p["Codename"],
+			version:              p["Version"],
+			notAutomatic:         strings.EqualFold(p["NotAutomatic"], "yes"),
+			butAutomaticUpgrades: strings.EqualFold(p["ButAutomaticUpgrades"], "yes"),
+		}
+		// "Sat, 10 Feb 2024 10:20:16 UTC", in RFC 2822 form
+		for _, layout := range []string{time.RFC1123, time.RFC1123Z} {
+			if date, err := time.Parse(layout, p["Date"]); err == nil {
+				release.date = date.UTC()
+				break
+			}
+		}
+	})
+	return release
+}
+
+// aptPin is one record of /etc/apt/preferences or /etc/apt/preferences.d.
+type aptPin struct {
+	packages []string
+	// kind is "version", "release" or "origin".
+	kind     string
+	value    string
+	priority int
+}
+
+// loadAptPreferences reads the pin records in the order apt applies them:
+// /etc/apt/preferences first, then the files in preferences.d sorted by
+// name. As in apt, files in preferences.d need no extension or ".pref".
+func loadAptPreferences(paths Paths) ([]aptPin, error) {
+	files := []string{paths.rootfs("/etc/apt/preferences")}
+	entries, err := os.ReadDir(paths.rootfs("/etc/apt/preferences.d"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") {
+			continue
+		}
+		if ext := filepath.Ext(name); ext != "" && ext != ".pref" {
+			continue
+		}
+		files = append(files, paths.rootfs(filepath.Join("/etc/apt/preferences.d", name)))
+	}
+
+	var pins []aptPin
+	for _, name := range files {
+		file, err := os.Open(name)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		err = readControlFile(file, []string{"Package", "Pin", "Pin-Priority"}, func(p controlParagraph) {
+			kind, value, _ := strings.Cut(p["Pin"], " ")
+			priority, err := strconv.Atoi(p["Pin-Priority"])
+			if p["Package"] == "" || kind == "" || err != nil {
+				return
+			}
+			pins = append(pins, aptPin{
+				packages: strings.Fields(p["Package"]),
+				kind:     kind,
+				value:    strings.TrimSpace(value),
+				priority: priority,
+			})
+		})
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", name, err)
+		}
+	}
+	return pins, nil
+}
+
+// matchesPackage reports whether the Package field of the pin covers name.
+// Entries are names, glob patterns, or regular expressions between slashes.
+func (p aptPin) matchesPackage(name string) bool {
+	for _, pattern := range p.packages {
+		if len(pattern) > 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+			if re, err := regexp.Compile(pattern[1 : len(pattern)-1]); err == nil && re.MatchString(name) {
+				return true
+			}
+			continue
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// matches reports whether the pin applies to version of name from release.
+// The installed version comes from no release, so only version pins match
+// it.
+func (p aptPin) matches(name, version string, release *aptRelease) bool {
+	if !p.matchesPackage(name) {
+		return false
+	}
+	switch p.kind {
+	case "version":
+		ok, _ := path.Match(p.value, version)
+		return ok
+	case "origin":
+		return release != nil && release.site == strings.Trim(p.value, `"`)
+	case "release":
+		return release != nil && release.matches(p.value)
+	}
+	return false
+}
+
+// matches evaluates a "Pin: release" expression such as
+// "a=bookworm-backports, o=Debian". Every condition must hold. A bare value
+// is a version number if it starts with a digit and an archive or codename
+// otherwise.
+func (r aptRelease) matches(expr string) bool {
+	for _, cond := range strings.Split(expr, ",") {
+		cond = strings.TrimSpace(cond)
+		key, value, ok := strings.Cut(cond, "=")
+		if !ok {
+			if cond != "" && cond[0] >= '0' && cond[0] <= '9' {
+				key, value = "v", cond
+			} else if cond != r.archive && cond != r.codename {
+				return false
+			} else {
+				continue
+			}
+		}
+		var field string
+		switch key {
+		case "a":
+			field = r.archive
+		case "n":
+			field = r.codename
+		case "o":
+			field = r.origin
+		case "l":
+			field = r.label
+		case "c":
+			field = r.component
+		case "v":
+			field = r.version
+		case "b":
+			field = r.architecture
+		default:
+			return false
+		}
+		if ok, _ := path.Match(value, field); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// aptPriority returns the priority of a version: that of the first matching
+// pin, or the default for its release.
+func aptPriority(pins []aptPin, name, version string, release *aptRelease) int {
+	for _, pin := range pins {
+		if pin.matches(name, version, release) {
+			return pin.priority
+		}
+	}
+	if release == nil {
+		return aptInstalledPriority
+	}
+	return release.defaultPriority()
+}
+
+// aptCandidate is a version available for an installed package.
+type aptCandidate struct {
+	version  string
+	priority int
+}
+
+// aptUpdate is an installed package whose candidate version differs from
+// the installed one.
+type aptUpdate struct {
+	pkg       dpkgPackage
+	candidate string
+	// held is packageLockHold or packageLockPin when apt does not install
+	// the update because of a hold or a pin, and "" otherwise.
+	held string
+	updateClassification
+}
+
+// findAptUpdates compares the installed packages with the versions in the
+// downloaded APT indexes and returns those apt would upgrade, sorted by name
+// and architecture. Updates of packages on hold, and those a pin keeps from
+// being the candidate, are returned as held. APT indexes carry no
+// advisories, so an update is classified as a security update when its
+// candidate version is published in a security suite, and as other
+// otherwise. The Date of that suite's Release file stands in for the issue
+// date of the advisory: the suite is republished after every advisory, so it
+// is the latest the advisory may have been issued.
+func findAptUpdates(paths Paths) ([]aptUpdate, error) {
+	packages, err := readDpkgStatus(paths.rootfs("/var/lib/dpkg/status"))
+	if err != nil {
+		return nil, err
+	}
+	pins, err := loadAptPreferences(paths)
+	if err != nil {
+		return nil, err
+	}
+	indexes, err := findAptIndexes(paths.rootfs("/var/lib/apt/lists"))
+	if err != nil {
+		return nil, fmt.Errorf("reading APT package lists: %w", err)
+	}
+	if len(indexes) == 0 {
+		return nil, errors.New("no APT package indexes found, run apt-get update")
+	}
+
+	installed := map[string]dpkgPackage{}
+	for _, pkg := range packages {
+		if pkg.isInstalled() {
+			installed[pkg.key()] = pkg
+		}
+	}
+
+	available := map[string][]aptCandidate{}
+	// unpinned holds the same versions with the priority they would have
+	// without any pins
+	unpinned := map[string][]aptCandidate{}
+	// security holds "name:arch version" for the versions in security
+	// suites, with the date of the earliest suite publishing it
+	security := map[string]time.Time{}
+	for _, index := range indexes {
+		err := readAptIndex(index.path, func(p controlParagraph) {
+			key := p["Package"] + ":" + p["Architecture"]
+			if _, ok := installed[key]; !ok {
+				return
+			}
+			if index.release.isSecurity() {
+				version := key + " " + p["Version"]
+				date, ok := security[version]
+				if !ok || !index.release.date.IsZero() && (date.IsZero() || index.release.date.Before(date)) {
+					security[version] = index.release.date
+				}
+			}
+			available[key] = append(available[key], aptCandidate{
+				version:  p["Version"],
+				priority: aptPriority(pins, p["Package"], p["Version"], &index.release),
+			})
+			unpinned[key] = append(unpinned[key], aptCandidate{
+				version:  p["Version"],
+				priority: index.release.defaultPriority(),
+			})
+		})
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", filepath.Base(index.path), err)
+		}
+	}
+
+	var updates []aptUpdate
+	for key, pkg := range installed {
+		candidate := aptCandidateVersion(pkg, aptPriority(pins, pkg.name, pkg.version, nil), available[key])
+		var held string
+		if CompareDebianVersions(candidate, pkg.version) <= 0 {
+			// A pin may keep the installed version as the candidate, or
+			// force an older one, which apt would downgrade to rather than
+			// update
+			candidate = aptCandidateVersion(pkg, aptInstalledPriority, unpinned[key])
+			if CompareDebianVersions(candidate, pkg.version) <= 0 {
+				continue
+			}
+			held = packageLockPin
+		}
+		if pkg.isHeld() {
+			held = packageLockHold
+		}
+		update := aptUpdate{pkg: pkg, candidate: candidate, held: held, updateClassification: unclassifiedUpdate}
+		if date, ok := security[key+" "+candidate]; ok {
+			update.updateClassification = updateClassification{class: updateClassSecurity, severity: "unknown", issued: date}
+		}
+		updates = append(updates, update)
+	}
+	sort.Slice(updates, func(i, j int) bool {
+		return updates[i].pkg.key() < updates[j].pkg.key()
+	})
+	return updates, nil
+}
+
+// aptCandidateVersion picks the version apt would install, following
+// apt_preferences(5): the highest priority wins and the newest version
+// breaks ties, versions with a negative or zero priority are never chosen,
+// and a version older than the installed one needs a priority of at least
+// 1000.
+func aptCandidateVersion(pkg dpkgPackage, installedPriority int, available []aptCandidate) string {
+	// The installed version also has the priority of any repository that
+	// still offers it
+	best := aptCandidate{version: pkg.version, priority: installedPriority}
+	for _, c := range available {
+		if c.version == pkg.version && c.priority > best.priority {
+			best.priority = c.priority
+		}
+	}
+	for _, c := range available {
+		if c.priority <= 0 || c.version == pkg.version {
+			continue
+		}
+		if CompareDebianVersions(c.version, pkg.version) < 0 && c.priority < aptDowngradePriority {
+			continue
+		}
+		if c.priority > best.priority || c.priority == best.priority && CompareDebianVersions(c.version, best.version) > 0 {
+			best = c
+		}
+	}
+	return best.version
+}
+
+// readAptIndex calls fn for every package in a Packages index, which may be
+// gzip-compressed when apt is configured with Acquire::GzipIndexes.
+func readAptIndex(indexPath string, fn func(controlParagraph)) error {
+	file, err := os.Open(indexPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var r io.Reader = file
+	if strings.HasSuffix(indexPath, ".gz") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	return readControlFile(r, []string{"Package", "Architecture", "Version"}, fn)
+}
@@ -0,0 +1,69 @@
+package metrics
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAptCandidateVersion(t *testing.T) {
+	installed := dpkgPackage{name: "curl", architecture: "amd64", version: "7.88.1-10+deb12u5"}
+	tests := []struct {
+		name      string
+		available []aptCandidate
+		want      string
+	}{
+		{"newer version", []aptCandidate{{"7.88.1-10+deb12u7", 500}}, "7.88.1-10+deb12u7"},
+		{"newest of equal priority", []aptCandidate{{"7.88.1-10+deb12u6", 500}, {"7.88.1-10+deb12u7", 500}}, "7.88.1-10+deb12u7"},
+		{"higher priority over newer", []aptCandidate{{"8.5.0-2~bpo12+1", 100}, {"7.88.1-10+deb12u7", 500}}, "7.88.1-10+deb12u7"},
+		{"NotAutomatic below installed", []aptCandidate{{"7.88.1-10+deb12u5", 500}, {"8.5.0-2~bpo12+1", 1}}, "7.88.1-10+deb12u5"},
+		{"never install negative priority", []aptCandidate{{"7.88.1-10+deb12u7", -1}}, "7.88.1-10+deb12u5"},
+		{"no downgrade below 1000", []aptCandidate{{"7.88.1-10", 990}}, "7.88.1-10+deb12u5"},
+		{"downgrade from 1000", []aptCandidate{{"7.88.1-10", 1000}}, "7.88.1-10"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := aptCandidateVersion(installed, aptInstalledPriority, tt.available); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFindAptUpdatesSkipsPinnedDowngrades(t *testing.T) {
+	opts := fixtureOptions(t, "debian12")
+	status := opts.Paths.rootfs("/var/lib/dpkg/status")
+	data, err := os.ReadFile(status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// curl is newer than bookworm's, which a pin forces back
+	data = []byte(strings.Replace(string(data), "Architecture: amd64\nVersion: 7.88.1-10+deb12u5\n", "Architecture: amd64\nVersion: 7.88.1-10+deb12u6\n", 1))
+	if err := os.WriteFile(status, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	pin := "Package: curl\nPin: release n=bookworm\nPin-Priority: 1001\n"
+	if err := os.WriteFile(filepath.Join(opts.Paths.rootfs("/etc/apt/preferences.d"), "curl.pref"), []byte(pin), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	updates, err := findAptUpdates(opts.Paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, update := range updates {
+		if update.pkg.name != "curl" {
+			continue
+		}
+		if update.pkg.version != "7.88.1-10+deb12u6" {
+			t.Fatalf("installed curl not replaced: %s", update.pkg.version)
+		}
+		if update.candidate != "7.88.1-10+deb12u7" || update.held != packageLockPin {
+			t.Errorf("curl update to %s, held %q; want 7.88.1-10+deb12u7 held by pin", update.candidate, update.held)
+		}
+		return
+	}
+	t.Error("curl update held back by the pin not reported")
+}
@@ -1,6 +1,8 @@
 package metrics
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -10,27 +12,50 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 )
 
-var (
-	auditingMetrics = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "system_auditing_info",
-			Help: "Information about auditing files",
-		},
-		[]string{"file_path", "last_modified", "size"},
-	)
-)
+type auditingCollector struct {
+	info        *prometheus.Desc
+	directories []string
+	paths       Paths
+}
+
+func init() {
+	registerCollector("auditing", false, func(opts Options) Collector {
+		return newAuditingCollector(opts.Config.Auditing, opts.Paths)
+	})
+}
 
-func RegisterAuditingMetrics() {
-	prometheus.MustRegister(auditingMetrics)
+// newAuditingCollector returns a collector for files under the audited
+// directories.
+func newAuditingCollector(cfg AuditingConfig, paths Paths) Collector {
+	return &auditingCollector{
+		info: prometheus.NewDesc(
+			"system_auditing_info",
+			"Information about auditing files",
+			[]string{"file_path", "last_modified", "size"}, nil,
+		),
+		directories: cfg.Directories,
+		paths:       paths,
+	}
 }
 
-func CollectAuditingMetrics() {
-	// Define directories to audit
-	directoriesToAudit := []string{"/var/log", "/etc"}
+func (c *auditingCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.info
+}
 
-	for _, dir := range directoriesToAudit {
+func (c *auditingCollector) Update(ctx context.Context, ch chan<- prometheus.Metric) error {
+	var errs []error
+	seen := labelSet{}
+	for _, auditDir := range c.directories {
+		dir := c.paths.rootfs(auditDir)
 		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			// Large trees can take longer than the scrape deadline
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
 			if err != nil {
+				if path == dir {
+					return err
+				}
 				log.Printf("Error accessing path %s: %v", path, err)
 				return nil
 			}
@@ -44,15 +69,25 @@ func CollectAuditingMetrics() {
 			lastModified := info.ModTime().Format(time.RFC3339)
 			size := info.Size()
 
+			// Overlapping directories would report the same file twice
+			hostPath := c.paths.hostPath(path)
+			if !seen.add(hostPath) {
+				return nil
+			}
+
 			// Add file details to Prometheus metric
-			auditingMetrics.WithLabelValues(path, lastModified, formatBytes(size)).Set(1)
+			ch <- prometheus.MustNewConstMetric(c.info, prometheus.GaugeValue, 1, hostPath, lastModified, formatBytes(size))
 			return nil
 		})
 
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		if err != nil {
-			log.Printf("Error walking directory %s: %v", dir, err)
+			errs = append(errs, fmt.Errorf("walking directory %s: %w", auditDir, err))
 		}
 	}
+	return errors.Join(errs...)
 }
 
 func formatBytes(bytes int64) string {
@@ -0,0 +1,163 @@
+package metrics
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// CgroupLimits are the CPU and memory limits of the cgroup the exporter runs
+// in. A zero value means the resource is not limited.
+type CgroupLimits struct {
+	CPUMillicores int
+	MemoryBytes   int64
+}
+
+// cgroupV1Unlimited is the smallest memory.limit_in_bytes treated as "no
+// limit"; the kernel reports the page-aligned maximum int64 rather than -1.
+const cgroupV1Unlimited = int64(1) << 62
+
+// DetectCgroupLimits reads the limits of the exporter's own cgroup, with
+// cgroup v2 (cpu.max, memory.max) or v1 (cpu.cfs_quota_us,
+// memory.limit_in_bytes). These are the exporter's own limits, so they are
+// always read from /proc and /sys/fs/cgroup rather than --path.procfs.
+func DetectCgroupLimits() (CgroupLimits, error) {
+	return detectCgroupLimits("/proc/self/cgroup", "/sys/fs/cgroup")
+}
+
+func detectCgroupLimits(selfCgroup, cgroupRoot string) (CgroupLimits, error) {
+	file, err := os.Open(selfCgroup)
+	if err != nil {
+		return CgroupLimits{}, err
+	}
+	defer file.Close()
+
+	// Each line is hierarchy-ID:controller-list:cgroup-path. cgroup v2 has a
+	// single line with ID 0 and no controllers.
+	v1Paths := map[string]string{}
+	var v2Path string
+	isV2 := false
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		if fields[0] == "0" && fields[1] == "" {
+			isV2 = true
+			v2Path = fields[2]
+			continue
+		}
+		for _, controller := range strings.Split(fields[1], ",") {
+			v1Paths[controller] = fields[2]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return CgroupLimits{}, fmt.Errorf("reading %s: %w", selfCgroup, err)
+	}
+
+	if len(v1Paths) > 0 {
+		return cgroupV1Limits(cgroupRoot, v1Paths)
+	}
+	if isV2 {
+		return cgroupV2Limits(cgroupRoot, v2Path)
+	}
+	return CgroupLimits{}, errors.New("no cgroup found for the exporter process")
+}
+
+// cgroupV2Limits takes the tightest limit from the exporter's cgroup and its
+// ancestors, since a parent's limit applies to all of its children.
+func cgroupV2Limits(cgroupRoot, cgroupPath string) (CgroupLimits, error) {
+	var limits CgroupLimits
+	for dir := filepath.Join(cgroupRoot, cgroupPath); ; dir = filepath.Dir(dir) {
+		if data, err := os.ReadFile(filepath.Join(dir, "cpu.max")); err == nil {
+			fields := strings.Fields(string(data))
+			if len(fields) == 2 && fields[0] != "max" {
+				quota, err1 := strconv.ParseInt(fields[0], 10, 64)
+				period, err2 := strconv.ParseInt(fields[1], 10, 64)
+				if err1 == nil && err2 == nil && period > 0 {
+					limits.CPUMillicores = minLimit(limits.CPUMillicores, quotaToMillicores(quota, period))
+				}
+			}
+		}
+		if data, err := os.ReadFile(filepath.Join(dir, "memory.max")); err == nil {
+			value := strings.TrimSpace(string(data))
+			if value != "max" {
+				if bytes, err := strconv.ParseInt(value, 10, 64); err == nil && bytes > 0 {
+					limits.MemoryBytes = minLimit(limits.MemoryBytes, bytes)
+				}
+			}
+		}
+
+		if dir == filepath.Clean(cgroupRoot) || dir == filepath.Dir(dir) {
+			break
+		}
+	}
+	return limits, nil
+}
+
+func cgroupV1Limits(cgroupRoot string, paths map[string]string) (CgroupLimits, error) {
+	var limits CgroupLimits
+
+	if cpuPath, ok := paths["cpu"]; ok {
+		for _, mount := range []string{"cpu,cpuacct", "cpu"} {
+			dir := cgroupV1Dir(filepath.Join(cgroupRoot, mount), cpuPath, "cpu.cfs_quota_us")
+			if dir == "" {
+				continue
+			}
+			quota, err1 := readCgroupInt(filepath.Join(dir, "cpu.cfs_quota_us"))
+			period, err2 := readCgroupInt(filepath.Join(dir, "cpu.cfs_period_us"))
+			if err1 == nil && err2 == nil && quota > 0 && period > 0 {
+				limits.CPUMillicores = quotaToMillicores(quota, period)
+			}
+			break
+		}
+	}
+
+	if memoryPath, ok := paths["memory"]; ok {
+		dir := cgroupV1Dir(filepath.Join(cgroupRoot, "memory"), memoryPath, "memory.limit_in_bytes")
+		if dir != "" {
+			if bytes, err := readCgroupInt(filepath.Join(dir, "memory.limit_in_bytes")); err == nil && bytes > 0 && bytes < cgroupV1Unlimited {
+				limits.MemoryBytes = bytes
+			}
+		}
+	}
+	return limits, nil
+}
+
+// cgroupV1Dir finds the directory of a v1 cgroup. Inside a container the
+// hierarchy is usually mounted at the container's own cgroup, so the path
+// from /proc/self/cgroup does not exist and the mount root is used instead.
+func cgroupV1Dir(mount, cgroupPath, file string) string {
+	for _, dir := range []string{filepath.Join(mount, cgroupPath), mount} {
+		if _, err := os.Stat(filepath.Join(dir, file)); err == nil {
+			return dir
+		}
+	}
+	return ""
+}
+
+func readCgroupInt(path string) (int64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
+
+func quotaToMillicores(quota, period int64) int {
+	return int(math.Ceil(float64(quota) * 1000 / float64(period)))
+}
+
+// minLimit returns the tighter of two limits where zero means unlimited.
+func minLimit[T int | int64](current, candidate T) T {
+	if current == 0 || candidate < current {
+		return candidate
+	}
+	return current
+}
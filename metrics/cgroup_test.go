@@ -0,0 +1,57 @@
+package metrics
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDetectCgroupLimits(t *testing.T) {
+	tests := []struct {
+		fixture string
+		want    CgroupLimits
+	}{
+		// The service sets the CPU limit, its parent slice the memory limit
+		{"v2", CgroupLimits{CPUMillicores: 500, MemoryBytes: 512 << 20}},
+		{"v2-unlimited", CgroupLimits{}},
+		// Inside a container the hierarchy is mounted at the pod's cgroup
+		{"v1", CgroupLimits{CPUMillicores: 250, MemoryBytes: 256 << 20}},
+		{"v1-unlimited", CgroupLimits{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			root := filepath.Join("testdata", "cgroup", tt.fixture)
+			got, err := detectCgroupLimits(filepath.Join(root, "proc", "cgroup"), filepath.Join(root, "sys", "fs", "cgroup"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCPUThrottle(t *testing.T) {
+	throttle := newCPUThrottle()
+	start := time.Unix(0, 0)
+
+	throttle.charge("process", start, time.Second)
+	if !throttle.allow("process", start) {
+		t.Fatal("throttled without a budget")
+	}
+
+	// One second of CPU at 250 millicores is paid back after four seconds
+	throttle.setBudget(250)
+	throttle.charge("process", start, time.Second)
+	if throttle.allow("process", start.Add(3*time.Second)) {
+		t.Error("allowed a run before the CPU time was paid back")
+	}
+	if !throttle.allow("process", start.Add(4*time.Second)) {
+		t.Error("throttled after the CPU time was paid back")
+	}
+	if !throttle.allow("auditing", start) {
+		t.Error("throttled a collector that has not run")
+	}
+}
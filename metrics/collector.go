@@ -1,17 +1,471 @@
 package metrics
 
-import "time"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
-// CollectSystemMetrics periodically collects all system metrics
-func CollectSystemMetrics(debug bool) {
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "system_os_info"
+
+var (
+	collectorDurationDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "collector", "duration_seconds"),
+		"Duration of a collector scrape",
+		[]string{"collector"}, nil,
+	)
+	collectorSuccessDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "collector", "success"),
+		"Whether the last collector scrape succeeded (1 for success, 0 for failure)",
+		[]string{"collector"}, nil,
+	)
+	collectorLastSuccessDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "collector", "last_success_timestamp_seconds"),
+		"Unix timestamp of the last successful collector scrape",
+		[]string{"collector"}, nil,
+	)
+	collectorShedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "collector", "shed_total"),
+		"Number of scrapes in which a collector was skipped to shed load",
+		[]string{"collector", "reason"}, nil,
+	)
+	collectorTimeoutsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "collector", "timeouts_total"),
+		"Number of scrapes in which a collector did not finish before its deadline",
+		[]string{"collector"}, nil,
+	)
+	memoryLimitDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "memory", "limit_bytes"),
+		"Soft memory limit of the exporter process",
+		nil, nil,
+	)
+)
+
+// Collector is implemented by every subsystem. Update sends the current
+// metrics to ch and returns an error when its source could not be read. It
+// should give up and return ctx.Err() once ctx is done.
+type Collector interface {
+	Describe(ch chan<- *prometheus.Desc)
+	Update(ctx context.Context, ch chan<- prometheus.Metric) error
+}
+
+// Options holds the settings passed to every collector factory.
+type Options struct {
+	Debug  bool
+	Config *Config
+	Paths  Paths
+	// CacheTTL is how long expensive collectors reuse their previous results.
+	CacheTTL time.Duration
+	// VulnDBPath is the directory of OSV records and OVAL definitions
+	// installed packages are matched against. Empty disables matching.
+	VulnDBPath string
+	// IntegrityReadRate caps the bytes per second the package_integrity
+	// collector hashes. Zero means no cap.
+	IntegrityReadRate int64
+	// IntegrityMaxDetails is how many modified files the package_integrity
+	// collector lists individually.
+	IntegrityMaxDetails int
+	// CPUMillicores is the CPU budget expensive collectors are throttled to.
+	// Zero means no budget.
+	CPUMillicores int
+	// Timeout is the deadline of each collector in a scrape. Zero means no
+	// deadline.
+	Timeout time.Duration
+	// MaxConcurrency is how many collectors run at once, across all scrapes.
+	// Zero runs every collector at once.
+	MaxConcurrency int
+}
+
+type collectorFactory func(opts Options) Collector
+
+// statefulCollector is implemented by collectors that accumulate state
+// across scrapes, such as counters read from logs. Reload calls inherit on
+// the new collector with the one it replaces, so that the state survives.
+type statefulCollector interface {
+	Collector
+	inherit(previous Collector)
+}
+
+var (
+	factories      = map[string]collectorFactory{}
+	defaultEnabled = map[string]bool{}
+)
+
+// registerCollector makes a subsystem available under name. It is called
+// from the init function of each collector file.
+func registerCollector(name string, isDefaultEnabled bool, factory collectorFactory) {
+	if _, exists := factories[name]; exists {
+		panic(fmt.Sprintf("collector %q registered twice", name))
+	}
+	factories[name] = factory
+	defaultEnabled[name] = isDefaultEnabled
+}
+
+// Collectors returns the names of all registered collectors mapped to
+// whether they are enabled by default.
+func Collectors() map[string]bool {
+	collectors := make(map[string]bool, len(defaultEnabled))
+	for name, enabled := range defaultEnabled {
+		collectors[name] = enabled
+	}
+	return collectors
+}
+
+// CollectorSet runs the enabled collectors as a single prometheus.Collector
+// and reports the health of each one.
+type CollectorSet struct {
+	names []string
+
+	collectorsMu sync.RWMutex
+	collectors   map[string]Collector
+	timeout      time.Duration
+	paths        Paths
+	cacheTTL     time.Duration
+
+	mu          sync.Mutex
+	lastSuccess map[string]time.Time
+	shed        map[shedKey]float64
+	timeouts    map[string]float64
+	// running holds the collectors whose Update has not returned yet, which
+	// includes those abandoned at their deadline.
+	running map[string]bool
+
+	throttle *cpuThrottle
+	workers  chan struct{}
+	// inventory caches the host inventory served as a software bill of
+	// materials.
+	inventory inventoryCache
+
+	// ctx is the parent of every collection and is cancelled by Stop.
+	ctx    context.Context
+	cancel context.CancelFunc
+	ready  atomic.Bool
+}
+
+type shedKey struct {
+	collector string
+	reason    string
+}
+
+// NewCollectorSet builds the collectors named in names.
+func NewCollectorSet(opts Options, names []string) (*CollectorSet, error) {
+	set := &CollectorSet{
+		lastSuccess: map[string]time.Time{},
+		shed:        map[shedKey]float64{},
+		timeouts:    map[string]float64{},
+		running:     map[string]bool{},
+		throttle:    newCPUThrottle(),
+	}
+	set.ctx, set.cancel = context.WithCancel(context.Background())
+	for _, name := range names {
+		if _, ok := factories[name]; !ok {
+			return nil, fmt.Errorf("unknown collector %q", name)
+		}
+		if !slices.Contains(set.names, name) {
+			set.names = append(set.names, name)
+		}
+	}
+	sort.Strings(set.names)
+
+	workers := opts.MaxConcurrency
+	if workers <= 0 {
+		// One more for the SBOM endpoint
+		workers = len(set.names) + 1
+	}
+	set.workers = make(chan struct{}, workers)
+
+	set.Reload(opts)
+	return set, nil
+}
+
+// Reload rebuilds every collector with opts, for example after the
+// configuration file changed. Scrapes in progress finish with the old
+// collectors. Collectors keeping state across scrapes hand it over to their
+// replacements.
+func (s *CollectorSet) Reload(opts Options) {
+	if opts.Config == nil {
+		opts.Config = DefaultConfig()
+	}
+	if opts.Paths == (Paths{}) {
+		opts.Paths = DefaultPaths()
+	}
+
+	s.collectorsMu.Lock()
+	previous := s.collectors
+	collectors := make(map[string]Collector, len(s.names))
+	for _, name := range s.names {
+		collectors[name] = factories[name](opts)
+		if c, ok := collectors[name].(statefulCollector); ok && previous[name] != nil {
+			c.inherit(previous[name])
+		}
+	}
+	s.collectors = collectors
+	s.timeout = opts.Timeout
+	s.paths = opts.Paths
+	s.cacheTTL = opts.CacheTTL
+	s.collectorsMu.Unlock()
+	s.throttle.setBudget(opts.CPUMillicores)
+}
+
+// Stop cancels the collections in progress and makes later ones fail
+// straight away, so that scrapes still being served finish quickly during
+// shutdown.
+func (s *CollectorSet) Stop() {
+	s.cancel()
+}
+
+// Ready reports whether a full collection cycle has finished, so caches are
+// warm and every collector has run at least once.
+func (s *CollectorSet) Ready() bool {
+	return s.ready.Load()
+}
+
+// Names returns the enabled collector names in the order they run.
+func (s *CollectorSet) Names() []string {
+	return append([]string(nil), s.names...)
+}
+
+func (s *CollectorSet) Describe(ch chan<- *prometheus.Desc) {
+	ch <- collectorDurationDesc
+	ch <- collectorSuccessDesc
+	ch <- collectorLastSuccessDesc
+	ch <- collectorShedDesc
+	ch <- collectorTimeoutsDesc
+	ch <- memoryLimitDesc
+
+	s.collectorsMu.RLock()
+	defer s.collectorsMu.RUnlock()
+	for _, name := range s.names {
+		s.collectors[name].Describe(ch)
+	}
+}
+
+// Collect runs the collectors concurrently, at most MaxConcurrency at a
+// time, each with its own deadline.
+func (s *CollectorSet) Collect(ch chan<- prometheus.Metric) {
+	s.collectorsMu.RLock()
+	collectors, timeout := s.collectors, s.timeout
+	s.collectorsMu.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, name := range s.names {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.workers <- struct{}{}
+			defer func() { <-s.workers }()
+			s.run(name, collectors[name], timeout, ch)
+		}()
+	}
+	wg.Wait()
+	s.ready.Store(true)
+
+	if limit := memoryLimit(); limit > 0 {
+		ch <- prometheus.MustNewConstMetric(memoryLimitDesc, prometheus.GaugeValue, float64(limit))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, count := range s.shed {
+		ch <- prometheus.MustNewConstMetric(collectorShedDesc, prometheus.CounterValue, count, key.collector, key.reason)
+	}
+	for name, count := range s.timeouts {
+		ch <- prometheus.MustNewConstMetric(collectorTimeoutsDesc, prometheus.CounterValue, count, name)
+	}
+}
+
+// run executes one collector unless the exporter is short on the resources
+// an expensive collector needs.
+func (s *CollectorSet) run(name string, c Collector, timeout time.Duration, ch chan<- prometheus.Metric) {
+	if !expensiveCollectors[name] {
+		s.execute(name, c, timeout, ch)
+		return
+	}
+
+	if underMemoryPressure() {
+		log.Printf("Skipping collector %s: memory use is close to the limit", name)
+		s.recordShed(name, "memory")
+		return
+	}
+	start := time.Now()
+	if !s.throttle.allow(name, start) {
+		log.Printf("Skipping collector %s: its previous run used up the CPU budget", name)
+		s.recordShed(name, "cpu")
+		return
+	}
+	cpuStart := processCPUTime()
+	s.execute(name, c, timeout, ch)
+	s.throttle.charge(name, start, processCPUTime()-cpuStart)
+}
+
+func (s *CollectorSet) recordShed(name, reason string) {
+	s.mu.Lock()
+	s.shed[shedKey{collector: name, reason: reason}]++
+	s.mu.Unlock()
+}
+
+// execute runs one collector and sends its duration, success and last
+// success timestamp alongside its metrics. A collector that misses its
+// deadline is abandoned: its metrics are dropped and it is counted as timed
+// out, even if it is stuck in a call that ignores ctx. Until that call
+// returns, the collector is skipped and counted as timed out again, so that
+// stuck collectors do not pile up beyond one per collector.
+func (s *CollectorSet) execute(name string, c Collector, timeout time.Duration, ch chan<- prometheus.Metric) {
+	ctx, cancel := s.ctx, context.CancelFunc(func() {})
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	defer cancel()
+
+	type result struct {
+		metrics []prometheus.Metric
+		err     error
+	}
+	start := time.Now()
+	var err error
+	if s.startRun(name) {
+		done := make(chan result, 1)
+		go func() {
+			defer s.finishRun(name)
+			metrics, err := gather(func(ch chan<- prometheus.Metric) error {
+				return c.Update(ctx, ch)
+			})
+			done <- result{metrics, err}
+		}()
+
+		select {
+		case r := <-done:
+			for _, m := range r.metrics {
+				ch <- m
+			}
+			err = r.err
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	} else {
+		err = errCollectorStillRunning
+	}
+	duration := time.Since(start)
+
+	success := 0.0
+	if err != nil {
+		log.Printf("Collector %s failed after %s: %v", name, duration, err)
+	} else {
+		success = 1
+	}
+
+	s.mu.Lock()
+	if err == nil {
+		s.lastSuccess[name] = start
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, errCollectorStillRunning) {
+		s.timeouts[name]++
+	}
+	lastSuccess, ok := s.lastSuccess[name]
+	s.mu.Unlock()
+
+	ch <- prometheus.MustNewConstMetric(collectorDurationDesc, prometheus.GaugeValue, duration.Seconds(), name)
+	ch <- prometheus.MustNewConstMetric(collectorSuccessDesc, prometheus.GaugeValue, success, name)
+	if ok {
+		ch <- prometheus.MustNewConstMetric(collectorLastSuccessDesc, prometheus.GaugeValue, float64(lastSuccess.UnixNano())/1e9, name)
+	}
+}
+
+// errCollectorStillRunning is reported for a collector skipped because its
+// run abandoned at an earlier deadline has not returned yet.
+var errCollectorStillRunning = errors.New("previous run has not finished after missing its deadline")
+
+// startRun marks the collector name as running, or reports false when it
+// already is.
+func (s *CollectorSet) startRun(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running[name] {
+		return false
+	}
+	s.running[name] = true
+	return true
+}
+
+func (s *CollectorSet) finishRun(name string) {
+	s.mu.Lock()
+	delete(s.running, name)
+	s.mu.Unlock()
+}
+
+// gather runs update and returns the metrics it sent.
+func gather(update func(ch chan<- prometheus.Metric) error) ([]prometheus.Metric, error) {
+	buf := make(chan prometheus.Metric)
+	done := make(chan struct{})
+	var metrics []prometheus.Metric
 	go func() {
-		for {
-			CollectSystemUserMetrics(debug) // Pass debug flag
-			CollectUserMetrics()
-			CollectProcessMetrics()
-			CollectNetworkMetrics()
-			CollectFilesystemMetrics()
-			time.Sleep(5 * time.Minute) // Adjust the interval as needed
+		for m := range buf {
+			metrics = append(metrics, m)
 		}
+		close(done)
 	}()
+	err := update(buf)
+	close(buf)
+	<-done
+	return metrics, err
+}
+
+// metricCache keeps the metrics from the previous collection so that
+// expensive sources are queried at most once per ttl. A zero ttl disables
+// caching and every scrape runs the update.
+type metricCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	metrics []prometheus.Metric
+	expires time.Time
+}
+
+// collect sends the cached metrics to ch, refreshing them with update first
+// when they have expired. A failed update is not cached, so the next scrape
+// retries it.
+func (c *metricCache) collect(ch chan<- prometheus.Metric, update func(ch chan<- prometheus.Metric) error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.ttl <= 0 || time.Now().After(c.expires) {
+		fresh, err := gather(update)
+		c.metrics = fresh
+		if err != nil {
+			c.expires = time.Time{}
+			for _, m := range c.metrics {
+				ch <- m
+			}
+			return err
+		}
+		c.expires = time.Now().Add(c.ttl)
+	}
+
+	for _, m := range c.metrics {
+		ch <- m
+	}
+	return nil
+}
+
+// labelSet remembers the label values already sent during one collection.
+// A const metric may only be exposed once per scrape, so duplicates are
+// dropped instead of failing the whole scrape.
+type labelSet map[string]struct{}
+
+func (s labelSet) add(values ...string) bool {
+	key := strings.Join(values, "\xff")
+	if _, ok := s[key]; ok {
+		return false
+	}
+	s[key] = struct{}{}
+	return true
 }
@@ -0,0 +1,387 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata/golden")
+
+// fixtureTime is the modification time given to every fixture file, so the
+// auditing collector produces stable labels.
+var fixtureTime = time.Date(2024, 2, 12, 10, 0, 0, 0, time.UTC)
+
+// updateCollector adapts a Collector to prometheus.Collector and remembers
+// the error of the last update.
+type updateCollector struct {
+	Collector
+	err error
+}
+
+func (c *updateCollector) Collect(ch chan<- prometheus.Metric) {
+	c.err = c.Update(context.Background(), ch)
+}
+
+// fixtureOptions copies the fixture host tree into a temporary directory and
+// returns options reading from it, with host-dependent sources replaced by
+// fixed values.
+func fixtureOptions(t *testing.T, fixture string) Options {
+	t.Helper()
+
+	root := t.TempDir()
+	copyFixtureTree(t, filepath.Join("testdata", "rootfs", fixture), root)
+	vulnDB := t.TempDir()
+	copyFixtureTree(t, filepath.Join("testdata", "vulndb"), vulnDB)
+
+	origLocal, origNow, origStatfs, origInterfaces := time.Local, timeNow, statfs, listNetworkInterfaces
+	t.Cleanup(func() {
+		time.Local, timeNow, statfs, listNetworkInterfaces = origLocal, origNow, origStatfs, origInterfaces
+	})
+	time.Local = time.UTC
+	timeNow = func() time.Time { return fixtureTime }
+	statfs = func(path string, stat *syscall.Statfs_t) error {
+		if _, err := os.Stat(path); err != nil {
+			return err
+		}
+		*stat = syscall.Statfs_t{Type: EXT4_SUPER_MAGIC, Bsize: 4096, Blocks: 26214400, Bfree: 13107200}
+		return nil
+	}
+	listNetworkInterfaces = func() ([]networkInterface, error) {
+		return []networkInterface{
+			{name: "lo", ipAddress: "127.0.0.1", macAddress: "unknown"},
+			{name: "eth0", ipAddress: "10.0.0.12", macAddress: "52:54:00:12:34:56"},
+		}, nil
+	}
+
+	return Options{
+		Config:              DefaultConfig(),
+		VulnDBPath:          vulnDB,
+		IntegrityMaxDetails: 10,
+		Paths: Paths{
+			RootFS: root,
+			ProcFS: filepath.Join(root, "proc"),
+			SysFS:  filepath.Join(root, "sys"),
+		},
+	}
+}
+
+// copyFixtureTree copies the files under src to dst, all modified at
+// fixtureTime.
+func copyFixtureTree(t *testing.T, src, dst string) {
+	t.Helper()
+
+	err := filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if d.IsDir() {
+			return os.MkdirAll(target, 0o755)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(target, data, 0o644); err != nil {
+			return err
+		}
+		return os.Chtimes(target, fixtureTime, fixtureTime)
+	})
+	if err != nil {
+		t.Fatalf("copying fixture %s: %v", src, err)
+	}
+}
+
+// compareGolden compares got with testdata/golden/<name>, or rewrites the
+// file when the tests run with -update.
+func compareGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+
+	golden := filepath.Join("testdata", "golden", name)
+	if *update {
+		if err := os.MkdirAll(filepath.Dir(golden), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(golden, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatalf("reading golden file (run with -update to create it): %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("output does not match %s (run with -update to accept it)\n--- got\n%s\n--- want\n%s", golden, got, want)
+	}
+}
+
+// collectText gathers c through a pedantic registry and returns the text
+// exposition format.
+func collectText(t *testing.T, c prometheus.Collector) []byte {
+	t.Helper()
+
+	reg := prometheus.NewPedanticRegistry()
+	if err := reg.Register(c); err != nil {
+		t.Fatalf("registering collector: %v", err)
+	}
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("gathering metrics: %v", err)
+	}
+
+	var out bytes.Buffer
+	for _, family := range families {
+		if _, err := expfmt.MetricFamilyToText(&out, family); err != nil {
+			t.Fatalf("encoding metrics: %v", err)
+		}
+	}
+	return out.Bytes()
+}
+
+func TestCollectorsGolden(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("fixtures describe Linux hosts")
+	}
+
+	fixtures, err := os.ReadDir(filepath.Join("testdata", "rootfs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, fixture := range fixtures {
+		for _, name := range names {
+			t.Run(fixture.Name()+"/"+name, func(t *testing.T) {
+				opts := fixtureOptions(t, fixture.Name())
+				c := &updateCollector{Collector: factories[name](opts)}
+
+				out := collectText(t, c)
+
+				// Record failures in the golden file so expected errors are
+				// reviewed like any other output.
+				var got bytes.Buffer
+				if c.err != nil {
+					msg := strings.ReplaceAll(c.err.Error(), opts.Paths.RootFS, "<rootfs>")
+					got.WriteString("# error: " + strings.ReplaceAll(msg, "\n", " ") + "\n")
+				}
+				got.Write(out)
+
+				compareGolden(t, filepath.Join(fixture.Name(), name+".prom"), got.Bytes())
+			})
+		}
+	}
+}
+
+func TestParseYumOutput(t *testing.T) {
+	output, err := os.ReadFile(filepath.Join("testdata", "yum-list-installed.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packages, err := parseYumOutput(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got bytes.Buffer
+	for _, pkg := range packages {
+		got.WriteString(pkg.name + " " + pkg.architecture + " " + pkg.version + "\n")
+	}
+	compareGolden(t, "yum-list-installed.txt", got.Bytes())
+}
+
+func TestCollectorSetShedsUnderMemoryPressure(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("fixtures describe Linux hosts")
+	}
+
+	// A limit far below current use puts the exporter under pressure
+	orig := debug.SetMemoryLimit(1)
+	t.Cleanup(func() { debug.SetMemoryLimit(orig) })
+
+	set, err := NewCollectorSet(fixtureOptions(t, "debian12"), []string{"os", "process"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := string(collectText(t, set))
+	if strings.Contains(out, "system_process_info{") {
+		t.Error("process collector ran under memory pressure")
+	}
+	if !strings.Contains(out, "system_os_info{") {
+		t.Error("os collector was skipped, but it is not expensive")
+	}
+	if !strings.Contains(out, `system_os_info_collector_shed_total{collector="process",reason="memory"} 1`) {
+		t.Errorf("shed collection not counted:\n%s", out)
+	}
+	if !strings.Contains(out, "system_os_info_memory_limit_bytes 1\n") {
+		t.Errorf("memory limit not reported:\n%s", out)
+	}
+}
+
+// hungCollector blocks until released, ignoring its context like a process
+// stuck in an uninterruptible syscall.
+type hungCollector struct {
+	release chan struct{}
+}
+
+func (c *hungCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+func (c *hungCollector) Update(ctx context.Context, ch chan<- prometheus.Metric) error {
+	<-c.release
+	return nil
+}
+
+func TestCollectorSetAbandonsCollectorsPastTheirDeadline(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("fixtures describe Linux hosts")
+	}
+
+	hung := &hungCollector{release: make(chan struct{})}
+	factories["hung"] = func(Options) Collector { return hung }
+	t.Cleanup(func() {
+		close(hung.release)
+		delete(factories, "hung")
+	})
+
+	opts := fixtureOptions(t, "debian12")
+	opts.Timeout = 50 * time.Millisecond
+	opts.MaxConcurrency = 1
+	set, err := NewCollectorSet(opts, []string{"hung", "os"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	out := string(collectText(t, set))
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("scrape waited %s for the hung collector", elapsed)
+	}
+	if !strings.Contains(out, "system_os_info{") {
+		t.Error("os collector did not run after the hung collector")
+	}
+	if !strings.Contains(out, `system_os_info_collector_success{collector="hung"} 0`) {
+		t.Errorf("hung collector not reported as failed:\n%s", out)
+	}
+	if !strings.Contains(out, `system_os_info_collector_timeouts_total{collector="hung"} 1`) {
+		t.Errorf("timeout not counted:\n%s", out)
+	}
+}
+
+// countingCollector counts its runs and blocks until released, ignoring
+// its context.
+type countingCollector struct {
+	runs    atomic.Int32
+	release chan struct{}
+}
+
+func (c *countingCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+func (c *countingCollector) Update(ctx context.Context, ch chan<- prometheus.Metric) error {
+	c.runs.Add(1)
+	<-c.release
+	return nil
+}
+
+func TestCollectorSetSkipsCollectorsStillRunning(t *testing.T) {
+	stuck := &countingCollector{release: make(chan struct{})}
+	factories["stuck"] = func(Options) Collector { return stuck }
+	t.Cleanup(func() { delete(factories, "stuck") })
+
+	set, err := NewCollectorSet(Options{Timeout: 20 * time.Millisecond}, []string{"stuck"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	collectText(t, set)
+	out := string(collectText(t, set))
+	if runs := stuck.runs.Load(); runs != 1 {
+		t.Errorf("collector started %d times while its first run was stuck", runs)
+	}
+	if !strings.Contains(out, `system_os_info_collector_timeouts_total{collector="stuck"} 2`) {
+		t.Errorf("skipped run not counted as a timeout:\n%s", out)
+	}
+
+	close(stuck.release)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		set.mu.Lock()
+		running := set.running["stuck"]
+		set.mu.Unlock()
+		if !running {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("collector still marked as running after it returned")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	out = string(collectText(t, set))
+	if runs := stuck.runs.Load(); runs != 2 {
+		t.Errorf("collector ran %d times, want 2 once the stuck run returned", runs)
+	}
+	if !strings.Contains(out, `system_os_info_collector_success{collector="stuck"} 1`) {
+		t.Errorf("collector not run again after it returned:\n%s", out)
+	}
+}
+
+// blockingCollector waits for its context to be cancelled.
+type blockingCollector struct{}
+
+func (blockingCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+func (blockingCollector) Update(ctx context.Context, ch chan<- prometheus.Metric) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestCollectorSetStopCancelsCollection(t *testing.T) {
+	factories["blocking"] = func(Options) Collector { return blockingCollector{} }
+	t.Cleanup(func() { delete(factories, "blocking") })
+
+	set, err := NewCollectorSet(Options{}, []string{"blocking"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if set.Ready() {
+		t.Error("ready before the first collection")
+	}
+
+	time.AfterFunc(50*time.Millisecond, set.Stop)
+	out := string(collectText(t, set))
+	if !strings.Contains(out, `system_os_info_collector_success{collector="blocking"} 0`) {
+		t.Errorf("cancelled collector not reported as failed:\n%s", out)
+	}
+	if strings.Contains(out, "timeouts_total") {
+		t.Errorf("cancellation counted as a timeout:\n%s", out)
+	}
+	if !set.Ready() {
+		t.Error("not ready after a full collection")
+	}
+}
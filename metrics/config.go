@@ -0,0 +1,79 @@
+package metrics
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the YAML configuration file. Every section overrides the
+// defaults of one collector.
+type Config struct {
+	Filesystem    FilesystemConfig    `yaml:"filesystem"`
+	Auditing      AuditingConfig      `yaml:"auditing"`
+	ScheduledJobs ScheduledJobsConfig `yaml:"scheduled_jobs"`
+	Users         UsersConfig         `yaml:"users"`
+}
+
+type FilesystemConfig struct {
+	MountPoints []string `yaml:"mount_points"`
+}
+
+type AuditingConfig struct {
+	Directories []string `yaml:"directories"`
+}
+
+type ScheduledJobsConfig struct {
+	CronFiles []string `yaml:"cron_files"`
+}
+
+type UsersConfig struct {
+	// MinUID skips system and application accounts below this UID.
+	MinUID int `yaml:"min_uid"`
+	// Shells limits users to these login shells. An empty list allows any shell.
+	Shells []string `yaml:"shells"`
+}
+
+// DefaultConfig returns the configuration used when no file is given.
+func DefaultConfig() *Config {
+	return &Config{
+		Filesystem: FilesystemConfig{
+			MountPoints: []string{"/", "/home", "/var"},
+		},
+		Auditing: AuditingConfig{
+			Directories: []string{"/var/log", "/etc"},
+		},
+		ScheduledJobs: ScheduledJobsConfig{
+			CronFiles: []string{"/etc/crontab"},
+		},
+		Users: UsersConfig{
+			MinUID: 1000,
+			Shells: []string{"/bin/bash", "/bin/sh"},
+		},
+	}
+}
+
+// LoadConfig reads the configuration file at path on top of the defaults.
+// An empty path returns the defaults.
+func LoadConfig(path string) (*Config, error) {
+	cfg := DefaultConfig()
+	if path == "" {
+		return cfg, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return cfg, nil
+}
@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"sync"
+	"syscall"
+	"time"
+)
+
+// cpuThrottle spaces out the runs of expensive collectors so that the CPU
+// time they use averages out to at most the exporter's millicore budget.
+// GOMAXPROCS only caps how many threads run at once; a collector that keeps
+// one core busy for seconds on every scrape still exceeds a 100m budget.
+type cpuThrottle struct {
+	mu         sync.Mutex
+	millicores int
+	next       map[string]time.Time
+}
+
+func newCPUThrottle() *cpuThrottle {
+	return &cpuThrottle{next: map[string]time.Time{}}
+}
+
+// setBudget changes the budget. Zero disables throttling.
+func (t *cpuThrottle) setBudget(millicores int) {
+	t.mu.Lock()
+	t.millicores = millicores
+	t.mu.Unlock()
+}
+
+// allow reports whether the collector has earned back the CPU time of its
+// previous run.
+func (t *cpuThrottle) allow(name string, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.millicores <= 0 || !now.Before(t.next[name])
+}
+
+// charge records that a run started at start used cpu of CPU time. At a
+// budget of m millicores, that time is only paid back after cpu*1000/m of
+// wall time.
+func (t *cpuThrottle) charge(name string, start time.Time, cpu time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.millicores <= 0 {
+		return
+	}
+	t.next[name] = start.Add(cpu * 1000 / time.Duration(t.millicores))
+}
+
+// processCPUTime returns the user and system CPU time used by the exporter
+// so far. It covers the whole process, so a concurrent scrape is charged to
+// the collector too, which errs on the side of staying within the budget.
+func processCPUTime() time.Duration {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return 0
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
@@ -0,0 +1,103 @@
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// cvss3Weights are the CVSS v3 base metric values, by metric and value.
+var cvss3Weights = map[string]map[string]float64{
+	"AV": {"N": 0.85, "A": 0.62, "L": 0.55, "P": 0.2},
+	"AC": {"L": 0.77, "H": 0.44},
+	"PR": {"N": 0.85, "L": 0.62, "H": 0.27},
+	"UI": {"N": 0.85, "R": 0.62},
+	"C":  {"H": 0.56, "L": 0.22, "N": 0},
+	"I":  {"H": 0.56, "L": 0.22, "N": 0},
+	"A":  {"H": 0.56, "L": 0.22, "N": 0},
+}
+
+// cvss3BaseScore computes the base score of a CVSS v3.0 or v3.1 vector such
+// as CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:H/I:H/A:H, following section 7 of the
+// v3.1 specification.
+func cvss3BaseScore(vector string) (float64, error) {
+	parts := strings.Split(vector, "/")
+	if len(parts) == 0 || !strings.HasPrefix(parts[0], "CVSS:3.") {
+		return 0, fmt.Errorf("not a CVSS v3 vector: %q", vector)
+	}
+
+	values := map[string]string{}
+	for _, part := range parts[1:] {
+		metric, value, ok := strings.Cut(part, ":")
+		if !ok {
+			return 0, fmt.Errorf("malformed CVSS metric %q", part)
+		}
+		values[metric] = value
+	}
+
+	scopeChanged := false
+	switch values["S"] {
+	case "U":
+	case "C":
+		scopeChanged = true
+	default:
+		return 0, fmt.Errorf("CVSS vector %q has no scope", vector)
+	}
+
+	weights := map[string]float64{}
+	for metric, table := range cvss3Weights {
+		weight, ok := table[values[metric]]
+		if !ok {
+			return 0, fmt.Errorf("CVSS vector %q has no valid %s", vector, metric)
+		}
+		weights[metric] = weight
+	}
+	// Privileges weigh less when the scope changes
+	if scopeChanged {
+		switch values["PR"] {
+		case "L":
+			weights["PR"] = 0.68
+		case "H":
+			weights["PR"] = 0.5
+		}
+	}
+
+	iss := 1 - (1-weights["C"])*(1-weights["I"])*(1-weights["A"])
+	impact := 6.42 * iss
+	if scopeChanged {
+		impact = 7.52*(iss-0.029) - 3.25*math.Pow(iss-0.02, 15)
+	}
+	if impact <= 0 {
+		return 0, nil
+	}
+	exploitability := 8.22 * weights["AV"] * weights["AC"] * weights["PR"] * weights["UI"]
+	if scopeChanged {
+		return cvssRoundUp(math.Min(1.08*(impact+exploitability), 10)), nil
+	}
+	return cvssRoundUp(math.Min(impact+exploitability, 10)), nil
+}
+
+// cvssRoundUp rounds up to one decimal, working in integers to avoid
+// floating point errors as Appendix A of the specification recommends.
+func cvssRoundUp(x float64) float64 {
+	n := int64(math.Round(x * 100000))
+	if n%10000 == 0 {
+		return float64(n) / 100000
+	}
+	return float64(n/10000+1) / 10
+}
+
+// cvssSeverity returns the qualitative severity rating of a CVSS score.
+func cvssSeverity(score float64) string {
+	switch {
+	case score >= 9:
+		return severityCritical
+	case score >= 7:
+		return severityHigh
+	case score >= 4:
+		return severityMedium
+	case score > 0:
+		return severityLow
+	}
+	return severityUnknown
+}
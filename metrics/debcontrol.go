@@ -0,0 +1,87 @@
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+// controlParagraph holds the fields of one paragraph of a Debian control
+// file, keyed by the field names passed to readControlFile.
+type controlParagraph map[string]string
+
+// readControlFile calls fn for every paragraph of a Debian control file such
+// as /var/lib/dpkg/status, a Packages index or an APT preferences file. Only
+// the named fields are kept, since a Packages index describes tens of
+// thousands of packages. Field names match case-insensitively and
+// continuation lines are joined with newlines.
+func readControlFile(r io.Reader, fields []string, fn func(controlParagraph)) error {
+	wanted := make(map[string]string, len(fields))
+	for _, field := range fields {
+		wanted[strings.ToLower(field)] = field
+	}
+
+	paragraph := controlParagraph{}
+	var current string
+	flush := func() {
+		if len(paragraph) > 0 {
+			fn(paragraph)
+			paragraph = controlParagraph{}
+		}
+		current = ""
+	}
+
+	scanner := bufio.NewScanner(r)
+	// Description and Conffiles lines can exceed the default 64KiB limit
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.TrimSpace(line) == "":
+			flush()
+		case strings.HasPrefix(line, "#"):
+			// Comments are allowed in APT preferences
+		case line[0] == ' ' || line[0] == '\t':
+			if current != "" {
+				paragraph[current] += "\n" + strings.TrimSpace(line)
+			}
+		default:
+			name, value, ok := strings.Cut(line, ":")
+			if !ok {
+				current = ""
+				continue
+			}
+			current = wanted[strings.ToLower(name)]
+			if current != "" {
+				paragraph[current] = strings.TrimSpace(value)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	flush()
+	return nil
+}
+
+// stripPGPSignature returns the signed text of a clearsigned message such as
+// an InRelease file, or data unchanged when it is not signed.
+func stripPGPSignature(data string) string {
+	const header = "-----BEGIN PGP SIGNED MESSAGE-----"
+	if !strings.HasPrefix(strings.TrimSpace(data), header) {
+		return data
+	}
+	// Armor headers such as "Hash:" end at the first blank line
+	_, body, ok := strings.Cut(data, "\n\n")
+	if !ok {
+		return ""
+	}
+	body, _, _ = strings.Cut(body, "-----BEGIN PGP SIGNATURE-----")
+
+	// Dash-escaped lines start with "- "
+	lines := strings.Split(body, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimPrefix(line, "- ")
+	}
+	return strings.Join(lines, "\n")
+}
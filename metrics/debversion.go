@@ -0,0 +1,130 @@
+package metrics
+
+import (
+	"strconv"
+	"strings"
+)
+
+// debianVersion is a version split into the parts dpkg compares separately.
+type debianVersion struct {
+	epoch    int
+	upstream string
+	revision string
+}
+
+// parseDebianVersion splits [epoch:]upstream[-revision]. The upstream part may
+// itself contain hyphens, so the revision starts after the last one. A
+// malformed epoch is treated as 0 rather than failing the comparison.
+func parseDebianVersion(version string) debianVersion {
+	var v debianVersion
+	version = strings.TrimSpace(version)
+	if i := strings.IndexByte(version, ':'); i >= 0 {
+		v.epoch, _ = strconv.Atoi(version[:i])
+		version = version[i+1:]
+	}
+	if i := strings.LastIndexByte(version, '-'); i >= 0 {
+		v.upstream, v.revision = version[:i], version[i+1:]
+	} else {
+		v.upstream = version
+	}
+	return v
+}
+
+// CompareDebianVersions compares two package versions the way
+// dpkg --compare-versions does. It returns a negative number when a is older
+// than b, zero when they are equal and a positive number when a is newer.
+//
+// Epochs are compared first, then the upstream version and the Debian
+// revision. A tilde sorts before everything, even the end of the string, so
+// 1.0~rc1 is older than 1.0.
+func CompareDebianVersions(a, b string) int {
+	va, vb := parseDebianVersion(a), parseDebianVersion(b)
+	if va.epoch != vb.epoch {
+		if va.epoch < vb.epoch {
+			return -1
+		}
+		return 1
+	}
+	if c := compareDebianFragment(va.upstream, vb.upstream); c != 0 {
+		return c
+	}
+	return compareDebianFragment(va.revision, vb.revision)
+}
+
+// compareDebianFragment is dpkg's verrevcmp: the strings are compared as
+// alternating runs of non-digits, ordered by debianCharOrder, and digits,
+// ordered numerically.
+func compareDebianFragment(a, b string) int {
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		for (i < len(a) && !isDigit(a[i])) || (j < len(b) && !isDigit(b[j])) {
+			ac, bc := 0, 0
+			if i < len(a) {
+				ac = debianCharOrder(a[i])
+			}
+			if j < len(b) {
+				bc = debianCharOrder(b[j])
+			}
+			if ac != bc {
+				return sign(ac - bc)
+			}
+			i++
+			j++
+		}
+
+		for i < len(a) && a[i] == '0' {
+			i++
+		}
+		for j < len(b) && b[j] == '0' {
+			j++
+		}
+
+		firstDiff := 0
+		for i < len(a) && isDigit(a[i]) && j < len(b) && isDigit(b[j]) {
+			if firstDiff == 0 {
+				firstDiff = int(a[i]) - int(b[j])
+			}
+			i++
+			j++
+		}
+		if i < len(a) && isDigit(a[i]) {
+			return 1
+		}
+		if j < len(b) && isDigit(b[j]) {
+			return -1
+		}
+		if firstDiff != 0 {
+			return sign(firstDiff)
+		}
+	}
+	return 0
+}
+
+// debianCharOrder ranks a non-digit character: tilde first, then the end of
+// the string and digits, then letters, then everything else.
+func debianCharOrder(c byte) int {
+	switch {
+	case c == '~':
+		return -1
+	case isDigit(c):
+		return 0
+	case isAlpha(c):
+		return int(c)
+	default:
+		return int(c) + 256
+	}
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,87 @@
+package metrics
+
+import "testing"
+
+// Test vectors from dpkg's scripts/t/Dpkg_Version.t, plus cases covering the
+// ordering of tildes, letters and punctuation. Each one was checked against
+// dpkg --compare-versions.
+var debianVersionTests = []struct {
+	a, b string
+	want int
+}{
+	{"1.0-1", "2.0-2", -1},
+	{"2.2~rc-4", "2.2-1", -1},
+	{"2.2-1", "2.2~rc-4", 1},
+	{"1.0000-1", "1.0-1", 0},
+	{"1", "0:1", 0},
+	{"0", "0:0-0", 0},
+	{"2:2.5", "1:7.5", 1},
+	{"1:0foo", "0foo", 1},
+	{"0:0foo", "0foo", 0},
+	{"0foo", "0foo", 0},
+	{"0foo-0", "0foo", 0},
+	{"0foo", "0foo-0", 0},
+	{"0foo", "0fo", 1},
+	{"0foo-0", "0foo+", -1},
+	{"0foo~1", "0foo", -1},
+	{"0foo~foo+Bar", "0foo~foo+bar", -1},
+	{"0foo~~", "0foo~", -1},
+	{"1~", "1", -1},
+	{"12345+that-really-is-some-ver-0", "12345+that-really-is-some-ver-10", -1},
+	{"0foo-0", "0foo-01", -1},
+	{"0foo.bar", "0foobar", 1},
+	{"0foo.bar", "0foo1bar", 1},
+	{"0foo.bar", "0foo0bar", 1},
+	{"0foo1bar-1", "0foobar-1", -1},
+	{"0foo2.0", "0foo2", 1},
+	{"0foo2.0.0", "0foo2.10.0", -1},
+	{"0foo2.0", "0foo2.0.0", -1},
+	{"0foo2.0", "0foo2.10", -1},
+	{"0foo2.1", "0foo2.10", -1},
+	{"1.09", "1.9", 0},
+	{"1.0.8+nmu1", "1.0.8", 1},
+	{"3.11", "3.10+nmu1", 1},
+	{"0.9j-20080306-4", "0.9i-20070324-2", 1},
+	{"1.2.0~b7-1", "1.2.0~b6-1", 1},
+	{"1.011-1", "1.06-2", 1},
+	{"0.0.9+dfsg1-1", "0.0.8+dfsg1-3", 1},
+	{"4.6.99+svn6582-1", "4.6.99+svn6496-1", 1},
+	{"53", "52", 1},
+	{"0.9.9~pre122-1", "0.9.9~pre111-1", 1},
+	{"2:2.3.2-2+lenny2", "2:2.3.2-2", 1},
+	{"1:3.8.1-1", "3.8.GA-1", 1},
+	{"1.0.1+gpl-1", "1:1.0.1-3", -1},
+	{"1a", "1default2", -1},
+	{"1.10", "11.0", -1},
+	{"1.10", "1.9", 1},
+	{"7.6p2-4", "7.6-0", 1},
+	{"1.0.3-3", "1.0-1", 1},
+	{"1.3", "1.2.2-2", 1},
+	{"1.3", "1.2.2", 1},
+	{"0-pre", "0-pre", 0},
+	{"0-pre", "0-pree", -1},
+	{"1.1.6r2-2", "1.1.6r-1", 1},
+	{"2.6b2-1", "2.6b-2", 1},
+	{"98.1p5-1", "98.1-pre2-b6-2", -1},
+	{"0.4a6-2", "0.4-1", 1},
+	{"1:3.0.5+dfsg-4", "1:3.0.5+dfsg-3", 1},
+	{"1.0", "1.0~rc1", 1},
+	{"1.0~rc1", "1.0~beta1", 1},
+	{"1.0~~", "1.0~~a", -1},
+	{"1.0~~a", "1.0~", -1},
+	{"1.0~", "1.0", -1},
+	{"1.0", "1.0a", -1},
+	{"1.0a", "1.0+", -1},
+	{"1.0+", "1.0.", -1},
+}
+
+func TestCompareDebianVersions(t *testing.T) {
+	for _, tt := range debianVersionTests {
+		if got := CompareDebianVersions(tt.a, tt.b); got != tt.want {
+			t.Errorf("CompareDebianVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+		if got := CompareDebianVersions(tt.b, tt.a); got != -tt.want {
+			t.Errorf("CompareDebianVersions(%q, %q) = %d, want %d", tt.b, tt.a, got, -tt.want)
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package metrics
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"syscall"
@@ -13,27 +15,56 @@ const (
 	TMPFS_MAGIC      = 0x01021994 // Magic number for tmpfs filesystem
 )
 
-var (
-	filesystemMetrics = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "system_filesystem_info",
-			Help: "Information about mounted filesystems",
-		},
-		[]string{"mount_point", "filesystem_type", "total_space", "used_space"},
-	)
-)
+type filesystemCollector struct {
+	info        *prometheus.Desc
+	mountPoints []string
+	paths       Paths
+}
+
+func init() {
+	registerCollector("filesystem", false, func(opts Options) Collector {
+		return newFilesystemCollector(opts.Config.Filesystem, opts.Paths)
+	})
+}
+
+// newFilesystemCollector returns a collector for the configured mount points.
+func newFilesystemCollector(cfg FilesystemConfig, paths Paths) Collector {
+	return &filesystemCollector{
+		info: prometheus.NewDesc(
+			"system_filesystem_info",
+			"Information about mounted filesystems",
+			[]string{"mount_point", "filesystem_type", "total_space", "used_space"}, nil,
+		),
+		mountPoints: cfg.MountPoints,
+		paths:       paths,
+	}
+}
 
-func RegisterFilesystemMetrics() {
-	prometheus.MustRegister(filesystemMetrics)
+func (c *filesystemCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.info
 }
 
-func CollectFilesystemMetrics() {
-	mountPoints := []string{"/", "/home", "/var"} // Add more mount points as needed
-	for _, mountPoint := range mountPoints {
+func (c *filesystemCollector) Update(ctx context.Context, ch chan<- prometheus.Metric) error {
+	var errs []error
+	seen := labelSet{}
+	for _, mountPoint := range c.mountPoints {
+		// statfs cannot be interrupted, so a hung mount is only noticed
+		// before the next one
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !seen.add(mountPoint) {
+			continue
+		}
+
 		var stat syscall.Statfs_t
-		err := syscall.Statfs(mountPoint, &stat)
+		err := statfs(c.paths.rootfs(mountPoint), &stat)
+		if errors.Is(err, syscall.ENOENT) {
+			log.Printf("Skipping missing mount point %s", mountPoint)
+			continue
+		}
 		if err != nil {
-			log.Printf("Error collecting filesystem metrics for %s: %v", mountPoint, err)
+			errs = append(errs, fmt.Errorf("collecting filesystem metrics for %s: %w", mountPoint, err))
 			continue
 		}
 
@@ -42,15 +73,19 @@ func CollectFilesystemMetrics() {
 		usedSpace := totalSpace - freeSpace
 		filesystemType := getFilesystemType(uint32(stat.Type))
 
-		filesystemMetrics.WithLabelValues(
+		ch <- prometheus.MustNewConstMetric(c.info, prometheus.GaugeValue, 1,
 			mountPoint,
 			filesystemType,
 			formatBytesFilesystem(totalSpace),
 			formatBytesFilesystem(usedSpace),
-		).Set(1)
+		)
 	}
+	return errors.Join(errs...)
 }
 
+// statfs is a variable so tests can report fixed filesystem sizes.
+var statfs = syscall.Statfs
+
 func getFilesystemType(fsType uint32) string {
 	switch fsType {
 	case EXT4_SUPER_MAGIC:
@@ -0,0 +1,57 @@
+package metrics
+
+import (
+	"math"
+	"runtime/debug"
+	"runtime/metrics"
+)
+
+// memoryShedRatio is the share of the memory limit above which expensive
+// collectors are skipped.
+const memoryShedRatio = 0.9
+
+// expensiveCollectors are the collectors skipped first when the exporter is
+// short on resources. They walk large parts of the filesystem or procfs and
+// allocate in proportion to the size of the host.
+var expensiveCollectors = map[string]bool{
+	"auditing":          true,
+	"package_integrity": true,
+	"process":           true,
+	"vulnerabilities":   true,
+}
+
+// ApplyMemoryLimit sets limit as the Go runtime's soft memory limit. The GC
+// runs more often as the heap approaches the limit instead of the process
+// being killed, and the GC percent is lowered so that garbage from one scrape
+// is reclaimed before the next one starts.
+func ApplyMemoryLimit(limit int64) {
+	debug.SetMemoryLimit(limit)
+	debug.SetGCPercent(50)
+}
+
+// memoryLimit returns the runtime's soft memory limit, or 0 when none is set.
+func memoryLimit() int64 {
+	limit := debug.SetMemoryLimit(-1)
+	if limit == math.MaxInt64 {
+		return 0
+	}
+	return limit
+}
+
+// memoryInUse returns the memory counted against the soft limit: everything
+// the runtime has mapped minus what it already returned to the OS.
+func memoryInUse() uint64 {
+	samples := []metrics.Sample{
+		{Name: "/memory/classes/total:bytes"},
+		{Name: "/memory/classes/heap/released:bytes"},
+	}
+	metrics.Read(samples)
+	return samples[0].Value.Uint64() - samples[1].Value.Uint64()
+}
+
+// underMemoryPressure reports whether memory use is close enough to the
+// limit that expensive collectors should be skipped.
+func underMemoryPressure() bool {
+	limit := memoryLimit()
+	return limit > 0 && float64(memoryInUse()) >= float64(limit)*memoryShedRatio
+}
@@ -1,33 +1,67 @@
 package metrics
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"net"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
 
-var (
-	networkMetrics = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "system_network_info",
-			Help: "Information about network interfaces",
-		},
-		[]string{"interface", "ip_address", "mac_address"},
-	)
-)
+type networkCollector struct {
+	info *prometheus.Desc
+}
 
 func init() {
-	prometheus.MustRegister(networkMetrics)
+	registerCollector("network", true, func(opts Options) Collector {
+		return newNetworkCollector()
+	})
+}
+
+// newNetworkCollector returns a collector for the network interfaces that
+// are up.
+func newNetworkCollector() Collector {
+	return &networkCollector{
+		info: prometheus.NewDesc(
+			"system_network_info",
+			"Information about network interfaces",
+			[]string{"interface", "ip_address", "mac_address"}, nil,
+		),
+	}
+}
+
+func (c *networkCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.info
+}
+
+func (c *networkCollector) Update(ctx context.Context, ch chan<- prometheus.Metric) error {
+	interfaces, err := listNetworkInterfaces()
+	if err != nil {
+		return fmt.Errorf("fetching network interfaces: %w", err)
+	}
+
+	for _, iface := range interfaces {
+		ch <- prometheus.MustNewConstMetric(c.info, prometheus.GaugeValue, 1, iface.name, iface.ipAddress, iface.macAddress)
+	}
+	return nil
+}
+
+type networkInterface struct {
+	name       string
+	ipAddress  string
+	macAddress string
 }
 
-func CollectNetworkMetrics() {
+// listNetworkInterfaces returns the interfaces that are up. It is a variable
+// so tests can replace the host's interfaces with fixed ones.
+var listNetworkInterfaces = func() ([]networkInterface, error) {
 	interfaces, err := net.Interfaces()
 	if err != nil {
-		log.Printf("Error fetching network interfaces: %v", err)
-		return
+		return nil, err
 	}
 
+	var result []networkInterface
 	for _, iface := range interfaces {
 		if iface.Flags&net.FlagUp == 0 {
 			// Skip interfaces that are down
@@ -54,6 +88,7 @@ func CollectNetworkMetrics() {
 			macAddress = "unknown"
 		}
 
-		networkMetrics.WithLabelValues(iface.Name, ipAddress, macAddress).Set(1)
+		result = append(result, networkInterface{name: iface.Name, ipAddress: ipAddress, macAddress: macAddress})
 	}
+	return result, nil
 }
@@ -0,0 +1,416 @@
+package metrics
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// OpenPGP packet tags (RFC 9580, section 5).
+const (
+	pgpTagSignature    = 2
+	pgpTagPublicKey    = 6
+	pgpTagUserID       = 13
+	pgpTagPublicSubkey = 14
+)
+
+// OpenPGP signature types and subpackets the parser reads.
+const (
+	pgpSigSubkeyBinding = 0x18
+	pgpSigDirectKey     = 0x1f
+
+	pgpSubpacketCreationTime      = 2
+	pgpSubpacketKeyExpirationTime = 9
+	pgpSubpacketIssuerKeyID       = 16
+	pgpSubpacketIssuerFingerprint = 33
+)
+
+// pgpKey is a primary key or subkey of an OpenPGP certificate.
+type pgpKey struct {
+	fingerprint string
+	// uid is the first user ID of the certificate the key belongs to.
+	uid     string
+	subkey  bool
+	created time.Time
+	// expires is zero for keys that do not expire.
+	expires time.Time
+}
+
+// pgpSelfSignature is what a self-signature says about a key.
+type pgpSelfSignature struct {
+	created time.Time
+	// lifetime is how long after its creation the key expires, or zero.
+	lifetime time.Duration
+}
+
+// parsePGPKeys returns the keys of the certificates in data, a keyring in
+// binary form or one or more ASCII-armored key blocks. Signatures are not
+// verified: a key's expiry is read from its newest self-signature, as the
+// inventory only needs to find keys about to expire.
+func parsePGPKeys(data []byte) ([]pgpKey, error) {
+	if bytes.Contains(data, []byte("-----BEGIN PGP PUBLIC KEY BLOCK-----")) {
+		blocks, err := dearmorPGP(data)
+		if err != nil {
+			return nil, err
+		}
+		var keys []pgpKey
+		for _, block := range blocks {
+			blockKeys, err := parsePGPPackets(block)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, blockKeys...)
+		}
+		return keys, nil
+	}
+	return parsePGPPackets(data)
+}
+
+// isPGPData reports whether data looks like an OpenPGP keyring, so that
+// other files in key directories can be skipped.
+func isPGPData(data []byte) bool {
+	if bytes.Contains(data, []byte("-----BEGIN PGP PUBLIC KEY BLOCK-----")) {
+		return true
+	}
+	if len(data) == 0 || data[0]&0x80 == 0 {
+		return false
+	}
+	tag := data[0] & 0x3f
+	if data[0]&0x40 == 0 {
+		tag = (data[0] >> 2) & 0x0f
+	}
+	return tag == pgpTagPublicKey
+}
+
+// dearmorPGP decodes the public key blocks of an ASCII-armored file. The
+// CRC24 checksum line is skipped.
+func dearmorPGP(data []byte) ([][]byte, error) {
+	var (
+		blocks [][]byte
+		body   strings.Builder
+		state  int // 0 outside a block, 1 in the armor headers, 2 in the body
+	)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "-----BEGIN PGP PUBLIC KEY BLOCK-----":
+			state = 1
+			body.Reset()
+		case line == "-----END PGP PUBLIC KEY BLOCK-----" && state != 0:
+			block, err := base64.StdEncoding.DecodeString(body.String())
+			if err != nil {
+				return nil, fmt.Errorf("decoding armored key: %w", err)
+			}
+			blocks = append(blocks, block)
+			state = 0
+		case state == 1:
+			// Headers such as "Comment:" end at the first blank line. Some
+			// tools write none at all.
+			if line == "" {
+				state = 2
+			} else if !strings.Contains(line, ": ") {
+				state = 2
+				body.WriteString(line)
+			}
+		case state == 2 && !strings.HasPrefix(line, "="):
+			body.WriteString(line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return blocks, nil
+}
+
+// parsePGPPackets walks the packets of a binary keyring. Every public key
+// packet starts a new certificate, and the public subkeys, user IDs and
+// signatures that follow belong to it.
+func parsePGPPackets(data []byte) ([]pgpKey, error) {
+	var (
+		keys []pgpKey
+		// primary is the index of the current certificate's primary key and
+		// current that of the key the next signatures are about.
+		primary, current = -1, -1
+		primaryKeyID     string
+		signatures       = map[int]pgpSelfSignature{}
+	)
+	finish := func() {
+		for i, sig := range signatures {
+			if sig.lifetime > 0 {
+				keys[i].expires = keys[i].created.Add(sig.lifetime)
+			}
+		}
+		signatures = map[int]pgpSelfSignature{}
+	}
+
+	for len(data) > 0 {
+		tag, body, rest, err := readPGPPacket(data)
+		if err != nil {
+			return nil, err
+		}
+		data = rest
+
+		switch tag {
+		case pgpTagPublicKey, pgpTagPublicSubkey:
+			key, keyID, err := parsePGPPublicKey(body)
+			if err != nil {
+				return nil, err
+			}
+			if tag == pgpTagPublicKey {
+				finish()
+				primary, primaryKeyID = len(keys), keyID
+			} else if primary < 0 {
+				return nil, errors.New("public subkey without a primary key")
+			} else {
+				key.subkey = true
+				key.uid = keys[primary].uid
+			}
+			current = len(keys)
+			keys = append(keys, key)
+		case pgpTagUserID:
+			if primary < 0 {
+				return nil, errors.New("user ID without a primary key")
+			}
+			if keys[primary].uid == "" {
+				keys[primary].uid = string(body)
+			}
+			// Certifications of the user ID are self-signatures of the
+			// primary key
+			current = primary
+		case pgpTagSignature:
+			if current < 0 {
+				continue
+			}
+			sig, sigType, issuer, err := parsePGPSignature(body)
+			if err != nil {
+				return nil, err
+			}
+			if issuer != "" && !strings.HasSuffix(keys[primary].fingerprint, issuer) && issuer != primaryKeyID {
+				// A certification by someone else
+				continue
+			}
+			isSelfSignature := (sigType >= 0x10 && sigType <= 0x13) || sigType == pgpSigDirectKey
+			if keys[current].subkey {
+				isSelfSignature = sigType == pgpSigSubkeyBinding
+			}
+			if isSelfSignature {
+				if previous, ok := signatures[current]; !ok || !sig.created.Before(previous.created) {
+					signatures[current] = sig
+				}
+			}
+		}
+	}
+	finish()
+
+	// Subkeys seen before the first user ID get the user ID too
+	for i := range keys {
+		if keys[i].subkey && keys[i].uid == "" {
+			for j := i; j >= 0; j-- {
+				if !keys[j].subkey {
+					keys[i].uid = keys[j].uid
+					break
+				}
+			}
+		}
+	}
+	return keys, nil
+}
+
+// readPGPPacket splits the first packet off data, in the old or the new
+// packet format.
+func readPGPPacket(data []byte) (tag byte, body, rest []byte, err error) {
+	header := data[0]
+	if header&0x80 == 0 {
+		return 0, nil, nil, errors.New("malformed OpenPGP packet header")
+	}
+	data = data[1:]
+
+	var length int
+	if header&0x40 != 0 {
+		tag = header & 0x3f
+		if len(data) == 0 {
+			return 0, nil, nil, errors.New("truncated OpenPGP packet")
+		}
+		switch first := int(data[0]); {
+		case first < 192:
+			length, data = first, data[1:]
+		case first < 224:
+			if len(data) < 2 {
+				return 0, nil, nil, errors.New("truncated OpenPGP packet")
+			}
+			length, data = (first-192)<<8+int(data[1])+192, data[2:]
+		case first == 255:
+			if len(data) < 5 {
+				return 0, nil, nil, errors.New("truncated OpenPGP packet")
+			}
+			length, data = int(binary.BigEndian.Uint32(data[1:5])), data[5:]
+		default:
+			return 0, nil, nil, errors.New("partial body lengths are not valid in keys")
+		}
+	} else {
+		tag = (header >> 2) & 0x0f
+		switch header & 0x03 {
+		case 0:
+			if len(data) < 1 {
+				return 0, nil, nil, errors.New("truncated OpenPGP packet")
+			}
+			length, data = int(data[0]), data[1:]
+		case 1:
+			if len(data) < 2 {
+				return 0, nil, nil, errors.New("truncated OpenPGP packet")
+			}
+			length, data = int(binary.BigEndian.Uint16(data)), data[2:]
+		case 2:
+			if len(data) < 4 {
+				return 0, nil, nil, errors.New("truncated OpenPGP packet")
+			}
+			length, data = int(binary.BigEndian.Uint32(data)), data[4:]
+		default:
+			length = len(data)
+		}
+	}
+	if length > len(data) {
+		return 0, nil, nil, errors.New("truncated OpenPGP packet")
+	}
+	return tag, data[:length], data[length:], nil
+}
+
+// parsePGPPublicKey reads the creation time of a version 4 or 6 key and
+// computes its fingerprint and key ID.
+func parsePGPPublicKey(body []byte) (pgpKey, string, error) {
+	if len(body) < 6 {
+		return pgpKey{}, "", errors.New("truncated OpenPGP public key")
+	}
+	key := pgpKey{created: time.Unix(int64(binary.BigEndian.Uint32(body[1:5])), 0)}
+	switch body[0] {
+	case 4:
+		h := sha1.New()
+		h.Write([]byte{0x99, byte(len(body) >> 8), byte(len(body))})
+		h.Write(body)
+		key.fingerprint = strings.ToUpper(hex.EncodeToString(h.Sum(nil)))
+		return key, key.fingerprint[24:], nil
+	case 6:
+		h := sha256.New()
+		h.Write([]byte{0x9b})
+		binary.Write(h, binary.BigEndian, uint32(len(body)))
+		h.Write(body)
+		key.fingerprint = strings.ToUpper(hex.EncodeToString(h.Sum(nil)))
+		return key, key.fingerprint[:16], nil
+	}
+	return pgpKey{}, "", fmt.Errorf("unsupported OpenPGP key version %d", body[0])
+}
+
+// parsePGPSignature reads the type, creation time, key expiration time and
+// issuer of a version 4 or 6 signature. The issuer is a key ID or
+// fingerprint in upper case hex, or "" when the signature names none.
+func parsePGPSignature(body []byte) (pgpSelfSignature, byte, string, error) {
+	var sig pgpSelfSignature
+	if len(body) < 4 {
+		return sig, 0, "", errors.New("truncated OpenPGP signature")
+	}
+	version, sigType := body[0], body[1]
+
+	var hashed, unhashed []byte
+	switch version {
+	case 4:
+		if len(body) < 6 {
+			return sig, 0, "", errors.New("truncated OpenPGP signature")
+		}
+		n := int(binary.BigEndian.Uint16(body[4:6]))
+		if len(body) < 8+n {
+			return sig, 0, "", errors.New("truncated OpenPGP signature")
+		}
+		hashed = body[6 : 6+n]
+		m := int(binary.BigEndian.Uint16(body[6+n : 8+n]))
+		if len(body) < 8+n+m {
+			return sig, 0, "", errors.New("truncated OpenPGP signature")
+		}
+		unhashed = body[8+n : 8+n+m]
+	case 6:
+		if len(body) < 8 {
+			return sig, 0, "", errors.New("truncated OpenPGP signature")
+		}
+		n := int(binary.BigEndian.Uint32(body[4:8]))
+		if len(body) < 12+n {
+			return sig, 0, "", errors.New("truncated OpenPGP signature")
+		}
+		hashed = body[8 : 8+n]
+		m := int(binary.BigEndian.Uint32(body[8+n : 12+n]))
+		if len(body) < 12+n+m {
+			return sig, 0, "", errors.New("truncated OpenPGP signature")
+		}
+		unhashed = body[12+n : 12+n+m]
+	default:
+		// Version 3 signatures carry no subpackets, and so no expiry
+		return sig, sigType, "", nil
+	}
+
+	var issuer string
+	err := readPGPSubpackets(hashed, func(kind byte, data []byte) {
+		switch kind {
+		case pgpSubpacketCreationTime:
+			if len(data) == 4 {
+				sig.created = time.Unix(int64(binary.BigEndian.Uint32(data)), 0)
+			}
+		case pgpSubpacketKeyExpirationTime:
+			if len(data) == 4 {
+				sig.lifetime = time.Duration(binary.BigEndian.Uint32(data)) * time.Second
+			}
+		}
+	})
+	if err != nil {
+		return sig, 0, "", err
+	}
+	// The issuer is often left unhashed
+	for _, subpackets := range [][]byte{hashed, unhashed} {
+		err := readPGPSubpackets(subpackets, func(kind byte, data []byte) {
+			switch {
+			case kind == pgpSubpacketIssuerKeyID && len(data) == 8:
+				issuer = strings.ToUpper(hex.EncodeToString(data))
+			case kind == pgpSubpacketIssuerFingerprint && len(data) > 1:
+				issuer = strings.ToUpper(hex.EncodeToString(data[1:]))
+			}
+		})
+		if err != nil {
+			return sig, 0, "", err
+		}
+	}
+	return sig, sigType, issuer, nil
+}
+
+// readPGPSubpackets calls fn with the type, without its critical bit, and
+// the data of every signature subpacket.
+func readPGPSubpackets(data []byte, fn func(kind byte, data []byte)) error {
+	for len(data) > 0 {
+		var length int
+		switch first := int(data[0]); {
+		case first < 192:
+			length, data = first, data[1:]
+		case first < 255:
+			if len(data) < 2 {
+				return errors.New("truncated OpenPGP subpacket")
+			}
+			length, data = (first-192)<<8+int(data[1])+192, data[2:]
+		default:
+			if len(data) < 5 {
+				return errors.New("truncated OpenPGP subpacket")
+			}
+			length, data = int(binary.BigEndian.Uint32(data[1:5])), data[5:]
+		}
+		if length == 0 || length > len(data) {
+			return errors.New("truncated OpenPGP subpacket")
+		}
+		fn(data[0]&0x7f, data[1:length])
+		data = data[length:]
+	}
+	return nil
+}
@@ -2,7 +2,8 @@ package metrics
 
 import (
 	"bufio"
-	"log"
+	"context"
+	"fmt"
 	"os"
 	"os/exec"
 	"runtime"
@@ -11,79 +12,120 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 )
 
-var osInfo = prometheus.NewGaugeVec(
-	prometheus.GaugeOpts{
-		Name: "system_os_info",
-		Help: "Operating system name, version, architecture, platform, and kernel version",
-	},
-	[]string{"os_name", "os_version", "architecture", "platform", "kernel_version"},
-)
+type osInfoCollector struct {
+	info  *prometheus.Desc
+	paths Paths
+}
 
 func init() {
-	prometheus.MustRegister(osInfo)
+	registerCollector("os", true, func(opts Options) Collector {
+		return newOSInfoCollector(opts.Paths)
+	})
+}
+
+// newOSInfoCollector returns a collector for the operating system details.
+func newOSInfoCollector(paths Paths) Collector {
+	return &osInfoCollector{
+		info: prometheus.NewDesc(
+			"system_os_info",
+			"Operating system name, version, architecture, platform, and kernel version",
+			[]string{"os_name", "os_version", "architecture", "platform", "kernel_version"}, nil,
+		),
+		paths: paths,
+	}
+}
+
+func (c *osInfoCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.info
 }
 
-func CollectOSInfo() {
+func (c *osInfoCollector) Update(ctx context.Context, ch chan<- prometheus.Metric) error {
 	architecture := runtime.GOARCH
 	platform := runtime.GOOS
 
-	// Fetch kernel version
-	cmd := exec.Command("uname", "-r")
-	output, err := cmd.Output()
+	kernelVersion, err := runningKernelVersion(ctx, c.paths)
 	if err != nil {
-		log.Printf("Error fetching kernel version: %v", err)
-		return
+		return fmt.Errorf("fetching kernel version: %w", err)
 	}
-	kernelVersion := strings.TrimSpace(string(output))
 
 	switch platform {
 	case "linux":
-		collectLinuxOSInfo(architecture, platform, kernelVersion)
+		return c.collectLinuxOSInfo(ch, architecture, platform, kernelVersion)
 	case "darwin":
-		collectMacOSInfo(architecture, platform, kernelVersion)
+		return c.collectMacOSInfo(ctx, ch, architecture, platform, kernelVersion)
 	default:
-		log.Println("OS information collection is not supported on this platform")
+		return fmt.Errorf("OS information collection is not supported on %s", platform)
 	}
 }
 
-func collectLinuxOSInfo(architecture, platform, kernelVersion string) {
-	file, err := os.Open("/etc/os-release")
+func (c *osInfoCollector) collectLinuxOSInfo(ch chan<- prometheus.Metric, architecture, platform, kernelVersion string) error {
+	release, err := readOSRelease(c.paths)
 	if err != nil {
-		log.Printf("Error opening /etc/os-release: %v", err)
-		return
+		return err
+	}
+
+	// Rolling releases such as Arch have no VERSION_ID, only a BUILD_ID
+	osName, osVersion := release["NAME"], release["VERSION_ID"]
+	if osVersion == "" {
+		osVersion = release["BUILD_ID"]
+	}
+	if osName == "" || osVersion == "" {
+		return fmt.Errorf("failed to extract OS name or version from /etc/os-release")
+	}
+
+	ch <- prometheus.MustNewConstMetric(c.info, prometheus.GaugeValue, 1, osName, osVersion, architecture, platform, kernelVersion)
+	return nil
+}
+
+// readOSRelease returns the fields of /etc/os-release with their quotes
+// removed. The first assignment of a field wins.
+func readOSRelease(paths Paths) (map[string]string, error) {
+	file, err := os.Open(paths.rootfs("/etc/os-release"))
+	if err != nil {
+		return nil, err
 	}
 	defer file.Close()
 
-	var osName, osVersion string
+	fields := map[string]string{}
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.HasPrefix(line, "NAME=") && osName == "" {
-			osName = strings.Trim(strings.TrimPrefix(line, "NAME="), "\"")
-		} else if strings.HasPrefix(line, "VERSION_ID=") && osVersion == "" {
-			osVersion = strings.Trim(strings.TrimPrefix(line, "VERSION_ID="), "\"")
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok || strings.HasPrefix(key, "#") {
+			continue
+		}
+		if _, seen := fields[key]; !seen {
+			fields[key] = strings.Trim(value, "\"'")
 		}
 	}
-
 	if err := scanner.Err(); err != nil {
-		log.Printf("Error reading /etc/os-release: %v", err)
-		return
+		return nil, fmt.Errorf("reading /etc/os-release: %w", err)
 	}
+	return fields, nil
+}
 
-	if osName == "" || osVersion == "" {
-		log.Println("Failed to extract OS name or version from /etc/os-release")
-		return
+// runningKernelVersion reads the running kernel release from procfs on
+// Linux so it honours --path.procfs, and falls back to uname elsewhere.
+func runningKernelVersion(ctx context.Context, paths Paths) (string, error) {
+	var (
+		output []byte
+		err    error
+	)
+	if runtime.GOOS == "linux" {
+		output, err = os.ReadFile(paths.proc("sys", "kernel", "osrelease"))
+	} else {
+		output, err = exec.CommandContext(ctx, "uname", "-r").Output()
 	}
-
-	osInfo.WithLabelValues(osName, osVersion, architecture, platform, kernelVersion).Set(1)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(output)), nil
 }
 
-func collectMacOSInfo(architecture, platform, kernelVersion string) {
-	cmd := exec.Command("sw_vers")
+func (c *osInfoCollector) collectMacOSInfo(ctx context.Context, ch chan<- prometheus.Metric, architecture, platform, kernelVersion string) error {
+	cmd := exec.CommandContext(ctx, "sw_vers")
 	output, err := cmd.Output()
 	if err != nil {
-		log.Printf("Error fetching macOS version: %v", err)
-		return
+		return fmt.Errorf("fetching macOS version: %w", err)
 	}
 
 	var osName, osVersion string
@@ -97,9 +139,9 @@ func collectMacOSInfo(architecture, platform, kernelVersion string) {
 	}
 
 	if osName == "" || osVersion == "" {
-		log.Println("Failed to extract macOS name or version")
-		return
+		return fmt.Errorf("failed to extract macOS name or version")
 	}
 
-	osInfo.WithLabelValues(osName, osVersion, architecture, platform, kernelVersion).Set(1)
+	ch <- prometheus.MustNewConstMetric(c.info, prometheus.GaugeValue, 1, osName, osVersion, architecture, platform, kernelVersion)
+	return nil
 }
@@ -0,0 +1,269 @@
+package metrics
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// osvRecord is the part of an OSV record (https://ossf.github.io/osv-schema/)
+// the matcher uses.
+type osvRecord struct {
+	ID               string         `json:"id"`
+	Aliases          []string       `json:"aliases"`
+	Upstream         []string       `json:"upstream"`
+	Withdrawn        string         `json:"withdrawn"`
+	Severity         []osvSeverity  `json:"severity"`
+	Affected         []osvAffected  `json:"affected"`
+	DatabaseSpecific map[string]any `json:"database_specific"`
+}
+
+type osvSeverity struct {
+	Type  string `json:"type"`
+	Score string `json:"score"`
+}
+
+type osvAffected struct {
+	Package struct {
+		Ecosystem string `json:"ecosystem"`
+		Name      string `json:"name"`
+	} `json:"package"`
+	Severity          []osvSeverity  `json:"severity"`
+	Ranges            []osvRange     `json:"ranges"`
+	Versions          []string       `json:"versions"`
+	EcosystemSpecific map[string]any `json:"ecosystem_specific"`
+	DatabaseSpecific  map[string]any `json:"database_specific"`
+}
+
+type osvRange struct {
+	Type   string     `json:"type"`
+	Events []osvEvent `json:"events"`
+}
+
+type osvEvent struct {
+	Introduced   string `json:"introduced"`
+	Fixed        string `json:"fixed"`
+	LastAffected string `json:"last_affected"`
+	Limit        string `json:"limit"`
+}
+
+// osvEntry is one affected package of a record, kept for the host's
+// ecosystem.
+type osvEntry struct {
+	cves     []string
+	severity string
+	affected osvAffected
+}
+
+// osvEcosystem returns the OSV ecosystem of the distribution release in
+// /etc/os-release, such as Debian:12 or Alpine:v3.19, or "" for
+// distributions OSV has no data for.
+func osvEcosystem(release map[string]string) string {
+	version := release["VERSION_ID"]
+	if version == "" {
+		return ""
+	}
+	major, _, _ := strings.Cut(version, ".")
+	switch release["ID"] {
+	case "debian":
+		return "Debian:" + major
+	case "ubuntu":
+		return "Ubuntu:" + version
+	case "alpine":
+		parts := strings.SplitN(version, ".", 3)
+		if len(parts) < 2 {
+			return ""
+		}
+		return "Alpine:v" + parts[0] + "." + parts[1]
+	case "rocky":
+		return "Rocky Linux:" + major
+	case "almalinux":
+		return "AlmaLinux:" + major
+	}
+	return ""
+}
+
+// matchesEcosystem reports whether ecosystem is the host's. Ubuntu qualifies
+// its releases, as in Ubuntu:22.04:LTS.
+func matchesEcosystem(ecosystem, host string) bool {
+	return host != "" && (ecosystem == host || strings.HasPrefix(ecosystem, host+":"))
+}
+
+// loadOSVFile adds the records of a .json file, or of every .json file in a
+// .zip such as the all.zip of an OSV data dump, to entries by package name.
+// Only packages of the host's ecosystem are kept.
+func loadOSVFile(path, ecosystem string, entries map[string][]osvEntry) error {
+	if strings.HasSuffix(path, ".zip") {
+		archive, err := zip.OpenReader(path)
+		if err != nil {
+			return err
+		}
+		defer archive.Close()
+		for _, file := range archive.File {
+			if !strings.HasSuffix(file.Name, ".json") {
+				continue
+			}
+			r, err := file.Open()
+			if err != nil {
+				return err
+			}
+			err = loadOSVRecord(r, ecosystem, entries)
+			r.Close()
+			if err != nil {
+				return fmt.Errorf("parsing %s in %s: %w", file.Name, path, err)
+			}
+		}
+		return nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := loadOSVRecord(file, ecosystem, entries); err != nil {
+		return fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return nil
+}
+
+func loadOSVRecord(r io.Reader, ecosystem string, entries map[string][]osvEntry) error {
+	var record osvRecord
+	if err := json.NewDecoder(r).Decode(&record); err != nil {
+		return err
+	}
+	if record.Withdrawn != "" {
+		return nil
+	}
+	for _, affected := range record.Affected {
+		if !matchesEcosystem(affected.Package.Ecosystem, ecosystem) {
+			continue
+		}
+		name := affected.Package.Name
+		entries[name] = append(entries[name], osvEntry{
+			cves:     record.cves(),
+			severity: record.severity(affected),
+			affected: affected,
+		})
+	}
+	return nil
+}
+
+// cves returns the CVE IDs of the record, or its own ID when it has none,
+// so that a CVE published by several databases is counted once.
+func (r osvRecord) cves() []string {
+	var cves []string
+	seen := labelSet{}
+	for _, id := range append(append([]string{r.ID}, r.Aliases...), r.Upstream...) {
+		if strings.HasPrefix(id, "CVE-") && seen.add(id) {
+			cves = append(cves, id)
+		}
+	}
+	if len(cves) == 0 {
+		return []string{r.ID}
+	}
+	return cves
+}
+
+// severity returns the severity of the record for one affected package.
+// Ratings given by the distribution, such as Debian's urgency or Ubuntu's
+// priority, take precedence over a CVSS v3 score.
+func (r osvRecord) severity(affected osvAffected) string {
+	for _, fields := range []map[string]any{affected.EcosystemSpecific, affected.DatabaseSpecific, r.DatabaseSpecific} {
+		for _, key := range []string{"severity", "urgency"} {
+			if value, ok := fields[key].(string); ok {
+				if severity := normalizeSeverity(value); severity != severityUnknown {
+					return severity
+				}
+			}
+		}
+	}
+
+	ratings := append(append([]osvSeverity{}, affected.Severity...), r.Severity...)
+	for _, rating := range ratings {
+		if !strings.HasPrefix(rating.Type, "CVSS_") {
+			if severity := normalizeSeverity(rating.Score); severity != severityUnknown {
+				return severity
+			}
+		}
+	}
+	for _, rating := range ratings {
+		if rating.Type == "CVSS_V3" {
+			if score, err := cvss3BaseScore(rating.Score); err == nil {
+				return cvssSeverity(score)
+			}
+		}
+	}
+	return severityUnknown
+}
+
+// affects reports whether version is one of the affected versions or falls
+// in one of the ECOSYSTEM ranges, ordered by compare.
+func (a osvAffected) affects(version string, compare func(a, b string) int) bool {
+	for _, v := range a.Versions {
+		if compare(v, version) == 0 {
+			return true
+		}
+	}
+	for _, r := range a.Ranges {
+		if r.Type == "ECOSYSTEM" && r.affects(version, compare) {
+			return true
+		}
+	}
+	return false
+}
+
+// affects walks the events of the range in version order. Every introduced
+// event version has reached makes it affected, and every fixed or
+// last_affected event it has passed makes it unaffected again.
+func (r osvRange) affects(version string, compare func(a, b string) int) bool {
+	events := make([]osvEvent, 0, len(r.Events))
+	for _, e := range r.Events {
+		if e.version() != "" {
+			events = append(events, e)
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		a, b := events[i], events[j]
+		if a.Introduced == "0" || b.Introduced == "0" {
+			return a.Introduced == "0" && b.Introduced != "0"
+		}
+		return compare(a.version(), b.version()) < 0
+	})
+
+	affected := false
+	for _, e := range events {
+		switch {
+		case e.Introduced != "":
+			if e.Introduced == "0" || compare(version, e.Introduced) >= 0 {
+				affected = true
+			}
+		case e.Fixed != "":
+			if compare(version, e.Fixed) >= 0 {
+				affected = false
+			}
+		case e.LastAffected != "":
+			if compare(version, e.LastAffected) > 0 {
+				affected = false
+			}
+		}
+	}
+	return affected
+}
+
+// version returns the version of the event. Limit events only bound git
+// commit ranges and are ignored.
+func (e osvEvent) version() string {
+	switch {
+	case e.Introduced != "":
+		return e.Introduced
+	case e.Fixed != "":
+		return e.Fixed
+	default:
+		return e.LastAffected
+	}
+}
@@ -0,0 +1,571 @@
+package metrics
+
+import (
+	"compress/bzip2"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// ovalDocument is the part of an OVAL definitions file, as published by
+// Debian, Ubuntu and Red Hat, the matcher evaluates. Only definitions for the
+// host's platform are kept.
+type ovalDocument struct {
+	definitions map[string]*ovalDefinition
+	tests       map[string]*ovalTest
+	objects     map[string]*ovalObject
+	states      map[string]*ovalState
+	variables   map[string][]string
+}
+
+type ovalDefinition struct {
+	ID       string `xml:"id,attr"`
+	Class    string `xml:"class,attr"`
+	Metadata struct {
+		Platforms  []string `xml:"affected>platform"`
+		References []struct {
+			Source string `xml:"source,attr"`
+			RefID  string `xml:"ref_id,attr"`
+		} `xml:"reference"`
+		Severity string `xml:"advisory>severity"`
+	} `xml:"metadata"`
+	Criteria *ovalCriteria `xml:"criteria"`
+}
+
+type ovalCriteria struct {
+	Operator   string          `xml:"operator,attr"`
+	Negate     bool            `xml:"negate,attr"`
+	Criteria   []ovalCriteria  `xml:"criteria"`
+	Criterions []ovalCriterion `xml:"criterion"`
+	Extends    []ovalExtend    `xml:"extend_definition"`
+}
+
+type ovalCriterion struct {
+	TestRef string `xml:"test_ref,attr"`
+	Negate  bool   `xml:"negate,attr"`
+}
+
+type ovalExtend struct {
+	DefinitionRef string `xml:"definition_ref,attr"`
+	Negate        bool   `xml:"negate,attr"`
+}
+
+type ovalTest struct {
+	// kind is the element name, such as dpkginfo_test.
+	kind   string
+	Object struct {
+		Ref string `xml:"object_ref,attr"`
+	} `xml:"object"`
+	States []ovalStateRef `xml:"state"`
+}
+
+type ovalStateRef struct {
+	Ref string `xml:"state_ref,attr"`
+}
+
+type ovalObject struct {
+	Name     ovalValue `xml:"name"`
+	Filepath ovalValue `xml:"filepath"`
+	Path     ovalValue `xml:"path"`
+	Filename ovalValue `xml:"filename"`
+	Pattern  ovalValue `xml:"pattern"`
+}
+
+// ovalState holds the entities the evaluator checks. Others, such as the
+// signing key of an RPM, are taken as satisfied.
+type ovalState struct {
+	EVR           *ovalValue `xml:"evr"`
+	Subexpression *ovalValue `xml:"subexpression"`
+	Family        *ovalValue `xml:"family"`
+}
+
+type ovalValue struct {
+	Value     string `xml:",chardata"`
+	Operation string `xml:"operation,attr"`
+	VarRef    string `xml:"var_ref,attr"`
+}
+
+type ovalVariable struct {
+	Values []string `xml:"value"`
+}
+
+// loadOVALFile parses an OVAL definitions file, compressed with bzip2 when
+// its name ends in .bz2, keeping the definitions whose platform is the
+// host's distribution release.
+func loadOVALFile(path string, release map[string]string) (*ovalDocument, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var r io.Reader = file
+	if strings.HasSuffix(path, ".bz2") {
+		r = bzip2.NewReader(file)
+	}
+
+	doc := &ovalDocument{
+		definitions: map[string]*ovalDefinition{},
+		tests:       map[string]*ovalTest{},
+		objects:     map[string]*ovalObject{},
+		states:      map[string]*ovalState{},
+		variables:   map[string][]string{},
+	}
+	// The file is decoded one element at a time, as Red Hat's run to
+	// hundreds of megabytes
+	decoder := xml.NewDecoder(r)
+	var section string
+	for {
+		token, err := decoder.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch start.Name.Local {
+		case "oval_definitions", "definitions", "tests", "objects", "states", "variables":
+			section = start.Name.Local
+			continue
+		}
+
+		var id string
+		for _, attr := range start.Attr {
+			if attr.Name.Local == "id" {
+				id = attr.Value
+			}
+		}
+		switch section {
+		case "definitions":
+			def := &ovalDefinition{}
+			if err := decoder.DecodeElement(def, &start); err != nil {
+				return nil, err
+			}
+			if ovalAppliesTo(def.Metadata.Platforms, release) {
+				doc.definitions[def.ID] = def
+			}
+		case "tests":
+			test := &ovalTest{kind: start.Name.Local}
+			if err := decoder.DecodeElement(test, &start); err != nil {
+				return nil, err
+			}
+			doc.tests[id] = test
+		case "objects":
+			object := &ovalObject{}
+			if err := decoder.DecodeElement(object, &start); err != nil {
+				return nil, err
+			}
+			doc.objects[id] = object
+		case "states":
+			state := &ovalState{}
+			if err := decoder.DecodeElement(state, &start); err != nil {
+				return nil, err
+			}
+			doc.states[id] = state
+		case "variables":
+			variable := &ovalVariable{}
+			if err := decoder.DecodeElement(variable, &start); err != nil {
+				return nil, err
+			}
+			doc.variables[id] = variable.Values
+		default:
+			if err := decoder.Skip(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return doc, nil
+}
+
+// ovalAppliesTo reports whether a definition for platforms, such as
+// "Debian GNU/Linux 12" or "Ubuntu 22.04 LTS", applies to the release in
+// /etc/os-release. Definitions without a platform apply everywhere.
+func ovalAppliesTo(platforms []string, release map[string]string) bool {
+	if len(platforms) == 0 {
+		return true
+	}
+	name, version := release["NAME"], release["VERSION_ID"]
+	if name == "" || version == "" {
+		return false
+	}
+	major, _, _ := strings.Cut(version, ".")
+	for _, platform := range platforms {
+		for _, v := range []string{version, major} {
+			if platform == name+" "+v || strings.HasPrefix(platform, name+" "+v+" ") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// cves returns the CVE IDs a definition references, or its first reference
+// or its own ID when it references no CVE.
+func (d *ovalDefinition) cves() []string {
+	var cves []string
+	seen := labelSet{}
+	for _, ref := range d.Metadata.References {
+		if ref.Source == "CVE" && seen.add(ref.RefID) {
+			cves = append(cves, ref.RefID)
+		}
+	}
+	if len(cves) > 0 {
+		return cves
+	}
+	if len(d.Metadata.References) > 0 && d.Metadata.References[0].RefID != "" {
+		return []string{d.Metadata.References[0].RefID}
+	}
+	return []string{d.ID}
+}
+
+// ovalResult is the outcome of evaluating OVAL logic. Tests the evaluator
+// does not implement are unknown, and so is any definition whose outcome
+// depends on them.
+type ovalResult int
+
+const (
+	ovalFalse ovalResult = iota
+	ovalTrue
+	ovalUnknown
+)
+
+func (r ovalResult) negate(negate bool) ovalResult {
+	if !negate || r == ovalUnknown {
+		return r
+	}
+	if r == ovalTrue {
+		return ovalFalse
+	}
+	return ovalTrue
+}
+
+// ovalEvaluator evaluates the definitions of one document against the host.
+type ovalEvaluator struct {
+	doc      *ovalDocument
+	paths    Paths
+	packages map[string][]installedPackage
+	// sources holds the installed packages by source package name, for those
+	// named differently from their source.
+	sources map[string][]installedPackage
+	// definitions caches results, and marks definitions being evaluated as
+	// unknown so that circular references end.
+	definitions map[string]ovalEvaluation
+}
+
+// ovalEvaluation is a result and, when true, the installed packages whose
+// version made it so.
+type ovalEvaluation struct {
+	result   ovalResult
+	packages []string
+}
+
+func newOVALEvaluator(doc *ovalDocument, paths Paths, packages []installedPackage) *ovalEvaluator {
+	e := &ovalEvaluator{
+		doc:         doc,
+		paths:       paths,
+		packages:    map[string][]installedPackage{},
+		sources:     map[string][]installedPackage{},
+		definitions: map[string]ovalEvaluation{},
+	}
+	for _, pkg := range packages {
+		e.packages[pkg.name] = append(e.packages[pkg.name], pkg)
+		if pkg.source != "" && pkg.source != pkg.name {
+			e.sources[pkg.source] = append(e.sources[pkg.source], pkg)
+		}
+	}
+	return e
+}
+
+func (e *ovalEvaluator) definition(id string) ovalEvaluation {
+	if result, ok := e.definitions[id]; ok {
+		return result
+	}
+	def, ok := e.doc.definitions[id]
+	if !ok || def.Criteria == nil {
+		return ovalEvaluation{result: ovalUnknown}
+	}
+	e.definitions[id] = ovalEvaluation{result: ovalUnknown}
+	result := e.criteria(def.Criteria)
+	e.definitions[id] = result
+	return result
+}
+
+// criteria combines its children with AND, the default, or OR. Packages of
+// negated results are dropped, as they are not what made the result true.
+func (e *ovalEvaluator) criteria(c *ovalCriteria) ovalEvaluation {
+	var children []ovalEvaluation
+	for i := range c.Criteria {
+		children = append(children, e.criteria(&c.Criteria[i]))
+	}
+	for _, criterion := range c.Criterions {
+		child := e.test(criterion.TestRef)
+		if criterion.Negate {
+			child = ovalEvaluation{result: child.result.negate(true)}
+		}
+		children = append(children, child)
+	}
+	for _, extend := range c.Extends {
+		child := e.definition(extend.DefinitionRef)
+		if extend.Negate {
+			child = ovalEvaluation{result: child.result.negate(true)}
+		}
+		children = append(children, child)
+	}
+	if len(children) == 0 {
+		return ovalEvaluation{result: ovalUnknown}
+	}
+
+	var combined ovalEvaluation
+	switch strings.ToUpper(c.Operator) {
+	case "", "AND":
+		combined.result = ovalTrue
+		for _, child := range children {
+			switch {
+			case child.result == ovalFalse:
+				return ovalEvaluation{result: ovalFalse.negate(c.Negate)}
+			case child.result == ovalUnknown:
+				combined.result = ovalUnknown
+			}
+			combined.packages = append(combined.packages, child.packages...)
+		}
+	case "OR":
+		combined.result = ovalFalse
+		for _, child := range children {
+			switch {
+			case child.result == ovalTrue:
+				combined.result = ovalTrue
+				combined.packages = append(combined.packages, child.packages...)
+			case child.result == ovalUnknown && combined.result == ovalFalse:
+				combined.result = ovalUnknown
+			}
+		}
+	default:
+		return ovalEvaluation{result: ovalUnknown}
+	}
+
+	if c.Negate {
+		return ovalEvaluation{result: combined.result.negate(true)}
+	}
+	if combined.result != ovalTrue {
+		combined.packages = nil
+	}
+	return combined
+}
+
+func (e *ovalEvaluator) test(id string) ovalEvaluation {
+	test, ok := e.doc.tests[id]
+	if !ok {
+		return ovalEvaluation{result: ovalUnknown}
+	}
+	var states []*ovalState
+	for _, ref := range test.States {
+		state, ok := e.doc.states[ref.Ref]
+		if !ok {
+			return ovalEvaluation{result: ovalUnknown}
+		}
+		states = append(states, state)
+	}
+	object := e.doc.objects[test.Object.Ref]
+
+	switch test.kind {
+	case "dpkginfo_test":
+		// Debian names source packages in its definitions and Ubuntu
+		// binary ones, so both names are looked up
+		return e.packageTest(object, states, CompareDebianVersions, true)
+	case "rpminfo_test":
+		return e.packageTest(object, states, CompareRPMVersions, false)
+	case "textfilecontent54_test":
+		return ovalEvaluation{result: e.textFileTest(object, states)}
+	case "family_test":
+		for _, state := range states {
+			if state.Family == nil || state.Family.Value != "unix" {
+				return ovalEvaluation{result: ovalFalse}
+			}
+		}
+		return ovalEvaluation{result: ovalTrue}
+	case "uname_test":
+		if len(states) == 0 {
+			return ovalEvaluation{result: ovalTrue}
+		}
+	}
+	return ovalEvaluation{result: ovalUnknown}
+}
+
+// packageTest is true when an installed package named by object satisfies
+// every state. Such packages count as vulnerable when the test compares
+// their version, or checks nothing but that they are installed, as Ubuntu
+// does for vulnerabilities without a fix. With bySource, packages are also
+// found by their source package name.
+func (e *ovalEvaluator) packageTest(object *ovalObject, states []*ovalState, compare func(a, b string) int, bySource bool) ovalEvaluation {
+	if object == nil {
+		return ovalEvaluation{result: ovalUnknown}
+	}
+	names, ok := e.values(object.Name)
+	if !ok {
+		return ovalEvaluation{result: ovalUnknown}
+	}
+
+	versionCheck := len(states) == 0
+	for _, state := range states {
+		if state.EVR != nil {
+			versionCheck = true
+		}
+	}
+
+	result := ovalEvaluation{result: ovalFalse}
+	for _, name := range names {
+		candidates := e.packages[name]
+		if bySource {
+			candidates = append(slices.Clip(candidates), e.sources[name]...)
+		}
+		for _, pkg := range candidates {
+			satisfied := ovalTrue
+			for _, state := range states {
+				if state.EVR == nil {
+					continue
+				}
+				if r := ovalCompare(pkg.version, state.EVR.Operation, state.EVR.Value, compare); r != ovalTrue {
+					satisfied = r
+					break
+				}
+			}
+			switch satisfied {
+			case ovalTrue:
+				result.result = ovalTrue
+				if versionCheck {
+					result.packages = append(result.packages, pkg.name)
+				}
+			case ovalUnknown:
+				if result.result == ovalFalse {
+					result.result = ovalUnknown
+				}
+			}
+		}
+	}
+	if result.result != ovalTrue {
+		result.packages = nil
+	}
+	return result
+}
+
+// ovalCompare applies a version operation, such as "less than", to the
+// installed version.
+func ovalCompare(installed, operation, version string, compare func(a, b string) int) ovalResult {
+	c := compare(installed, version)
+	var ok bool
+	switch operation {
+	case "less than":
+		ok = c < 0
+	case "less than or equal":
+		ok = c <= 0
+	case "", "equals":
+		ok = c == 0
+	case "not equal":
+		ok = c != 0
+	case "greater than":
+		ok = c > 0
+	case "greater than or equal":
+		ok = c >= 0
+	default:
+		return ovalUnknown
+	}
+	if ok {
+		return ovalTrue
+	}
+	return ovalFalse
+}
+
+// textFileTest matches the pattern of object against a file, as Debian and
+// Ubuntu do to check the release in /etc/debian_version or /etc/lsb-release.
+// The states compare the first subexpression of a match.
+func (e *ovalEvaluator) textFileTest(object *ovalObject, states []*ovalState) ovalResult {
+	if object == nil || object.Pattern.VarRef != "" || object.Filepath.VarRef != "" {
+		return ovalUnknown
+	}
+	path := object.Filepath.Value
+	if path == "" {
+		path = filepath.Join(object.Path.Value, object.Filename.Value)
+	}
+	if !filepath.IsAbs(path) {
+		return ovalUnknown
+	}
+	// Patterns are multiline unless the object's behaviors say otherwise
+	pattern, err := regexp.Compile("(?m)" + object.Pattern.Value)
+	if err != nil {
+		return ovalUnknown
+	}
+	data, err := os.ReadFile(e.paths.rootfs(path))
+	if errors.Is(err, fs.ErrNotExist) {
+		return ovalFalse
+	}
+	if err != nil {
+		return ovalUnknown
+	}
+
+	result := ovalFalse
+	for _, match := range pattern.FindAllStringSubmatch(string(data), -1) {
+		value := match[0]
+		if len(match) > 1 {
+			value = match[1]
+		}
+		satisfied := ovalTrue
+		for _, state := range states {
+			if state.Subexpression == nil {
+				continue
+			}
+			if r := ovalMatchText(value, state.Subexpression); r != ovalTrue {
+				satisfied = r
+				break
+			}
+		}
+		if satisfied == ovalTrue {
+			return ovalTrue
+		}
+		if satisfied == ovalUnknown {
+			result = ovalUnknown
+		}
+	}
+	return result
+}
+
+func ovalMatchText(value string, expected *ovalValue) ovalResult {
+	var ok bool
+	switch expected.Operation {
+	case "", "equals":
+		ok = value == expected.Value
+	case "not equal":
+		ok = value != expected.Value
+	case "pattern match":
+		pattern, err := regexp.Compile(expected.Value)
+		if err != nil {
+			return ovalUnknown
+		}
+		ok = pattern.MatchString(value)
+	default:
+		return ovalUnknown
+	}
+	if ok {
+		return ovalTrue
+	}
+	return ovalFalse
+}
+
+// values returns the value of an entity, or the values of the constant
+// variable it refers to.
+func (e *ovalEvaluator) values(v ovalValue) ([]string, bool) {
+	if v.VarRef == "" {
+		return []string{strings.TrimSpace(v.Value)}, true
+	}
+	values, ok := e.doc.variables[v.VarRef]
+	return values, ok && len(values) > 0
+}
@@ -0,0 +1,603 @@
+package metrics
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Package change actions.
+const (
+	packageActionInstall   = "install"
+	packageActionUpgrade   = "upgrade"
+	packageActionDowngrade = "downgrade"
+	packageActionRemove    = "remove"
+	// packageActionPurge is dpkg removing the configuration files of a
+	// package, after or along with removing it.
+	packageActionPurge = "purge"
+)
+
+// packageChangeKey identifies a counter of package changes.
+type packageChangeKey struct {
+	manager string
+	pkg     string
+	action  string
+}
+
+// packageHistory accumulates the package changes read from the logs and
+// history databases of the package managers.
+type packageHistory struct {
+	changes     map[packageChangeKey]float64
+	lastChange  map[string]time.Time
+	lastUpgrade map[string]time.Time
+}
+
+func (h *packageHistory) record(manager, pkg, action string, at time.Time) {
+	h.changes[packageChangeKey{manager: manager, pkg: pkg, action: action}]++
+	if at.After(h.lastChange[manager]) {
+		h.lastChange[manager] = at
+	}
+}
+
+func (h *packageHistory) recordFullUpgrade(manager string, at time.Time) {
+	if at.After(h.lastUpgrade[manager]) {
+		h.lastUpgrade[manager] = at
+	}
+}
+
+type packageHistoryCollector struct {
+	changes     *prometheus.Desc
+	lastChange  *prometheus.Desc
+	lastUpgrade *prometheus.Desc
+	paths       Paths
+	state       *packageHistoryState
+}
+
+// packageHistoryState is the history read so far and the positions reading
+// carries on from. It is handed over to the collector replacing this one on
+// a configuration reload, so that counters do not reset and logs are not
+// counted twice.
+type packageHistoryState struct {
+	// mu serialises scrapes, which advance the positions below.
+	mu      sync.Mutex
+	history packageHistory
+	dpkgLog logTail
+	aptLog  logTail
+	apt     aptHistoryParser
+	yumLog  logTail
+	// lastDNFTransaction is the ID of the last dnf transaction read.
+	lastDNFTransaction int64
+}
+
+func init() {
+	registerCollector("package_history", true, func(opts Options) Collector {
+		return newPackageHistoryCollector(opts.Paths)
+	})
+}
+
+// newPackageHistoryCollector returns a collector for the package changes
+// recorded by dpkg, apt, dnf and yum. Logs are read incrementally, so every
+// scrape only parses what was appended since the previous one.
+func newPackageHistoryCollector(paths Paths) Collector {
+	return &packageHistoryCollector{
+		changes: prometheus.NewDesc(
+			"system_package_changes_total",
+			"Number of times a package was installed, upgraded, downgraded, removed or purged, as recorded by the package manager",
+			[]string{"manager", "package", "action"}, nil,
+		),
+		lastChange: prometheus.NewDesc(
+			"system_package_last_change_timestamp_seconds",
+			"Unix timestamp of the last package change recorded by the package manager",
+			[]string{"manager"}, nil,
+		),
+		lastUpgrade: prometheus.NewDesc(
+			"system_package_last_full_upgrade_timestamp_seconds",
+			"Unix timestamp of the end of the last transaction that upgraded all packages",
+			[]string{"manager"}, nil,
+		),
+		paths: paths,
+		state: &packageHistoryState{
+			history: packageHistory{
+				changes:     map[packageChangeKey]float64{},
+				lastChange:  map[string]time.Time{},
+				lastUpgrade: map[string]time.Time{},
+			},
+			dpkgLog: logTail{path: paths.rootfs("/var/log/dpkg.log")},
+			aptLog:  logTail{path: paths.rootfs("/var/log/apt/history.log")},
+			yumLog:  logTail{path: paths.rootfs("/var/log/yum.log")},
+		},
+	}
+}
+
+// inherit takes over the history of the collector being replaced, unless it
+// read another root filesystem.
+func (c *packageHistoryCollector) inherit(previous Collector) {
+	if prev, ok := previous.(*packageHistoryCollector); ok && prev.paths == c.paths {
+		c.state = prev.state
+	}
+}
+
+func (c *packageHistoryCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.changes
+	ch <- c.lastChange
+	ch <- c.lastUpgrade
+}
+
+func (c *packageHistoryCollector) Update(ctx context.Context, ch chan<- prometheus.Metric) error {
+	s := c.state
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var errs []error
+	err := s.dpkgLog.read(ctx, func(line string) {
+		parseDpkgLogLine(&s.history, line)
+	})
+	if err != nil {
+		errs = append(errs, fmt.Errorf("reading dpkg.log: %w", err))
+	}
+	err = s.aptLog.read(ctx, func(line string) {
+		s.apt.parseLine(&s.history, line)
+	})
+	if err != nil {
+		errs = append(errs, fmt.Errorf("reading apt history: %w", err))
+	}
+	if err := c.readDNFHistory(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("reading dnf history: %w", err))
+	}
+	now := timeNow()
+	err = s.yumLog.read(ctx, func(line string) {
+		parseYumLogLine(&s.history, line, now)
+	})
+	if err != nil {
+		errs = append(errs, fmt.Errorf("reading yum.log: %w", err))
+	}
+
+	keys := make([]packageChangeKey, 0, len(s.history.changes))
+	for key := range s.history.changes {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.manager != b.manager {
+			return a.manager < b.manager
+		}
+		if a.pkg != b.pkg {
+			return a.pkg < b.pkg
+		}
+		return a.action < b.action
+	})
+	for _, key := range keys {
+		ch <- prometheus.MustNewConstMetric(c.changes, prometheus.CounterValue, s.history.changes[key], key.manager, key.pkg, key.action)
+	}
+	for manager, at := range s.history.lastChange {
+		ch <- prometheus.MustNewConstMetric(c.lastChange, prometheus.GaugeValue, float64(at.Unix()), manager)
+	}
+	for manager, at := range s.history.lastUpgrade {
+		ch <- prometheus.MustNewConstMetric(c.lastUpgrade, prometheus.GaugeValue, float64(at.Unix()), manager)
+	}
+	return errors.Join(errs...)
+}
+
+// logTail reads a log file incrementally across scrapes and follows it when
+// logrotate renames it to <path>.1 and starts a new one.
+type logTail struct {
+	path string
+
+	started bool
+	// file is the log read last and offset the end of its last complete
+	// line.
+	file   os.FileInfo
+	offset int64
+}
+
+// read calls fn for every complete line appended to the log since the last
+// call. The first call also reads the rotated logs, oldest first, so the
+// counts start from everything the host still has. A missing log is not an
+// error.
+func (t *logTail) read(ctx context.Context, fn func(line string)) error {
+	if !t.started {
+		t.started = true
+		if err := readRotatedLogs(ctx, t.path, fn); err != nil {
+			return err
+		}
+	} else if t.file != nil {
+		// The log may have been rotated since the last scrape, in which
+		// case the rest of the old one is read first
+		if rotated, err := os.Stat(t.path + ".1"); err == nil && os.SameFile(rotated, t.file) {
+			if _, err := readLines(t.path+".1", t.offset, fn); err != nil {
+				return err
+			}
+			t.file, t.offset = nil, 0
+		}
+	}
+
+	file, err := os.Open(t.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		t.file, t.offset = nil, 0
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	// Start over on a new log, or on one truncated in place, which is only
+	// noticed once it is shorter than what was read
+	if t.file == nil || !os.SameFile(info, t.file) || info.Size() < t.offset {
+		t.offset = 0
+	}
+	t.file = info
+
+	consumed, err := scanLines(file, t.offset, fn)
+	t.offset += consumed
+	return err
+}
+
+// readRotatedLogs reads <path>.N and <path>.N.gz, from the highest N down to
+// <path>.1.
+func readRotatedLogs(ctx context.Context, path string, fn func(line string)) error {
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return err
+	}
+
+	type rotatedLog struct {
+		path string
+		n    int
+	}
+	var logs []rotatedLog
+	for _, match := range matches {
+		suffix := strings.TrimSuffix(strings.TrimPrefix(match, path+"."), ".gz")
+		if n, err := strconv.Atoi(suffix); err == nil {
+			logs = append(logs, rotatedLog{path: match, n: n})
+		}
+	}
+	sort.Slice(logs, func(i, j int) bool {
+		return logs[i].n > logs[j].n
+	})
+
+	for _, rotated := range logs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if _, err := readLines(rotated.path, 0, fn); err != nil {
+			return fmt.Errorf("reading %s: %w", filepath.Base(rotated.path), err)
+		}
+	}
+	return nil
+}
+
+// readLines calls fn for every complete line of the file after offset,
+// decompressing .gz files, and returns how many bytes it consumed.
+func readLines(path string, offset int64, fn func(line string)) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	if !strings.HasSuffix(path, ".gz") {
+		return scanLines(file, offset, fn)
+	}
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return 0, err
+	}
+	defer gz.Close()
+	if _, err := io.CopyN(io.Discard, gz, offset); err != nil {
+		return 0, err
+	}
+	return scanLines(gz, 0, fn)
+}
+
+// scanLines calls fn for every complete line of r after offset. A trailing
+// line without a newline is still being written and is left for the next
+// read.
+func scanLines(r io.Reader, offset int64, fn func(line string)) (int64, error) {
+	if offset > 0 {
+		seeker, ok := r.(io.Seeker)
+		if !ok {
+			return 0, errors.New("cannot seek in log")
+		}
+		if _, err := seeker.Seek(offset, io.SeekStart); err != nil {
+			return 0, err
+		}
+	}
+
+	var consumed int64
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if errors.Is(err, io.EOF) {
+			return consumed, nil
+		}
+		if err != nil {
+			return consumed, err
+		}
+		consumed += int64(len(line))
+		fn(strings.TrimRight(line, "\r\n"))
+	}
+}
+
+// dpkgLogTimeLayout is the layout of the local timestamps in dpkg.log.
+const dpkgLogTimeLayout = "2006-01-02 15:04:05"
+
+// parseDpkgLogLine records the action lines of dpkg.log, such as
+//
+//	2024-02-10 06:25:11 upgrade curl:amd64 7.88.1-10+deb12u4 7.88.1-10+deb12u5
+//
+// Status, configure and trigger lines are ignored. dpkg logs downgrades and
+// reinstalls as upgrades, so the versions tell them apart. Purging a package
+// logs a purge line after the remove line, and is counted separately.
+func parseDpkgLogLine(h *packageHistory, line string) {
+	fields := strings.Fields(line)
+	if len(fields) != 6 {
+		return
+	}
+	at, err := time.ParseInLocation(dpkgLogTimeLayout, fields[0]+" "+fields[1], time.Local)
+	if err != nil {
+		return
+	}
+	name, _, _ := strings.Cut(fields[3], ":")
+	oldVersion, newVersion := fields[4], fields[5]
+
+	switch fields[2] {
+	case "install":
+		h.record("dpkg", name, packageActionInstall, at)
+	case "upgrade":
+		action := packageActionUpgrade
+		if oldVersion != "<none>" && CompareDebianVersions(newVersion, oldVersion) < 0 {
+			action = packageActionDowngrade
+		}
+		h.record("dpkg", name, action, at)
+	case "remove":
+		h.record("dpkg", name, packageActionRemove, at)
+	case "purge":
+		h.record("dpkg", name, packageActionPurge, at)
+	}
+}
+
+// yumLogTimeLayout is the layout of the local timestamps in yum.log, which
+// leave out the year.
+const yumLogTimeLayout = "Jan _2 15:04:05"
+
+// yumLogActions are the actions yum logs, from its rpmtrans module.
+var yumLogActions = map[string]string{
+	"Installed":     packageActionInstall,
+	"Dep-Installed": packageActionInstall,
+	"Updated":       packageActionUpgrade,
+	"Erased":        packageActionRemove,
+}
+
+// parseYumLogLine records the lines of /var/log/yum.log, written by yum on
+// RHEL 7 and older, such as
+//
+//	Feb 10 06:25:11 Updated: 1:openssl-libs-1.0.2k-26.el7_9.x86_64
+//
+// Their year is taken to be the one that puts them at most a year before
+// now. yum.log names no command, so full upgrades are not found there.
+func parseYumLogLine(h *packageHistory, line string, now time.Time) {
+	if len(line) < len(yumLogTimeLayout) {
+		return
+	}
+	at, err := time.ParseInLocation(yumLogTimeLayout, line[:len(yumLogTimeLayout)], time.Local)
+	if err != nil {
+		return
+	}
+	at = at.AddDate(now.Year()-at.Year(), 0, 0)
+	if at.After(now) {
+		at = at.AddDate(-1, 0, 0)
+	}
+	verb, nevra, ok := strings.Cut(strings.TrimSpace(line[len(yumLogTimeLayout):]), ": ")
+	action, known := yumLogActions[verb]
+	if !ok || !known || nevra == "" {
+		return
+	}
+	h.record("yum", yumLogPackageName(nevra), action, at)
+}
+
+// yumLogPackageName returns the name of a package logged by yum as
+// [epoch:]name-version-release.arch, or as its bare name, as older releases
+// log removals.
+func yumLogPackageName(nevra string) string {
+	nevra = versionlockEpoch.ReplaceAllString(nevra, "")
+	i := strings.LastIndexByte(nevra, '-')
+	if i <= 0 || !strings.Contains(nevra[i:], ".") {
+		return nevra
+	}
+	if j := strings.LastIndexByte(nevra[:i], '-'); j > 0 {
+		return nevra[:j]
+	}
+	return nevra
+}
+
+// aptHistoryParser finds full upgrades in /var/log/apt/history.log, whose
+// entries are blocks of Start-Date, Commandline, the changes and End-Date.
+// The package changes themselves are counted from dpkg.log, which also sees
+// those not made through apt.
+type aptHistoryParser struct {
+	fullUpgrade bool
+}
+
+// aptUpgradeCommands upgrade every package when given no package names.
+var aptUpgradeCommands = []string{"upgrade", "full-upgrade", "dist-upgrade"}
+
+// aptValueOptions are the apt options whose value is a separate argument.
+var aptValueOptions = []string{"-o", "--option", "-c", "--config-file", "-t", "--target-release"}
+
+func (p *aptHistoryParser) parseLine(h *packageHistory, line string) {
+	field, value, ok := strings.Cut(line, ": ")
+	if !ok {
+		return
+	}
+	switch field {
+	case "Start-Date":
+		p.fullUpgrade = false
+	case "Commandline":
+		args := strings.Fields(value)
+		p.fullUpgrade = len(args) > 0 && isFullUpgrade(args[1:], aptUpgradeCommands, aptValueOptions)
+	case "End-Date":
+		// apt pads the date and time with two spaces
+		at, err := time.ParseInLocation(dpkgLogTimeLayout, strings.Join(strings.Fields(value), " "), time.Local)
+		if err == nil && p.fullUpgrade {
+			h.recordFullUpgrade("dpkg", at)
+		}
+		p.fullUpgrade = false
+	}
+}
+
+// isFullUpgrade reports whether the arguments of a package manager command
+// line are one of the upgrade commands without package names.
+func isFullUpgrade(args, upgradeCommands, valueOptions []string) bool {
+	command := ""
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case slices.Contains(valueOptions, arg):
+			i++
+		case strings.HasPrefix(arg, "-"):
+		case command == "":
+			command = arg
+		default:
+			return false
+		}
+	}
+	return slices.Contains(upgradeCommands, command)
+}
+
+// dnfUpgradeCommands upgrade every package when given no package names.
+var dnfUpgradeCommands = []string{"upgrade", "update", "distro-sync", "dsync", "dist-upgrade"}
+
+// dnfValueOptions are the dnf options whose value is a separate argument.
+var dnfValueOptions = []string{
+	"-x", "--exclude", "--enablerepo", "--disablerepo", "--repo", "--repoid",
+	"--setopt", "--releasever", "-c", "--config", "--installroot",
+	"-d", "--debuglevel", "-e", "--errorlevel",
+}
+
+// Transaction item actions of the dnf history database, from libdnf's
+// TransactionItemAction.
+var dnfHistoryActions = map[int]string{
+	1: packageActionInstall,   // INSTALL
+	2: packageActionDowngrade, // DOWNGRADE
+	4: packageActionInstall,   // OBSOLETE, the package replacing another
+	5: packageActionRemove,    // OBSOLETED
+	6: packageActionUpgrade,   // UPGRADE
+	8: packageActionRemove,    // REMOVE
+}
+
+// readDNFHistory reads the transactions dnf and yum on RHEL 8 and later
+// completed since the last call from /var/lib/dnf/history.sqlite. A missing
+// database is not an error. Transactions read before ctx is done are kept
+// for the next call to carry on from.
+func (c *packageHistoryCollector) readDNFHistory(ctx context.Context) error {
+	path := c.paths.rootfs("/var/lib/dnf/history.sqlite")
+	if _, err := os.Stat(path); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	// Like rpmdb.sqlite, the database is opened as immutable when a
+	// read-only root filesystem prevents reading the WAL
+	s := c.state
+	transactions, err := queryDNFHistory(ctx, "file:"+path+"?mode=ro", s.lastDNFTransaction)
+	if err != nil && ctx.Err() == nil {
+		transactions, err = queryDNFHistory(ctx, "file:"+path+"?mode=ro&immutable=1", s.lastDNFTransaction)
+	}
+
+	for _, transaction := range transactions {
+		for _, item := range transaction.items {
+			s.history.record("dnf", item.name, item.action, transaction.end)
+		}
+		if isFullUpgrade(strings.Fields(transaction.cmdline), dnfUpgradeCommands, dnfValueOptions) {
+			s.history.recordFullUpgrade("dnf", transaction.end)
+		}
+		s.lastDNFTransaction = transaction.id
+	}
+	return err
+}
+
+// dnfTransaction is a completed transaction of the dnf history database.
+type dnfTransaction struct {
+	id      int64
+	end     time.Time
+	cmdline string
+	items   []dnfTransactionItem
+}
+
+type dnfTransactionItem struct {
+	name   string
+	action string
+}
+
+// queryDNFHistory returns the successful transactions after the one with ID
+// after, in order. When ctx is done, the transactions read completely so far
+// are returned with its error.
+func queryDNFHistory(ctx context.Context, dsn string, after int64) ([]dnfTransaction, error) {
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	// State 1 is DONE for transactions and their items
+	rows, err := db.QueryContext(ctx, `
+		SELECT t.id, COALESCE(t.dt_end, t.dt_begin), COALESCE(t.cmdline, ''), COALESCE(r.name, ''), COALESCE(ti.action, 0)
+		FROM trans t
+		LEFT JOIN trans_item ti ON ti.trans_id = t.id AND ti.state = 1
+		LEFT JOIN rpm r ON r.item_id = ti.item_id
+		WHERE t.id > ? AND t.state = 1
+		ORDER BY t.id, ti.id`, after)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var transactions []dnfTransaction
+	for rows.Next() {
+		var (
+			id, end       int64
+			cmdline, name string
+			action        int
+		)
+		if err := rows.Scan(&id, &end, &cmdline, &name, &action); err != nil {
+			return nil, err
+		}
+		if len(transactions) == 0 || transactions[len(transactions)-1].id != id {
+			transactions = append(transactions, dnfTransaction{id: id, end: time.Unix(end, 0), cmdline: cmdline})
+		}
+		if action, ok := dnfHistoryActions[action]; ok && name != "" {
+			last := &transactions[len(transactions)-1]
+			last.items = append(last.items, dnfTransactionItem{name: name, action: action})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		// The last transaction may be missing some of its items
+		if len(transactions) > 0 {
+			transactions = transactions[:len(transactions)-1]
+		}
+		return transactions, err
+	}
+	return transactions, nil
+}
@@ -0,0 +1,196 @@
+package metrics
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogTailFollowsRotation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "dpkg.log")
+	write := func(name, data string, flag int) {
+		t.Helper()
+		file, err := os.OpenFile(filepath.Join(dir, name), flag|os.O_WRONLY|os.O_CREATE, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		if _, err := file.WriteString(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	gz, err := os.Create(path + ".2.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := gzip.NewWriter(gz)
+	zw.Write([]byte("oldest\n"))
+	zw.Close()
+	gz.Close()
+	write("dpkg.log.1", "older\n", os.O_TRUNC)
+	write("dpkg.log", "first\nsecond\npar", os.O_TRUNC)
+
+	tail := logTail{path: path}
+	steps := []struct {
+		name   string
+		change func()
+		want   []string
+	}{
+		{
+			name: "first read includes rotated logs",
+			want: []string{"oldest", "older", "first", "second"},
+		},
+		{
+			name:   "partial line is completed",
+			change: func() { write("dpkg.log", "tial\nthird\n", os.O_APPEND) },
+			want:   []string{"partial", "third"},
+		},
+		{
+			name: "nothing new",
+		},
+		{
+			name: "rotation",
+			change: func() {
+				write("dpkg.log", "fourth\n", os.O_APPEND)
+				if err := os.Rename(path, path+".1"); err != nil {
+					t.Fatal(err)
+				}
+				write("dpkg.log", "fifth\n", os.O_TRUNC)
+			},
+			want: []string{"fourth", "fifth"},
+		},
+		{
+			name:   "truncation",
+			change: func() { write("dpkg.log", "6th\n", os.O_TRUNC) },
+			want:   []string{"6th"},
+		},
+	}
+	for _, step := range steps {
+		if step.change != nil {
+			step.change()
+		}
+		var got []string
+		err := tail.read(context.Background(), func(line string) {
+			got = append(got, line)
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if !reflect.DeepEqual(got, step.want) {
+			t.Errorf("%s: got %q, want %q", step.name, got, step.want)
+		}
+	}
+}
+
+func TestIsFullUpgrade(t *testing.T) {
+	tests := []struct {
+		cmdline string
+		want    bool
+	}{
+		{"upgrade", true},
+		{"-y upgrade", true},
+		{"upgrade -y --exclude kernel*", true},
+		{"-x kernel* update", true},
+		{"distro-sync", true},
+		{"upgrade openssl", false},
+		{"install nginx", false},
+		{"upgrade-minimal --security", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := isFullUpgrade(strings.Fields(tt.cmdline), dnfUpgradeCommands, dnfValueOptions); got != tt.want {
+			t.Errorf("isFullUpgrade(%q) = %v, want %v", tt.cmdline, got, tt.want)
+		}
+	}
+}
+
+func TestParseYumLogLine(t *testing.T) {
+	origLocal := time.Local
+	t.Cleanup(func() { time.Local = origLocal })
+	time.Local = time.UTC
+
+	h := packageHistory{changes: map[packageChangeKey]float64{}, lastChange: map[string]time.Time{}, lastUpgrade: map[string]time.Time{}}
+	now := time.Date(2024, 2, 12, 10, 0, 0, 0, time.UTC)
+	for _, line := range []string{
+		"Dec 30 14:02:51 Installed: nginx-1.20.1-10.el7.x86_64",
+		"Feb 10 06:25:11 Updated: 1:openssl-libs-1.0.2k-26.el7_9.x86_64",
+		"Feb 10 06:25:12 Dep-Installed: libfoo-2.0-1.el7.noarch",
+		"Feb 11 09:00:00 Erased: vim-enhanced",
+		"Feb 11 09:00:01 Erased: 2:vim-common-7.4.629-8.el7_9.x86_64",
+		"not a yum line",
+		"Feb 11 09:00:02 Repackaged: bash-4.2.46-35.el7_9.x86_64",
+	} {
+		parseYumLogLine(&h, line, now)
+	}
+
+	want := map[packageChangeKey]float64{
+		{"yum", "nginx", packageActionInstall}:        1,
+		{"yum", "openssl-libs", packageActionUpgrade}: 1,
+		{"yum", "libfoo", packageActionInstall}:       1,
+		{"yum", "vim-enhanced", packageActionRemove}:  1,
+		{"yum", "vim-common", packageActionRemove}:    1,
+	}
+	if !reflect.DeepEqual(h.changes, want) {
+		t.Errorf("got %v, want %v", h.changes, want)
+	}
+	if got, want := h.lastChange["yum"], time.Date(2024, 2, 11, 9, 0, 1, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("last change %v, want %v", got, want)
+	}
+}
+
+func TestPackageHistorySurvivesReload(t *testing.T) {
+	opts := fixtureOptions(t, "debian12")
+	set, err := NewCollectorSet(opts, []string{"package_history"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(set.Stop)
+
+	const curl = `system_package_changes_total{action="upgrade",manager="dpkg",package="curl"} 2`
+	if got := collectText(t, set); !bytes.Contains(got, []byte(curl)) {
+		t.Fatalf("curl upgrades not counted:\n%s", got)
+	}
+
+	// The log is rotated and the old one deleted before the reload, so only
+	// the new line is left to read
+	log := opts.Paths.rootfs("/var/log/dpkg.log")
+	if err := os.Remove(log); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(log, []byte("2024-02-12 09:00:00 upgrade curl:amd64 7.88.1-10+deb12u5 7.88.1-10+deb12u6\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	set.Reload(opts)
+	if got := collectText(t, set); !bytes.Contains(got, []byte(strings.Replace(curl, "} 2", "} 3", 1))) {
+		t.Errorf("counter not carried over the reload:\n%s", got)
+	}
+}
+
+func TestReadDNFHistoryStopsAtDeadline(t *testing.T) {
+	opts := fixtureOptions(t, "rocky9")
+	c := newPackageHistoryCollector(opts.Paths).(*packageHistoryCollector)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := c.readDNFHistory(ctx); err == nil {
+		t.Error("reading with a cancelled context succeeded")
+	}
+	if c.state.lastDNFTransaction != 0 {
+		t.Errorf("transaction %d recorded from a cancelled read", c.state.lastDNFTransaction)
+	}
+
+	if err := c.readDNFHistory(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if c.state.lastDNFTransaction == 0 {
+		t.Error("no transactions read after the cancelled read")
+	}
+}
@@ -0,0 +1,457 @@
+package metrics
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Kinds of package files, as reported in the type label.
+const (
+	packageFileBinary = "binary"
+	packageFileConfig = "config"
+)
+
+// Reasons a package file fails verification.
+const (
+	packageFileModified   = "modified"
+	packageFileMissing    = "missing"
+	packageFileUnreadable = "unreadable"
+)
+
+type packageIntegrityCollector struct {
+	modifiedFiles *prometheus.Desc
+	modifiedFile  *prometheus.Desc
+	verified      *prometheus.Desc
+	lastPass      *prometheus.Desc
+	paths         Paths
+	// readRate caps how many bytes per second are hashed, or zero for no
+	// cap.
+	readRate   int64
+	maxDetails int
+	// interval is the pause between the end of a pass over every package
+	// and the start of the next.
+	interval time.Duration
+
+	mu sync.Mutex
+	// results holds the outcome of the latest verification of each package,
+	// by name and architecture.
+	results map[string]packageIntegrity
+	// queue holds the packages left to verify in the current pass, and
+	// next the number of files of queue[0] already verified.
+	queue []string
+	next  int
+	// current holds the results for the files of queue[0] verified so far,
+	// and partial the state of the file hashing stopped in the middle of.
+	current      packageIntegrity
+	partial      *partialSum
+	lastPassTime time.Time
+}
+
+// packageIntegrity is the result of verifying the files of a package.
+type packageIntegrity struct {
+	key     string
+	name    string
+	version string
+	failed  []packageFileFailure
+}
+
+// packageFileFailure is a package file that differs from its manifest.
+type packageFileFailure struct {
+	path   string
+	kind   string
+	reason string
+}
+
+// packageFile is a file of a package with the MD5 sum dpkg recorded for it.
+type packageFile struct {
+	path string
+	sum  string
+	kind string
+}
+
+func init() {
+	registerCollector("package_integrity", false, func(opts Options) Collector {
+		return newPackageIntegrityCollector(opts.Paths, opts.IntegrityReadRate, opts.IntegrityMaxDetails, opts.CacheTTL)
+	})
+}
+
+// newPackageIntegrityCollector returns a collector verifying the installed
+// files of dpkg packages against their recorded MD5 sums, like debsums.
+// Hashing every file on the host is slow, so each scrape verifies packages
+// for at most half of its deadline, reading no more than readRate bytes per
+// second, and the next scrape carries on where it stopped, within a file if
+// need be. Once every package has been verified, the next pass starts after
+// interval.
+func newPackageIntegrityCollector(paths Paths, readRate int64, maxDetails int, interval time.Duration) Collector {
+	return &packageIntegrityCollector{
+		modifiedFiles: prometheus.NewDesc(
+			"system_package_modified_files",
+			"Number of files of a package that differ from the MD5 sums recorded by dpkg, are missing or cannot be read, by type (binary or config)",
+			[]string{"package", "type"}, nil,
+		),
+		modifiedFile: prometheus.NewDesc(
+			"system_package_modified_file",
+			"Files that differ from the MD5 sums recorded by dpkg, with the reason (modified, missing or unreadable). Only the first files are listed, up to --integrity.max-details.",
+			[]string{"package", "path", "type", "reason"}, nil,
+		),
+		verified: prometheus.NewDesc(
+			"system_package_integrity_verified_packages",
+			"Number of installed packages whose files have been verified",
+			nil, nil,
+		),
+		lastPass: prometheus.NewDesc(
+			"system_package_integrity_last_pass_timestamp_seconds",
+			"Time the last pass verifying the files of every installed package finished",
+			nil, nil,
+		),
+		paths:      paths,
+		readRate:   readRate,
+		maxDetails: maxDetails,
+		interval:   interval,
+		results:    map[string]packageIntegrity{},
+	}
+}
+
+func (c *packageIntegrityCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.modifiedFiles
+	ch <- c.modifiedFile
+	ch <- c.verified
+	ch <- c.lastPass
+}
+
+func (c *packageIntegrityCollector) Update(ctx context.Context, ch chan<- prometheus.Metric) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	packages, err := readDpkgStatus(c.paths.rootfs("/var/lib/dpkg/status"))
+	if errors.Is(err, os.ErrNotExist) {
+		return errors.New("package integrity verification needs dpkg")
+	}
+	if err != nil {
+		return err
+	}
+	installed := map[string]dpkgPackage{}
+	for _, pkg := range packages {
+		if pkg.isInstalled() {
+			installed[pkg.key()] = pkg
+		}
+	}
+
+	if err := c.verify(ctx, installed); err != nil {
+		return err
+	}
+	c.export(ch, installed)
+	return nil
+}
+
+// verify carries on with the current pass until half of the time left
+// before the deadline of ctx is used, starting a new pass when the last one
+// finished more than interval ago.
+func (c *packageIntegrityCollector) verify(ctx context.Context, installed map[string]dpkgPackage) error {
+	start := timeNow()
+	if len(c.queue) == 0 && (c.lastPassTime.IsZero() || !start.Before(c.lastPassTime.Add(c.interval))) {
+		for key := range installed {
+			c.queue = append(c.queue, key)
+		}
+		sort.Strings(c.queue)
+		c.next, c.current, c.partial = 0, packageIntegrity{}, nil
+	}
+	if len(c.queue) == 0 {
+		return nil
+	}
+
+	var stop time.Time
+	if deadline, ok := ctx.Deadline(); ok {
+		stop = time.Now().Add(time.Until(deadline) / 2)
+	}
+	diversions, err := readDpkgDiversions(c.paths)
+	if err != nil {
+		return err
+	}
+	hasher := &throttledHasher{ctx: ctx, rate: c.readRate, start: time.Now(), stop: stop, partial: c.partial}
+	defer func() { c.partial = hasher.partial }()
+
+	for len(c.queue) > 0 {
+		key := c.queue[0]
+		pkg, ok := installed[key]
+		if !ok {
+			// Removed since the pass started
+			c.skip()
+			continue
+		}
+		files, err := dpkgPackageFiles(c.paths, pkg)
+		if err != nil {
+			// The next scrape carries on with the next package
+			c.skip()
+			return fmt.Errorf("listing the files of %s: %w", key, err)
+		}
+		if c.current.key != key || c.current.version != pkg.version {
+			c.current = packageIntegrity{key: key, name: pkg.name, version: pkg.version}
+			c.next, hasher.partial = 0, nil
+		}
+		for c.next < len(files) {
+			if !stop.IsZero() && time.Now().After(stop) {
+				return nil
+			}
+			file := files[c.next]
+			path := file.path
+			if diverted, ok := diversions[path]; ok && diverted.pkg != pkg.name {
+				// Another package or the administrator moved the file away
+				path = diverted.to
+			}
+			sum, err := hasher.sum(c.paths.rootfs(path))
+			switch {
+			case errors.Is(err, errHashPaused), err != nil && ctx.Err() != nil:
+				// The next scrape carries on from where hashing stopped
+				return nil
+			case errors.Is(err, os.ErrNotExist):
+				c.current.fail(file, packageFileMissing)
+			case errors.Is(err, errIsDirectory):
+			case err != nil:
+				// Typically a file only root may read, such as /etc/sudoers
+				c.current.fail(file, packageFileUnreadable)
+			case !strings.EqualFold(sum, file.sum):
+				c.current.fail(file, packageFileModified)
+			}
+			c.next++
+		}
+		c.results[key] = c.current
+		c.skip()
+	}
+	c.lastPassTime = timeNow()
+	return nil
+}
+
+// skip moves on to the next package of the pass.
+func (c *packageIntegrityCollector) skip() {
+	c.queue, c.next, c.current = c.queue[1:], 0, packageIntegrity{}
+}
+
+// fail records a file that failed verification for the reason given.
+func (p *packageIntegrity) fail(file packageFile, reason string) {
+	p.failed = append(p.failed, packageFileFailure{path: file.path, kind: file.kind, reason: reason})
+}
+
+// export sends the results of the packages still installed in the verified
+// version.
+func (c *packageIntegrityCollector) export(ch chan<- prometheus.Metric, installed map[string]dpkgPackage) {
+	keys := make([]string, 0, len(c.results))
+	for key, result := range c.results {
+		if pkg, ok := installed[key]; ok && pkg.version == result.version {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	// Multi-Arch: same packages are installed once per architecture, and
+	// list their shared files for each
+	counts := map[[2]string]int{}
+	seen := labelSet{}
+	details := 0
+	for _, key := range keys {
+		result := c.results[key]
+		for _, failure := range result.failed {
+			if !seen.add(result.name, failure.path) {
+				continue
+			}
+			counts[[2]string{result.name, failure.kind}]++
+			if details < c.maxDetails {
+				details++
+				ch <- prometheus.MustNewConstMetric(c.modifiedFile, prometheus.GaugeValue, 1, result.name, failure.path, failure.kind, failure.reason)
+			}
+		}
+	}
+	for key, count := range counts {
+		ch <- prometheus.MustNewConstMetric(c.modifiedFiles, prometheus.GaugeValue, float64(count), key[0], key[1])
+	}
+	ch <- prometheus.MustNewConstMetric(c.verified, prometheus.GaugeValue, float64(len(keys)))
+	if !c.lastPassTime.IsZero() {
+		ch <- prometheus.MustNewConstMetric(c.lastPass, prometheus.GaugeValue, float64(c.lastPassTime.Unix()))
+	}
+}
+
+// dpkgPackageFiles returns the configuration files of a package from its
+// Conffiles field, followed by its other files from
+// /var/lib/dpkg/info/<package>.md5sums, named <package>:<arch>.md5sums for
+// Multi-Arch: same packages. Obsolete configuration files, those to be
+// removed on upgrade and new ones dpkg has not recorded a sum for yet are
+// left out.
+func dpkgPackageFiles(paths Paths, pkg dpkgPackage) ([]packageFile, error) {
+	var files []packageFile
+	for _, line := range strings.Split(pkg.conffiles, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		skip := false
+		for _, field := range fields[1:] {
+			skip = skip || field == "newconffile" || field == "obsolete" || field == "remove-on-upgrade"
+		}
+		if !skip {
+			files = append(files, packageFile{path: fields[0], sum: fields[1], kind: packageFileConfig})
+		}
+	}
+
+	infoDir := paths.rootfs("/var/lib/dpkg/info")
+	for _, name := range []string{pkg.key() + ".md5sums", pkg.name + ".md5sums"} {
+		file, err := os.Open(filepath.Join(infoDir, name))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			// "<md5>  <path relative to />"
+			sum, path, ok := strings.Cut(scanner.Text(), " ")
+			path = strings.TrimSpace(path)
+			if !ok || path == "" {
+				continue
+			}
+			files = append(files, packageFile{path: "/" + path, sum: sum, kind: packageFileBinary})
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("reading %s: %w", name, err)
+		}
+		break
+	}
+	return files, nil
+}
+
+// dpkgDiversion is a file moved away by dpkg-divert.
+type dpkgDiversion struct {
+	to string
+	// pkg is the package whose own copy stays in place, or ":" for a
+	// diversion made by the administrator.
+	pkg string
+}
+
+// readDpkgDiversions reads /var/lib/dpkg/diversions, which lists every
+// diversion as three lines: the diverted path, the path the file is moved
+// to and the diverting package.
+func readDpkgDiversions(paths Paths) (map[string]dpkgDiversion, error) {
+	data, err := os.ReadFile(paths.rootfs("/var/lib/dpkg/diversions"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	diversions := map[string]dpkgDiversion{}
+	for i := 0; i+2 < len(lines); i += 3 {
+		diversions[lines[i]] = dpkgDiversion{to: lines[i+1], pkg: lines[i+2]}
+	}
+	return diversions, nil
+}
+
+// errIsDirectory is returned for package paths that are directories, which
+// dpkg lists among the Conffiles of some packages.
+var errIsDirectory = errors.New("is a directory")
+
+// errHashPaused is returned when hashing a file stops at the time the
+// hasher was given, with the state to carry on from saved.
+var errHashPaused = errors.New("hashing paused")
+
+// partialSum is the state of a file hashing stopped in the middle of. It is
+// only resumed while the file keeps its size and modification time.
+type partialSum struct {
+	path    string
+	size    int64
+	modTime time.Time
+	offset  int64
+	hash    hash.Hash
+}
+
+// throttledHasher computes MD5 sums, sleeping as needed so that no more than
+// rate bytes per second are read since start. It stops reading once ctx is
+// done or stop has passed, keeping the state of the file it stopped in in
+// partial so that large files are hashed over several scrapes.
+type throttledHasher struct {
+	ctx     context.Context
+	rate    int64
+	start   time.Time
+	stop    time.Time
+	read    int64
+	partial *partialSum
+}
+
+func (h *throttledHasher) sum(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+	if info.IsDir() {
+		return "", errIsDirectory
+	}
+
+	state := h.partial
+	if state == nil || state.path != path || state.size != info.Size() || !state.modTime.Equal(info.ModTime()) {
+		state = &partialSum{path: path, size: info.Size(), modTime: info.ModTime(), hash: md5.New()}
+	} else if _, err := file.Seek(state.offset, io.SeekStart); err != nil {
+		return "", err
+	}
+	h.partial = nil
+	pause := func() (string, error) {
+		h.partial = state
+		if err := h.ctx.Err(); err != nil {
+			return "", err
+		}
+		return "", errHashPaused
+	}
+
+	buf := make([]byte, 64*1024)
+	for {
+		if h.ctx.Err() != nil {
+			return pause()
+		}
+		n, err := file.Read(buf)
+		state.hash.Write(buf[:n])
+		state.offset += int64(n)
+		h.read += int64(n)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if h.rate > 0 {
+			due := h.start.Add(time.Duration(float64(h.read) / float64(h.rate) * float64(time.Second)))
+			if !h.stop.IsZero() && due.After(h.stop) {
+				due = h.stop
+			}
+			if wait := time.Until(due); wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-h.ctx.Done():
+				}
+			}
+		}
+		if !h.stop.IsZero() && !time.Now().Before(h.stop) {
+			return pause()
+		}
+	}
+	return hex.EncodeToString(state.hash.Sum(nil)), nil
+}
@@ -0,0 +1,104 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestPackageIntegrityPasses(t *testing.T) {
+	opts := fixtureOptions(t, "debian12")
+	c := &updateCollector{Collector: newPackageIntegrityCollector(opts.Paths, 0, 1, time.Hour)}
+
+	got := collectText(t, c)
+	if c.err != nil {
+		t.Fatal(c.err)
+	}
+	if n := bytes.Count(got, []byte("system_package_modified_file{")); n != 1 {
+		t.Errorf("got %d modified files listed, want 1:\n%s", n, got)
+	}
+	if !bytes.Contains(got, []byte(`system_package_modified_files{package="bash",type="config"} 1`)) {
+		t.Errorf("modified bash configuration not counted:\n%s", got)
+	}
+
+	// The original of the diverted /usr/bin/curl is only verified again once
+	// the interval has passed
+	if err := os.WriteFile(opts.Paths.rootfs("/usr/bin/curl.distrib"), []byte("tampered\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	const curl = `system_package_modified_files{package="curl",type="binary"} 1`
+	if got := collectText(t, c); bytes.Contains(got, []byte(curl)) {
+		t.Errorf("package verified again before the interval passed:\n%s", got)
+	}
+	timeNow = func() time.Time { return fixtureTime.Add(2 * time.Hour) }
+	if got := collectText(t, c); !bytes.Contains(got, []byte(curl)) {
+		t.Errorf("modified curl not found by the next pass:\n%s", got)
+	}
+}
+
+func TestPackageIntegrityResumes(t *testing.T) {
+	opts := fixtureOptions(t, "debian12")
+
+	// A file too large to hash within one scrape at the read rate
+	libc := make([]byte, 4*64*1024+1)
+	for i := range libc {
+		libc[i] = byte(i)
+	}
+	if err := os.WriteFile(opts.Paths.rootfs("/usr/lib/x86_64-linux-gnu/libc.so.6"), libc, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	md5sums := opts.Paths.rootfs("/var/lib/dpkg/info/libc6:amd64.md5sums")
+	data, err := os.ReadFile(md5sums)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = []byte(strings.Replace(string(data), "2ea39571e8f81919061bb5b078614471", fmt.Sprintf("%x", md5.Sum(libc)), 1))
+	if err := os.WriteFile(md5sums, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// A file that cannot be opened, even by root
+	bash := opts.Paths.rootfs("/usr/bin/bash")
+	if err := os.Remove(bash); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(bash, bash); err != nil {
+		t.Fatal(err)
+	}
+
+	c := newPackageIntegrityCollector(opts.Paths, 64*1024, 10, time.Hour).(*packageIntegrityCollector)
+	ch := make(chan prometheus.Metric, 100)
+	scrapes, resumed := 0, false
+	for ; scrapes < 50 && c.lastPassTime.IsZero(); scrapes++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		err := c.Update(ctx, ch)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for len(ch) > 0 {
+			<-ch
+		}
+		resumed = resumed || c.partial != nil && c.partial.offset > 0
+	}
+	if c.lastPassTime.IsZero() {
+		t.Fatalf("pass not finished after %d scrapes", scrapes)
+	}
+	if !resumed {
+		t.Errorf("large file hashed within a single scrape")
+	}
+
+	got := collectText(t, &updateCollector{Collector: c})
+	if !bytes.Contains(got, []byte(`system_package_modified_file{package="bash",path="/usr/bin/bash",reason="unreadable",type="binary"} 1`)) {
+		t.Errorf("unreadable bash binary not reported:\n%s", got)
+	}
+	if bytes.Contains(got, []byte(`path="/usr/lib/x86_64-linux-gnu/libc.so.6"`)) {
+		t.Errorf("large file hashed over several scrapes reported as failed:\n%s", got)
+	}
+}
@@ -0,0 +1,198 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Mechanisms that keep a package at its version. They are also the reasons
+// an update is held back.
+const (
+	// packageLockHold is a dpkg "hold" selection, set with apt-mark hold.
+	packageLockHold = "hold"
+	// packageLockPin is an apt preferences record.
+	packageLockPin = "pin"
+	// packageLockVersionlock is an entry of the dnf or yum versionlock
+	// plugin.
+	packageLockVersionlock = "versionlock"
+)
+
+// packageLock is a package kept at a version by one of the mechanisms above.
+type packageLock struct {
+	manager string
+	pkg     string
+	kind    string
+	// version is the version the package is locked to, or "" when the lock
+	// names no version, as for pins on a release.
+	version string
+}
+
+// findPackageLocks returns the dpkg holds, apt pins and versionlock entries
+// of the host.
+func findPackageLocks(paths Paths) ([]packageLock, error) {
+	var locks []packageLock
+
+	packages, err := readDpkgStatus(paths.rootfs("/var/lib/dpkg/status"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	for _, pkg := range packages {
+		if pkg.isHeld() && pkg.isInstalled() {
+			locks = append(locks, packageLock{manager: "dpkg", pkg: pkg.name, kind: packageLockHold, version: pkg.version})
+		}
+	}
+
+	pins, err := loadAptPreferences(paths)
+	if err != nil {
+		return nil, err
+	}
+	for _, pin := range pins {
+		version := ""
+		if pin.kind == "version" {
+			version = pin.value
+		}
+		for _, pkg := range pin.packages {
+			locks = append(locks, packageLock{manager: "apt", pkg: pkg, kind: packageLockPin, version: version})
+		}
+	}
+
+	versionlocks, err := loadVersionlocks(paths)
+	if err != nil {
+		return nil, err
+	}
+	manager := rpmRepoManager(paths)
+	for _, lock := range versionlocks {
+		if !lock.exclude {
+			locks = append(locks, packageLock{manager: manager, pkg: lock.name, kind: packageLockVersionlock, version: lock.version})
+		}
+	}
+	return locks, nil
+}
+
+// isHeld reports whether the package is on hold, so that apt upgrades leave
+// it alone.
+func (p dpkgPackage) isHeld() bool {
+	return strings.HasPrefix(p.status, "hold ")
+}
+
+// versionlockFiles are the lists of the dnf and yum versionlock plugins.
+var versionlockFiles = []string{"/etc/dnf/plugins/versionlock.list", "/etc/yum/pluginconf.d/versionlock.list"}
+
+// versionlockEpoch is the epoch yum writes before the name of an entry.
+var versionlockEpoch = regexp.MustCompile(`^[0-9]+:`)
+
+// rpmVersionlock is an entry of a versionlock list, a glob pattern such as
+// "curl-0:7.76.1-26.el9_3.2.*" matching the NEVRA of the allowed versions.
+// Entries starting with "!" exclude the versions they match instead.
+type rpmVersionlock struct {
+	pattern string
+	name    string
+	// version is the [epoch:]version-release of the entry, which may hold
+	// wildcards.
+	version string
+	exclude bool
+}
+
+// loadVersionlocks reads the versionlock lists of dnf and yum.
+func loadVersionlocks(paths Paths) ([]rpmVersionlock, error) {
+	var locks []rpmVersionlock
+	for _, name := range versionlockFiles {
+		data, err := os.ReadFile(paths.rootfs(name))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", name, err)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if lock, ok := parseVersionlock(line); ok {
+				locks = append(locks, lock)
+			}
+		}
+	}
+	sort.SliceStable(locks, func(i, j int) bool { return locks[i].name < locks[j].name })
+	return locks, nil
+}
+
+// parseVersionlock parses a line of a versionlock list, in the
+// name-epoch:version-release.arch form dnf writes or the
+// epoch:name-version-release.arch form of yum.
+func parseVersionlock(line string) (rpmVersionlock, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return rpmVersionlock{}, false
+	}
+	lock := rpmVersionlock{pattern: line}
+	if strings.HasPrefix(line, "!") {
+		lock.exclude = true
+		lock.pattern = strings.TrimSpace(line[1:])
+	}
+
+	nevra := lock.pattern
+	epoch := versionlockEpoch.FindString(nevra)
+	nevra = nevra[len(epoch):]
+	// The release runs from the last hyphen to the architecture
+	i := strings.LastIndexByte(nevra, '-')
+	if i <= 0 {
+		return rpmVersionlock{}, false
+	}
+	release := nevra[i+1:]
+	if j := strings.LastIndexByte(release, '.'); j > 0 {
+		release = release[:j]
+	}
+	j := strings.LastIndexByte(nevra[:i], '-')
+	if j <= 0 {
+		return rpmVersionlock{}, false
+	}
+	lock.name = nevra[:j]
+	version := nevra[j+1 : i]
+	if epoch == "" {
+		if k := strings.IndexByte(version, ':'); k >= 0 {
+			epoch, version = version[:k+1], version[k+1:]
+		}
+	}
+	lock.version = parseRPMVersion(epoch + version + "-" + release).String()
+	return lock, true
+}
+
+// matches reports whether the entry matches a version of a package, in
+// either NEVRA form.
+func (l rpmVersionlock) matches(name string, evr rpmEVR, arch string) bool {
+	for _, nevra := range []string{
+		fmt.Sprintf("%s-%d:%s-%s.%s", name, evr.epoch, evr.version, evr.release, arch),
+		fmt.Sprintf("%d:%s-%s-%s.%s", evr.epoch, name, evr.version, evr.release, arch),
+	} {
+		if ok, _ := path.Match(l.pattern, nevra); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// versionlockAllows reports whether the versionlock plugin lets a package
+// be updated to evr: an entry for the package must match it, when there is
+// one, and no exclude entry may.
+func versionlockAllows(locks []rpmVersionlock, name string, evr rpmEVR, arch string) bool {
+	locked, allowed := false, false
+	for _, lock := range locks {
+		if lock.name != name {
+			continue
+		}
+		if lock.exclude {
+			if lock.matches(name, evr, arch) {
+				return false
+			}
+			continue
+		}
+		locked = true
+		if lock.matches(name, evr, arch) {
+			allowed = true
+		}
+	}
+	return !locked || allowed
+}
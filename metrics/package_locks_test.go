@@ -0,0 +1,66 @@
+package metrics
+
+import "testing"
+
+func TestParseVersionlock(t *testing.T) {
+	tests := []struct {
+		line string
+		want rpmVersionlock
+		ok   bool
+	}{
+		{
+			"curl-0:7.76.1-26.el9_3.2.*",
+			rpmVersionlock{pattern: "curl-0:7.76.1-26.el9_3.2.*", name: "curl", version: "7.76.1-26.el9_3.2"},
+			true,
+		},
+		{
+			"vim-enhanced-2:8.2.2637-20.el9_1.x86_64",
+			rpmVersionlock{pattern: "vim-enhanced-2:8.2.2637-20.el9_1.x86_64", name: "vim-enhanced", version: "2:8.2.2637-20.el9_1"},
+			true,
+		},
+		{
+			"0:bash-4.2.46-34.el7.*",
+			rpmVersionlock{pattern: "0:bash-4.2.46-34.el7.*", name: "bash", version: "4.2.46-34.el7"},
+			true,
+		},
+		{
+			"!tzdata-0:2024a-1.el9.*",
+			rpmVersionlock{pattern: "tzdata-0:2024a-1.el9.*", name: "tzdata", version: "2024a-1.el9", exclude: true},
+			true,
+		},
+		{"# Added by versionlock on Mon Jan 15 09:12:44 2024", rpmVersionlock{}, false},
+		{"curl", rpmVersionlock{}, false},
+		{"", rpmVersionlock{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseVersionlock(tt.line)
+		if ok != tt.ok || got != tt.want {
+			t.Errorf("parseVersionlock(%q) = %+v, %v, want %+v, %v", tt.line, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestVersionlockAllows(t *testing.T) {
+	var locks []rpmVersionlock
+	for _, line := range []string{"curl-0:7.76.1-26.el9_3.*", "0:bash-5.1.8-*", "!tzdata-0:2024a-1.el9.*"} {
+		lock, _ := parseVersionlock(line)
+		locks = append(locks, lock)
+	}
+	tests := []struct {
+		name, evr string
+		want      bool
+	}{
+		{"curl", "7.76.1-26.el9_3.3", true},
+		{"curl", "7.76.1-27.el9", false},
+		{"bash", "5.1.8-9.el9", true},
+		{"bash", "5.2.15-1.el9", false},
+		{"tzdata", "2024a-1.el9", false},
+		{"tzdata", "2024b-1.el9", true},
+		{"glibc", "2.34-83.el9.12", true},
+	}
+	for _, tt := range tests {
+		if got := versionlockAllows(locks, tt.name, parseRPMVersion(tt.evr), "x86_64"); got != tt.want {
+			t.Errorf("versionlockAllows(%s-%s) = %v, want %v", tt.name, tt.evr, got, tt.want)
+		}
+	}
+}
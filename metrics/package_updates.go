@@ -1,126 +1,291 @@
 package metrics
 
 import (
-	"bufio"
-	"log"
+	"context"
+	"errors"
+	"fmt"
 	"os"
 	"runtime"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
 
-var packageUpdateAvailable = prometheus.NewGaugeVec(
-	prometheus.GaugeOpts{
-		Name: "system_package_update_available",
-		Help: "Indicates if updates are available for installed packages (1 if updates are available, 0 otherwise)",
-	},
-	[]string{"package"},
-)
+type packageUpdatesCollector struct {
+	updateAvailable   *prometheus.Desc
+	updatesPending    *prometheus.Desc
+	updateHeld        *prometheus.Desc
+	updatesHeld       *prometheus.Desc
+	updatesByClass    *prometheus.Desc
+	securityUpdateAge *prometheus.Desc
+	paths             Paths
+	cache             metricCache
+
+	mu sync.Mutex
+	// oldestSecurity holds the issue date of the oldest security advisory
+	// fixed by a pending update, by manager, as of the last refresh of the
+	// cache. Its age is computed at every scrape instead of being cached.
+	oldestSecurity map[string]time.Time
+}
+
+// timeNow is replaced in tests so advisory ages are reproducible.
+var timeNow = time.Now
 
 func init() {
-	prometheus.MustRegister(packageUpdateAvailable)
+	registerCollector("package_updates", true, func(opts Options) Collector {
+		return newPackageUpdatesCollector(opts.Paths, opts.CacheTTL)
+	})
 }
 
-func CollectPackageUpdateAvailability() {
+// newPackageUpdatesCollector returns a collector reporting the installed
+// packages with a newer candidate version. Results are reused for ttl.
+func newPackageUpdatesCollector(paths Paths, ttl time.Duration) Collector {
+	return &packageUpdatesCollector{
+		updateAvailable: prometheus.NewDesc(
+			"system_package_update_available",
+			"Installed packages with an update available, labelled with the installed and candidate versions. Package managers without per-package data report their own name as the package.",
+			[]string{"package", "installed_version", "candidate_version"}, nil,
+		),
+		updatesPending: prometheus.NewDesc(
+			"system_package_updates_pending",
+			"Number of installed packages with an update available",
+			[]string{"manager"}, nil,
+		),
+		updateHeld: prometheus.NewDesc(
+			"system_package_update_held",
+			"Installed packages whose available update is held back by a dpkg hold, an apt pin or a versionlock entry, labelled with the installed and candidate versions and the reason (hold, pin or versionlock)",
+			[]string{"package", "installed_version", "candidate_version", "reason"}, nil,
+		),
+		updatesHeld: prometheus.NewDesc(
+			"system_package_updates_held",
+			"Number of installed packages whose available update is held back. These are not counted as pending.",
+			[]string{"manager"}, nil,
+		),
+		updatesByClass: prometheus.NewDesc(
+			"system_package_updates_by_class",
+			"Number of installed packages with an update available by class (security, bugfix, enhancement or other) and the highest severity of the security advisories they fix",
+			[]string{"manager", "class", "severity"}, nil,
+		),
+		securityUpdateAge: prometheus.NewDesc(
+			"system_package_security_update_oldest_age_seconds",
+			"Time since the oldest security advisory fixed by a pending update was issued. Absent when no pending security advisory has an issue date.",
+			[]string{"manager"}, nil,
+		),
+		paths: paths,
+		cache: metricCache{ttl: ttl},
+	}
+}
+
+func (c *packageUpdatesCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.updateAvailable
+	ch <- c.updatesPending
+	ch <- c.updateHeld
+	ch <- c.updatesHeld
+	ch <- c.updatesByClass
+	ch <- c.securityUpdateAge
+}
+
+func (c *packageUpdatesCollector) Update(ctx context.Context, ch chan<- prometheus.Metric) error {
+	err := c.cache.collect(ch, func(ch chan<- prometheus.Metric) error {
+		c.mu.Lock()
+		c.oldestSecurity = map[string]time.Time{}
+		c.mu.Unlock()
+		return c.update(ctx, ch)
+	})
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for manager, oldest := range c.oldestSecurity {
+		ch <- prometheus.MustNewConstMetric(c.securityUpdateAge, prometheus.GaugeValue, timeNow().Sub(oldest).Seconds(), manager)
+	}
+	return err
+}
+
+func (c *packageUpdatesCollector) update(ctx context.Context, ch chan<- prometheus.Metric) error {
 	switch runtime.GOOS {
 	case "linux":
-		detectLinuxDistroAndCollectUpdates()
+		return c.detectLinuxDistroAndCollectUpdates(ctx, ch)
 	case "darwin":
-		collectMacOSPackageUpdates()
+		return c.collectMacOSPackageUpdates(ch)
 	default:
-		log.Println("Unsupported operating system for update availability check")
+		return fmt.Errorf("update availability check is not supported on %s", runtime.GOOS)
 	}
 }
 
-func detectLinuxDistroAndCollectUpdates() {
-	if _, err := os.Stat("/etc/os-release"); err == nil {
-		file, err := os.Open("/etc/os-release")
-		if err != nil { // Fixed syntax error: removed extra parentheses
-			log.Printf("Error opening /etc/os-release: %v", err)
-			return
-		}
-		defer file.Close()
-
-		scanner := bufio.NewScanner(file)
-		var distro string
-		for scanner.Scan() {
-			line := scanner.Text()
-			if strings.HasPrefix(line, "ID=") {
-				distro = strings.Trim(strings.TrimPrefix(line, "ID="), "\"")
-				break
-			}
-		}
-
-		if err := scanner.Err(); err != nil {
-			log.Printf("Error reading /etc/os-release: %v", err)
-			return
-		}
+func (c *packageUpdatesCollector) detectLinuxDistroAndCollectUpdates(ctx context.Context, ch chan<- prometheus.Metric) error {
+	release, err := readOSRelease(c.paths)
+	if err != nil {
+		return fmt.Errorf("unable to detect Linux distribution: %w", err)
+	}
+	distro := release["ID"]
 
-		switch distro {
+	// Derivatives such as Rocky Linux or Linux Mint name their parent
+	// distributions in ID_LIKE
+	for _, id := range append([]string{distro}, strings.Fields(release["ID_LIKE"])...) {
+		switch id {
 		case "ubuntu", "debian":
-			collectAptUpdates()
+			return c.collectAptUpdates(ch)
 		case "rhel", "centos", "fedora", "amazon", "amzn":
-			collectYumOrDnfUpdates()
-		default:
-			log.Printf("Unsupported Linux distribution: %s", distro)
+			return c.collectRPMUpdates(ctx, ch)
+		case "alpine":
+			return c.collectAPKUpdates(ch)
+		case "arch":
+			return c.collectPacmanUpdates(ch)
 		}
-	} else {
-		log.Println("Unable to detect Linux distribution, skipping update check")
 	}
+	return fmt.Errorf("unsupported Linux distribution: %s", distro)
 }
 
-func collectMacOSPackageUpdates() {
+func (c *packageUpdatesCollector) collectMacOSPackageUpdates(ch chan<- prometheus.Metric) error {
 	homebrewPaths := []string{"/usr/local/Cellar", "/opt/homebrew/Cellar"}
 
 	var homebrewCellar string
 	for _, path := range homebrewPaths {
-		if _, err := os.Stat(path); err == nil {
-			homebrewCellar = path
+		if _, err := os.Stat(c.paths.rootfs(path)); err == nil {
+			homebrewCellar = c.paths.rootfs(path)
 			break
 		}
 	}
 
 	if homebrewCellar == "" {
-		log.Println("Homebrew not found on this system")
-		packageUpdateAvailable.WithLabelValues("homebrew").Set(0)
-		return
+		ch <- prometheus.MustNewConstMetric(c.updateAvailable, prometheus.GaugeValue, 0, "homebrew", "", "")
+		return errors.New("homebrew not found on this system")
 	}
 
 	outdatedPath := homebrewCellar + "/outdated"
 	if _, err := os.Stat(outdatedPath); err == nil {
-		packageUpdateAvailable.WithLabelValues("homebrew").Set(1)
+		ch <- prometheus.MustNewConstMetric(c.updateAvailable, prometheus.GaugeValue, 1, "homebrew", "", "")
 	} else {
-		packageUpdateAvailable.WithLabelValues("homebrew").Set(0)
+		ch <- prometheus.MustNewConstMetric(c.updateAvailable, prometheus.GaugeValue, 0, "homebrew", "", "")
 	}
+	return nil
 }
 
-func collectAptUpdates() {
-	if _, err := os.Stat("/var/lib/apt/lists"); err == nil {
-		if _, err := os.Stat("/var/lib/apt/lists/partial"); err == nil {
-			log.Println("APT updates are available")
-			packageUpdateAvailable.WithLabelValues("apt").Set(1)
-		} else {
-			packageUpdateAvailable.WithLabelValues("apt").Set(0)
+// collectAptUpdates compares the installed packages with the package
+// indexes apt downloaded during its last update, so no network access is
+// needed and the result is only as fresh as the last apt-get update.
+func (c *packageUpdatesCollector) collectAptUpdates(ch chan<- prometheus.Metric) error {
+	updates, err := findAptUpdates(c.paths)
+	if err != nil {
+		return err
+	}
+
+	// Multi-Arch: same packages are installed once per architecture, and
+	// are counted once, like their series. A hold is set per architecture,
+	// so a held copy and one that is not are both counted
+	seen := labelSet{}
+	classes := make([]updateClassification, 0, len(updates))
+	held := 0
+	for _, update := range updates {
+		if !seen.add(update.pkg.name, update.pkg.version, update.candidate, update.held) {
+			continue
 		}
-	} else {
-		log.Println("APT package manager not found, skipping update check")
+		if update.held != "" {
+			held++
+			ch <- prometheus.MustNewConstMetric(c.updateHeld, prometheus.GaugeValue, 1, update.pkg.name, update.pkg.version, update.candidate, update.held)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(c.updateAvailable, prometheus.GaugeValue, 1, update.pkg.name, update.pkg.version, update.candidate)
+		classes = append(classes, update.updateClassification)
+	}
+	ch <- prometheus.MustNewConstMetric(c.updatesPending, prometheus.GaugeValue, float64(len(classes)), "apt")
+	ch <- prometheus.MustNewConstMetric(c.updatesHeld, prometheus.GaugeValue, float64(held), "apt")
+	c.collectUpdateClasses(ch, "apt", classes)
+	return nil
+}
+
+// collectRPMUpdates compares the installed packages with the repository
+// metadata dnf or yum cached during its last refresh, like collectAptUpdates.
+func (c *packageUpdatesCollector) collectRPMUpdates(ctx context.Context, ch chan<- prometheus.Metric) error {
+	manager, updates, err := findRPMUpdates(ctx, c.paths)
+	if err != nil {
+		return err
+	}
+
+	// Multilib packages are installed once per architecture, and are
+	// counted once, like their series. A versionlock entry may name one
+	// architecture, so a held copy and one that is not are both counted
+	seen := labelSet{}
+	classes := make([]updateClassification, 0, len(updates))
+	held := 0
+	for _, update := range updates {
+		installed, candidate := update.pkg.evr.String(), update.candidate.String()
+		if !seen.add(update.pkg.name, installed, candidate, update.held) {
+			continue
+		}
+		if update.held != "" {
+			held++
+			ch <- prometheus.MustNewConstMetric(c.updateHeld, prometheus.GaugeValue, 1, update.pkg.name, installed, candidate, update.held)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(c.updateAvailable, prometheus.GaugeValue, 1, update.pkg.name, installed, candidate)
+		classes = append(classes, update.updateClassification)
+	}
+	ch <- prometheus.MustNewConstMetric(c.updatesPending, prometheus.GaugeValue, float64(len(classes)), manager)
+	ch <- prometheus.MustNewConstMetric(c.updatesHeld, prometheus.GaugeValue, float64(held), manager)
+	c.collectUpdateClasses(ch, manager, classes)
+	return nil
+}
+
+// collectAPKUpdates compares the installed packages with the APKINDEX files
+// cached by the last apk update. APK indexes carry no advisories, so all
+// updates are classified as other.
+func (c *packageUpdatesCollector) collectAPKUpdates(ch chan<- prometheus.Metric) error {
+	updates, err := findAPKUpdates(c.paths)
+	if err != nil {
+		return err
 	}
+
+	classes := make([]updateClassification, 0, len(updates))
+	for _, update := range updates {
+		ch <- prometheus.MustNewConstMetric(c.updateAvailable, prometheus.GaugeValue, 1, update.pkg.name, update.pkg.version, update.candidate)
+		classes = append(classes, unclassifiedUpdate)
+	}
+	ch <- prometheus.MustNewConstMetric(c.updatesPending, prometheus.GaugeValue, float64(len(updates)), "apk")
+	c.collectUpdateClasses(ch, "apk", classes)
+	return nil
 }
 
-func collectYumOrDnfUpdates() {
-	if _, err := os.Stat("/var/cache/yum"); err == nil {
-		log.Println("YUM updates are available")
-		packageUpdateAvailable.WithLabelValues("yum").Set(1)
-		return
+// collectPacmanUpdates compares the installed packages with the sync
+// databases downloaded by the last pacman -Sy. Arch publishes no advisories
+// in them, so all updates are classified as other.
+func (c *packageUpdatesCollector) collectPacmanUpdates(ch chan<- prometheus.Metric) error {
+	updates, err := findPacmanUpdates(c.paths)
+	if err != nil {
+		return err
+	}
+
+	classes := make([]updateClassification, 0, len(updates))
+	for _, update := range updates {
+		ch <- prometheus.MustNewConstMetric(c.updateAvailable, prometheus.GaugeValue, 1, update.pkg.name, update.pkg.version, update.candidate)
+		classes = append(classes, unclassifiedUpdate)
 	}
+	ch <- prometheus.MustNewConstMetric(c.updatesPending, prometheus.GaugeValue, float64(len(updates)), "pacman")
+	c.collectUpdateClasses(ch, "pacman", classes)
+	return nil
+}
 
-	if _, err := os.Stat("/var/cache/dnf"); err == nil {
-		log.Println("DNF updates are available")
-		packageUpdateAvailable.WithLabelValues("dnf").Set(1)
-		return
+// collectUpdateClasses counts the pending updates of manager by class and
+// severity, and records when the oldest security fix among them was issued
+// for Update to report its age.
+func (c *packageUpdatesCollector) collectUpdateClasses(ch chan<- prometheus.Metric, manager string, classes []updateClassification) {
+	counts := map[[2]string]int{}
+	var oldest time.Time
+	for _, class := range classes {
+		counts[[2]string{class.class, class.severity}]++
+		if class.class == updateClassSecurity && !class.issued.IsZero() && (oldest.IsZero() || class.issued.Before(oldest)) {
+			oldest = class.issued
+		}
 	}
 
-	packageUpdateAvailable.WithLabelValues("yum_or_dnf").Set(0)
-	log.Println("No updates found for YUM or DNF")
+	for key, n := range counts {
+		ch <- prometheus.MustNewConstMetric(c.updatesByClass, prometheus.GaugeValue, float64(n), manager, key[0], key[1])
+	}
+	if !oldest.IsZero() {
+		c.mu.Lock()
+		c.oldestSecurity[manager] = oldest
+		c.mu.Unlock()
+	}
 }
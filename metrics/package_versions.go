@@ -2,86 +2,236 @@ package metrics
 
 import (
 	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
 	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
-	"strconv"
 	"strings"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
 
-var packageVersions = prometheus.NewGaugeVec(
-	prometheus.GaugeOpts{
-		Name: "system_package_version",
-		Help: "Version of installed packages",
-	},
-	[]string{"package", "version"},
-)
+type installedPackage struct {
+	name         string
+	version      string
+	architecture string
+	// source is the source package the package was built from, or "" when
+	// the package manager does not say.
+	source string
+	// purlType is the package URL type of the package manager, such as deb
+	// or rpm, or "" when packages have none.
+	purlType string
+	// vendor is the organisation that built the package, when recorded.
+	vendor string
+	// installTime is when the package was installed, or zero when unknown.
+	installTime time.Time
+}
+
+type packageVersionsCollector struct {
+	version      *prometheus.Desc
+	dpkgAbnormal *prometheus.Desc
+	lock         *prometheus.Desc
+	debug        bool
+	paths        Paths
+	cache        metricCache
+}
 
 func init() {
-	prometheus.MustRegister(packageVersions)
+	registerCollector("packages", true, func(opts Options) Collector {
+		return newPackageVersionsCollector(opts.Debug, opts.Paths, opts.CacheTTL)
+	})
 }
 
-func CollectPackageVersions(debug bool) {
+// newPackageVersionsCollector returns a collector for installed package
+// versions. Querying the package manager is expensive, so results are reused
+// for ttl.
+func newPackageVersionsCollector(debug bool, paths Paths, ttl time.Duration) Collector {
+	return &packageVersionsCollector{
+		version: prometheus.NewDesc(
+			"system_package_version",
+			"Version of installed packages",
+			[]string{"package", "version", "architecture", "source"}, nil,
+		),
+		dpkgAbnormal: prometheus.NewDesc(
+			"system_package_dpkg_abnormal_packages",
+			"Number of dpkg packages left half-installed, unconfigured, with pending triggers or requiring a reinstall",
+			[]string{"state"}, nil,
+		),
+		lock: prometheus.NewDesc(
+			"system_package_lock_info",
+			"Packages kept at a version by a dpkg hold, an apt pin or a versionlock entry, labelled with the locked version",
+			[]string{"manager", "package", "type", "version"}, nil,
+		),
+		debug: debug,
+		paths: paths,
+		cache: metricCache{ttl: ttl},
+	}
+}
+
+func (c *packageVersionsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.version
+	ch <- c.dpkgAbnormal
+	ch <- c.lock
+}
+
+func (c *packageVersionsCollector) Update(ctx context.Context, ch chan<- prometheus.Metric) error {
+	return c.cache.collect(ch, func(ch chan<- prometheus.Metric) error {
+		return c.update(ctx, ch)
+	})
+}
+
+func (c *packageVersionsCollector) update(ctx context.Context, ch chan<- prometheus.Metric) error {
+	debug := c.debug
 	if debug {
 		log.Println("Debug: Starting package version collection")
 	}
 
+	var (
+		packages []installedPackage
+		err      error
+	)
 	switch runtime.GOOS {
 	case "linux":
 		if debug {
 			log.Println("Debug: Collecting package versions for Linux")
 		}
-		collectLinuxPackageVersions(debug)
+		packages, err = collectLinuxPackageVersions(ctx, debug, c.paths)
 	case "darwin":
 		if debug {
 			log.Println("Debug: Collecting package versions for macOS")
 		}
-		collectMacOSPackageVersions(debug)
+		packages, err = collectMacOSPackageVersions(debug, c.paths)
 	default:
-		log.Println("Unsupported operating system")
+		err = fmt.Errorf("package version collection is not supported on %s", runtime.GOOS)
+	}
+	if err != nil {
+		return err
+	}
+
+	seen := labelSet{}
+	for _, pkg := range packages {
+		if seen.add(pkg.name, pkg.version, pkg.architecture) {
+			ch <- prometheus.MustNewConstMetric(c.version, prometheus.GaugeValue, 1, pkg.name, pkg.version, pkg.architecture, pkg.source)
+		}
+	}
+
+	if runtime.GOOS == "linux" {
+		if err := c.collectDpkgAbnormalStates(ch); err != nil {
+			return err
+		}
+		locks, err := findPackageLocks(c.paths)
+		if err != nil {
+			return fmt.Errorf("reading package locks: %w", err)
+		}
+		seen := labelSet{}
+		for _, lock := range locks {
+			if seen.add(lock.manager, lock.pkg, lock.kind, lock.version) {
+				ch <- prometheus.MustNewConstMetric(c.lock, prometheus.GaugeValue, 1, lock.manager, lock.pkg, lock.kind, lock.version)
+			}
+		}
 	}
 
 	if debug {
 		log.Println("Debug: Finished package version collection")
 	}
+	return nil
 }
 
-func collectLinuxPackageVersions(debug bool) {
-	if _, err := os.Stat("/var/lib/dpkg/status"); err == nil {
+func collectLinuxPackageVersions(ctx context.Context, debug bool, paths Paths) ([]installedPackage, error) {
+	dpkgStatus := paths.rootfs("/var/lib/dpkg/status")
+	if _, err := os.Stat(dpkgStatus); err == nil {
 		// Use dpkg for Debian/Ubuntu-based systems
-		parseDpkgStatusFile("/var/lib/dpkg/status")
-		return
+		return parseDpkgStatusFile(dpkgStatus)
+	}
+
+	installed, err := readRPMDatabase(paths)
+	if err == nil {
+		packages := make([]installedPackage, 0, len(installed))
+		for _, pkg := range installed {
+			packages = append(packages, installedPackage{
+				name:         pkg.name,
+				version:      pkg.evr.String(),
+				architecture: pkg.arch,
+				source:       pkg.sourceName(),
+				purlType:     "rpm",
+				vendor:       pkg.vendor,
+				installTime:  pkg.installTime,
+			})
+		}
+		return packages, nil
+	}
+	if errors.Is(err, errUnreadableRPMDatabase) {
+		// yum and dnf read the database with rpm itself
+		log.Printf("Falling back to yum or dnf: %v", err)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	if _, err := os.Stat(paths.rootfs("/lib/apk/db/installed")); err == nil {
+		// Use apk for Alpine Linux
+		apks, err := readInstalledAPKs(paths)
+		if err != nil {
+			return nil, fmt.Errorf("reading apk database: %w", err)
+		}
+		packages := make([]installedPackage, 0, len(apks))
+		for _, pkg := range apks {
+			packages = append(packages, installedPackage{name: pkg.name, version: pkg.version, architecture: pkg.architecture, source: pkg.sourceName(), purlType: "apk"})
+		}
+		return packages, nil
+	}
+
+	if _, err := os.Stat(paths.rootfs("/var/lib/pacman/local")); err == nil {
+		// Use pacman for Arch Linux
+		pacmanPackages, err := readInstalledPacman(paths)
+		if err != nil {
+			return nil, fmt.Errorf("reading pacman database: %w", err)
+		}
+		packages := make([]installedPackage, 0, len(pacmanPackages))
+		for _, pkg := range pacmanPackages {
+			packages = append(packages, installedPackage{name: pkg.name, version: pkg.version, architecture: pkg.architecture, source: pkg.sourceName(), purlType: "alpm", installTime: pkg.installTime})
+		}
+		return packages, nil
+	}
+
+	if debug {
+		log.Println("Debug: No package database found, falling back to yum or dnf")
+	}
+
+	// yum and dnf query the host's package database through --installroot
+	listArgs := []string{"list", "installed"}
+	if !paths.isHostRoot() {
+		listArgs = append(listArgs, "--installroot="+paths.RootFS)
 	}
 
 	if _, err := exec.LookPath("yum"); err == nil {
 		// Use yum for Red Hat-based systems
-		output, err := exec.Command("yum", "list", "installed").Output()
+		output, err := exec.CommandContext(ctx, "yum", listArgs...).Output()
 		if err != nil {
-			log.Printf("Error querying installed packages using yum: %v", err)
-			return
+			return nil, fmt.Errorf("querying installed packages using yum: %w", err)
 		}
-		parseYumOutput(output)
-		return
+		return parseYumOutput(output)
 	}
 
 	if _, err := exec.LookPath("dnf"); err == nil {
 		// Use dnf for newer Red Hat-based systems
-		output, err := exec.Command("dnf", "list", "installed").Output()
+		output, err := exec.CommandContext(ctx, "dnf", listArgs...).Output()
 		if err != nil {
-			log.Printf("Error querying installed packages using dnf: %v", err)
-			return
+			return nil, fmt.Errorf("querying installed packages using dnf: %w", err)
 		}
-		parseYumOutput(output)
-		return
+		return parseYumOutput(output)
 	}
 
-	log.Println("No supported package manager found on this system")
+	return nil, errors.New("no supported package manager found on this system")
 }
 
-func parseYumOutput(output []byte) {
+func parseYumOutput(output []byte) ([]installedPackage, error) {
+	var packages []installedPackage
 	scanner := bufio.NewScanner(strings.NewReader(string(output)))
 	for scanner.Scan() {
 		line := scanner.Text()
@@ -93,87 +243,104 @@ func parseYumOutput(output []byte) {
 		// Parse package name and version
 		fields := strings.Fields(line)
 		if len(fields) >= 3 { // Ensure there are enough fields for package and version
-			packageName := fields[0]
+			// Packages are listed as name.arch
+			packageName, architecture := fields[0], ""
+			if i := strings.LastIndexByte(packageName, '.'); i > 0 {
+				packageName, architecture = packageName[:i], packageName[i+1:]
+			}
 			version := fields[1]
-			packageVersions.WithLabelValues(packageName, version).Set(1) // Provide both labels
+			packages = append(packages, installedPackage{name: packageName, version: version, architecture: architecture, purlType: "rpm"})
 		}
 	}
 
 	if err := scanner.Err(); err != nil {
-		log.Printf("Error reading yum/dnf list output: %v", err)
+		return nil, fmt.Errorf("reading yum/dnf list output: %w", err)
 	}
+	return packages, nil
 }
 
-func parseVersionToFloat(version string) float64 {
-	// Replace non-numeric characters with dots and parse as float
-	version = strings.ReplaceAll(version, "-", ".")
-	version = strings.ReplaceAll(version, "_", ".")
-	parts := strings.Split(version, ".")
-	var numericVersion string
-	for _, part := range parts {
-		if _, err := strconv.Atoi(part); err == nil {
-			numericVersion += part
-		} else {
-			break
+func parseDpkgStatusFile(statusPath string) ([]installedPackage, error) {
+	dpkgPackages, err := readDpkgStatus(statusPath)
+	if err != nil {
+		return nil, err
+	}
+
+	infoDir := filepath.Join(filepath.Dir(statusPath), "info")
+	packages := make([]installedPackage, 0, len(dpkgPackages))
+	for _, pkg := range dpkgPackages {
+		if pkg.isInstalled() {
+			packages = append(packages, installedPackage{
+				name:         pkg.name,
+				version:      pkg.version,
+				architecture: pkg.architecture,
+				source:       pkg.sourceName(),
+				purlType:     "deb",
+				installTime:  dpkgInstallTime(infoDir, pkg),
+			})
 		}
 	}
-	floatVersion, err := strconv.ParseFloat(numericVersion, 64)
-	if err != nil {
-		log.Printf("Error parsing version %s: %v", version, err)
-		return 0
+	return packages, nil
+}
+
+// dpkgInstallTime returns when the package was last unpacked. dpkg records
+// no install time, but rewrites the list of the package's files in
+// /var/lib/dpkg/info every time, named <package>:<arch>.list for
+// Multi-Arch: same packages.
+func dpkgInstallTime(infoDir string, pkg dpkgPackage) time.Time {
+	for _, name := range []string{pkg.key() + ".list", pkg.name + ".list"} {
+		if info, err := os.Stat(filepath.Join(infoDir, name)); err == nil {
+			return info.ModTime().UTC()
+		}
 	}
-	return floatVersion
+	return time.Time{}
 }
 
-func parseDpkgStatusFile(filepath string) {
-	file, err := os.Open(filepath)
+// collectDpkgAbnormalStates counts the packages dpkg left in an unfinished
+// or broken state, which dpkg --audit reports. Every state is reported, as
+// zero when no package is in it, so that alerts can tell a healthy host
+// from one without dpkg.
+func (c *packageVersionsCollector) collectDpkgAbnormalStates(ch chan<- prometheus.Metric) error {
+	packages, err := readDpkgStatus(c.paths.rootfs("/var/lib/dpkg/status"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
 	if err != nil {
-		log.Printf("Error opening dpkg status file: %v", err)
-		return
+		return err
 	}
-	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
-	var packageName, version string
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.HasPrefix(line, "Package: ") {
-			packageName = strings.TrimPrefix(line, "Package: ")
-		} else if strings.HasPrefix(line, "Version: ") {
-			version = strings.TrimPrefix(line, "Version: ")
-			if packageName != "" && version != "" {
-				packageVersions.WithLabelValues(packageName, version).Set(1)
-				packageName, version = "", ""
-			}
+	counts := map[string]int{}
+	for _, pkg := range packages {
+		if state := pkg.abnormalState(); state != "" {
+			counts[state]++
 		}
 	}
-	if err := scanner.Err(); err != nil {
-		log.Printf("Error reading dpkg status file: %v", err)
+	for _, state := range dpkgAbnormalStates {
+		ch <- prometheus.MustNewConstMetric(c.dpkgAbnormal, prometheus.GaugeValue, float64(counts[state]), state)
 	}
+	return nil
 }
 
-func collectMacOSPackageVersions(debug bool) {
+func collectMacOSPackageVersions(debug bool, paths Paths) ([]installedPackage, error) {
 	homebrewPaths := []string{"/usr/local/Cellar", "/opt/homebrew/Cellar"}
 
 	var homebrewCellar string
 	for _, path := range homebrewPaths {
-		if _, err := os.Stat(path); err == nil {
-			homebrewCellar = path
+		if _, err := os.Stat(paths.rootfs(path)); err == nil {
+			homebrewCellar = paths.rootfs(path)
 			break
 		}
 	}
 
 	if homebrewCellar == "" {
-		log.Println("Homebrew not found on this system")
-		return
+		return nil, errors.New("homebrew not found on this system")
 	}
 
 	entries, err := os.ReadDir(homebrewCellar)
 	if err != nil {
-		log.Printf("Error reading Homebrew cellar directory: %v", err)
-		return
+		return nil, fmt.Errorf("reading Homebrew cellar directory: %w", err)
 	}
 
+	var packages []installedPackage
 	for _, entry := range entries {
 		if entry.IsDir() {
 			packageName := entry.Name()
@@ -181,8 +348,16 @@ func collectMacOSPackageVersions(debug bool) {
 			if err != nil || len(versionEntries) == 0 {
 				continue
 			}
+			// Old versions stay in the cellar until `brew cleanup`, and
+			// directory order would put 1.10 before 1.9
 			version := versionEntries[0].Name()
-			packageVersions.WithLabelValues(packageName, version).Set(1)
+			for _, entry := range versionEntries[1:] {
+				if CompareDebianVersions(entry.Name(), version) > 0 {
+					version = entry.Name()
+				}
+			}
+			packages = append(packages, installedPackage{name: packageName, version: version})
 		}
 	}
+	return packages, nil
 }
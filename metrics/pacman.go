@@ -0,0 +1,247 @@
+package metrics
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// pacmanPackage is a package in the pacman local or sync database.
+type pacmanPackage struct {
+	name         string
+	version      string
+	architecture string
+	// base is the pkgbase of split packages, the PKGBUILD they were built
+	// from.
+	base string
+	// installTime is when the package was installed, recorded in the local
+	// database only.
+	installTime time.Time
+}
+
+// sourceName returns the pkgbase of the package, or its name for packages
+// that are not split.
+func (p pacmanPackage) sourceName() string {
+	if p.base != "" {
+		return p.base
+	}
+	return p.name
+}
+
+// readPacmanDesc parses a desc file of the pacman database. Every field is
+// a %NAME% line followed by its values, one per line, and a blank line.
+func readPacmanDesc(r io.Reader) (pacmanPackage, error) {
+	var pkg pacmanPackage
+	var field string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			field = ""
+		case strings.HasPrefix(line, "%") && strings.HasSuffix(line, "%"):
+			field = line
+		case field == "%NAME%":
+			pkg.name = line
+		case field == "%VERSION%":
+			pkg.version = line
+		case field == "%ARCH%":
+			pkg.architecture = line
+		case field == "%BASE%":
+			pkg.base = line
+		case field == "%INSTALLDATE%":
+			if seconds, err := strconv.ParseInt(line, 10, 64); err == nil {
+				pkg.installTime = time.Unix(seconds, 0).UTC()
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return pkg, err
+	}
+	if pkg.name == "" || pkg.version == "" {
+		return pkg, errors.New("package description without name or version")
+	}
+	return pkg, nil
+}
+
+// readInstalledPacman reads the local database, a directory per installed
+// package under /var/lib/pacman/local.
+func readInstalledPacman(paths Paths) ([]pacmanPackage, error) {
+	descs, err := filepath.Glob(paths.rootfs("/var/lib/pacman/local/*/desc"))
+	if err != nil {
+		return nil, err
+	}
+
+	packages := make([]pacmanPackage, 0, len(descs))
+	for _, desc := range descs {
+		file, err := os.Open(desc)
+		if err != nil {
+			return nil, err
+		}
+		pkg, err := readPacmanDesc(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", filepath.Base(filepath.Dir(desc)), err)
+		}
+		packages = append(packages, pkg)
+	}
+	return packages, nil
+}
+
+// pacmanRepos returns the repositories in the order /etc/pacman.conf lists
+// them, which is the order pacman searches them. Without a configuration
+// every downloaded sync database is used in name order.
+func pacmanRepos(paths Paths) ([]string, error) {
+	data, err := os.ReadFile(paths.rootfs("/etc/pacman.conf"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	var repos []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			if name := line[1 : len(line)-1]; name != "options" {
+				repos = append(repos, name)
+			}
+		}
+	}
+	if len(repos) > 0 {
+		return repos, nil
+	}
+
+	dbs, err := filepath.Glob(paths.rootfs("/var/lib/pacman/sync/*.db"))
+	if err != nil {
+		return nil, err
+	}
+	for _, db := range dbs {
+		repos = append(repos, strings.TrimSuffix(filepath.Base(db), ".db"))
+	}
+	return repos, nil
+}
+
+// readPacmanSyncDB calls fn for every package of a sync database, a tar
+// archive of <name>-<version>/desc files compressed as repo-add was told
+// to.
+func readPacmanSyncDB(path string, fn func(pacmanPackage)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	br := bufio.NewReader(file)
+	magic, _ := br.Peek(4)
+	var r io.Reader = br
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		r = bzip2.NewReader(br)
+	case bytes.HasPrefix(magic, []byte{0xfd, '7', 'z', 'X'}):
+		return errors.New("xz-compressed sync databases are not supported")
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !strings.HasSuffix(header.Name, "/desc") {
+			continue
+		}
+		pkg, err := readPacmanDesc(tr)
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", header.Name, err)
+		}
+		fn(pkg)
+	}
+}
+
+// pacmanUpdate is an installed package with a newer version in a sync
+// database.
+type pacmanUpdate struct {
+	pkg       pacmanPackage
+	candidate string
+}
+
+// findPacmanUpdates compares the installed packages with the sync databases
+// downloaded by the last pacman -Sy, like pacman -Qu. As in pacman, the
+// first repository that has a package provides its candidate, even when a
+// later one has a newer version.
+func findPacmanUpdates(paths Paths) ([]pacmanUpdate, error) {
+	installed, err := readInstalledPacman(paths)
+	if err != nil {
+		return nil, err
+	}
+	repos, err := pacmanRepos(paths)
+	if err != nil {
+		return nil, err
+	}
+
+	wanted := map[string]bool{}
+	for _, pkg := range installed {
+		wanted[pkg.name] = true
+	}
+
+	candidates := map[string]string{}
+	found := false
+	for _, repo := range repos {
+		db := paths.rootfs(filepath.Join("/var/lib/pacman/sync", repo+".db"))
+		if _, err := os.Stat(db); err != nil {
+			continue
+		}
+		found = true
+		err := readPacmanSyncDB(db, func(pkg pacmanPackage) {
+			if _, ok := candidates[pkg.name]; !ok && wanted[pkg.name] {
+				candidates[pkg.name] = pkg.version
+			}
+		})
+		if err != nil {
+			return nil, fmt.Errorf("reading %s.db: %w", repo, err)
+		}
+	}
+	if !found {
+		return nil, errors.New("no pacman sync databases found, run pacman -Sy")
+	}
+
+	var updates []pacmanUpdate
+	for _, pkg := range installed {
+		if candidate, ok := candidates[pkg.name]; ok && ComparePacmanVersions(candidate, pkg.version) > 0 {
+			updates = append(updates, pacmanUpdate{pkg: pkg, candidate: candidate})
+		}
+	}
+	sort.Slice(updates, func(i, j int) bool {
+		return updates[i].pkg.name < updates[j].pkg.name
+	})
+	return updates, nil
+}
@@ -0,0 +1,122 @@
+package metrics
+
+import "strings"
+
+// ComparePacmanVersions compares two Arch Linux package versions of the form
+// [epoch:]pkgver-pkgrel the way vercmp and pacman do. It returns a negative
+// number when a is older than b, zero when they are equal and a positive
+// number when a is newer.
+//
+// The ordering is close to rpm's, but a trailing letter marks a
+// pre-release, so 1.0a is older than 1.0, longer separators are newer, and
+// the release is only compared when both versions have one.
+func ComparePacmanVersions(a, b string) int {
+	if a == b {
+		return 0
+	}
+	epochA, versionA, releaseA, hasReleaseA := parsePacmanVersion(a)
+	epochB, versionB, releaseB, hasReleaseB := parsePacmanVersion(b)
+	if c := alpmvercmp(epochA, epochB); c != 0 {
+		return c
+	}
+	if c := alpmvercmp(versionA, versionB); c != 0 || !hasReleaseA || !hasReleaseB {
+		return c
+	}
+	return alpmvercmp(releaseA, releaseB)
+}
+
+// parsePacmanVersion is libalpm's parseEVR. The epoch is only recognised
+// when the version starts with digits followed by a colon.
+func parsePacmanVersion(evr string) (epoch, version, release string, hasRelease bool) {
+	epoch, version = "0", evr
+	digits := 0
+	for digits < len(evr) && isDigit(evr[digits]) {
+		digits++
+	}
+	if digits < len(evr) && evr[digits] == ':' {
+		if digits > 0 {
+			epoch = evr[:digits]
+		}
+		version = evr[digits+1:]
+	}
+	if i := strings.LastIndexByte(version, '-'); i >= 0 {
+		version, release, hasRelease = version[:i], version[i+1:], true
+	}
+	return epoch, version, release, hasRelease
+}
+
+// alpmvercmp is libalpm's copy of rpmvercmp, which predates rpm's tilde and
+// caret handling and differs from it at the end of the strings.
+func alpmvercmp(a, b string) int {
+	if a == b {
+		return 0
+	}
+
+	i, j := 0, 0
+	segA, segB := 0, 0 // ends of the previous segments
+	for i < len(a) && j < len(b) {
+		for i < len(a) && !isAlnum(a[i]) {
+			i++
+		}
+		for j < len(b) && !isAlnum(b[j]) {
+			j++
+		}
+		if i == len(a) || j == len(b) {
+			break
+		}
+
+		// The version with the longer separator is newer
+		if sepA, sepB := i-segA, j-segB; sepA != sepB {
+			if sepA < sepB {
+				return -1
+			}
+			return 1
+		}
+
+		isNum := isDigit(a[i])
+		segment := isAlpha
+		if isNum {
+			segment = isDigit
+		}
+		endA, endB := i, j
+		for endA < len(a) && segment(a[endA]) {
+			endA++
+		}
+		for endB < len(b) && segment(b[endB]) {
+			endB++
+		}
+		if endB == j {
+			// The segments are of different types; numbers are newer
+			if isNum {
+				return 1
+			}
+			return -1
+		}
+
+		sa, sb := a[i:endA], b[j:endB]
+		if isNum {
+			sa, sb = strings.TrimLeft(sa, "0"), strings.TrimLeft(sb, "0")
+			if len(sa) != len(sb) {
+				if len(sa) > len(sb) {
+					return 1
+				}
+				return -1
+			}
+		}
+		if c := strings.Compare(sa, sb); c != 0 {
+			return c
+		}
+		i, j = endA, endB
+		segA, segB = endA, endB
+	}
+
+	if i == len(a) && j == len(b) {
+		return 0
+	}
+	// A remaining alphabetic part never beats the end of the string: it is
+	// a pre-release such as 1.0a or 1.0rc1
+	if (i == len(a) && !isAlpha(byteAt(b, j))) || isAlpha(byteAt(a, i)) {
+		return -1
+	}
+	return 1
+}
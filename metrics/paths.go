@@ -0,0 +1,51 @@
+package metrics
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// Paths holds the prefixes under which the host filesystem, procfs and
+// sysfs are mounted. They differ from the defaults when the exporter runs in
+// a container with the host filesystem mounted elsewhere, e.g. /host.
+type Paths struct {
+	RootFS string
+	ProcFS string
+	SysFS  string
+}
+
+// DefaultPaths returns the prefixes of a process running directly on the host.
+func DefaultPaths() Paths {
+	return Paths{RootFS: "/", ProcFS: "/proc", SysFS: "/sys"}
+}
+
+// rootfs resolves a host path such as /etc/passwd under the rootfs prefix.
+func (p Paths) rootfs(path string) string {
+	return filepath.Join(p.RootFS, path)
+}
+
+// hostPath strips the rootfs prefix from a resolved path so labels show the
+// path as seen on the host.
+func (p Paths) hostPath(path string) string {
+	rel, err := filepath.Rel(p.RootFS, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return path
+	}
+	return filepath.Join("/", rel)
+}
+
+// proc resolves a path relative to the procfs mount, e.g. proc("1", "status").
+func (p Paths) proc(elem ...string) string {
+	return filepath.Join(append([]string{p.ProcFS}, elem...)...)
+}
+
+// sys resolves a path relative to the sysfs mount.
+func (p Paths) sys(elem ...string) string {
+	return filepath.Join(append([]string{p.SysFS}, elem...)...)
+}
+
+// isHostRoot reports whether the exporter sees the host filesystem as its
+// own, so commands it runs and the user it runs as belong to the host.
+func (p Paths) isHostRoot() bool {
+	return filepath.Clean(p.RootFS) == "/"
+}
@@ -1,6 +1,8 @@
 package metrics
 
 import (
+	"context"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"runtime"
@@ -15,39 +17,53 @@ import (
 // Run the following command in your terminal:
 // go get github.com/shirou/gopsutil/process
 
-var (
-	processMetrics = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "system_process_info",
-			Help: "Information about running processes",
-		},
-		[]string{"pid", "name", "user"},
-	)
-)
+type processCollector struct {
+	info  *prometheus.Desc
+	paths Paths
+}
+
+func init() {
+	registerCollector("process", false, func(opts Options) Collector {
+		return newProcessCollector(opts.Paths)
+	})
+}
 
-func RegisterProcessMetrics() {
-	prometheus.MustRegister(processMetrics)
+// newProcessCollector returns a collector for the running processes.
+func newProcessCollector(paths Paths) Collector {
+	return &processCollector{
+		info: prometheus.NewDesc(
+			"system_process_info",
+			"Information about running processes",
+			[]string{"pid", "name", "user"}, nil,
+		),
+		paths: paths,
+	}
+}
+
+func (c *processCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.info
 }
 
-func CollectProcessMetrics() {
+func (c *processCollector) Update(ctx context.Context, ch chan<- prometheus.Metric) error {
 	if runtime.GOOS == "linux" {
-		collectLinuxProcessMetrics()
+		return c.collectLinuxProcessMetrics(ctx, ch)
 	} else if runtime.GOOS == "darwin" {
-		collectMacOSProcessMetrics()
-	} else {
-		log.Printf("Process metrics collection is not supported on %s", runtime.GOOS)
+		return c.collectMacOSProcessMetrics(ctx, ch)
 	}
+	return fmt.Errorf("process metrics collection is not supported on %s", runtime.GOOS)
 }
 
-func collectLinuxProcessMetrics() {
-	procDir := "/proc"
+func (c *processCollector) collectLinuxProcessMetrics(ctx context.Context, ch chan<- prometheus.Metric) error {
+	procDir := c.paths.proc()
 	files, err := ioutil.ReadDir(procDir)
 	if err != nil {
-		log.Printf("Error reading /proc directory: %v", err)
-		return
+		return fmt.Errorf("reading %s directory: %w", procDir, err)
 	}
 
 	for _, file := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		if !file.IsDir() {
 			continue
 		}
@@ -57,48 +73,61 @@ func collectLinuxProcessMetrics() {
 			continue // Skip non-numeric directories
 		}
 
-		statusPath := procDir + "/" + pid + "/status"
-		data, err := ioutil.ReadFile(statusPath)
+		name, user, err := readProcessStatus(c.paths.proc(pid, "status"))
 		if err != nil {
 			log.Printf("Error reading process status for PID %s: %v", pid, err)
 			continue
 		}
 
-		var name, user string
-		lines := strings.Split(string(data), "\n")
-		for _, line := range lines {
-			if strings.HasPrefix(line, "Name:") {
-				name = strings.TrimSpace(strings.Split(line, ":")[1])
-			} else if strings.HasPrefix(line, "Uid:") {
-				uid := strings.Fields(strings.Split(line, ":")[1])[0]
-				user = uid // You can resolve UID to username if needed
+		ch <- prometheus.MustNewConstMetric(c.info, prometheus.GaugeValue, 1, pid, name, user)
+	}
+	return nil
+}
+
+// readProcessStatus returns the command name and real UID from a
+// /proc/<pid>/status file.
+func readProcessStatus(statusPath string) (name, uid string, err error) {
+	data, err := ioutil.ReadFile(statusPath)
+	if err != nil {
+		return "", "", err
+	}
+
+	lines := strings.Split(string(data), "\n")
+	for _, line := range lines {
+		if strings.HasPrefix(line, "Name:") {
+			name = strings.TrimSpace(strings.TrimPrefix(line, "Name:"))
+		} else if strings.HasPrefix(line, "Uid:") {
+			if fields := strings.Fields(strings.TrimPrefix(line, "Uid:")); len(fields) > 0 {
+				uid = fields[0] // You can resolve UID to username if needed
 			}
 		}
-
-		processMetrics.WithLabelValues(pid, name, user).Set(1)
 	}
+	return name, uid, nil
 }
 
-func collectMacOSProcessMetrics() {
-	processes, err := process.Processes()
+func (c *processCollector) collectMacOSProcessMetrics(ctx context.Context, ch chan<- prometheus.Metric) error {
+	processes, err := process.ProcessesWithContext(ctx)
 	if err != nil {
-		log.Printf("Error fetching process list: %v", err)
-		return
+		return fmt.Errorf("fetching process list: %w", err)
 	}
 
 	for _, proc := range processes {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		pid := strconv.Itoa(int(proc.Pid))
-		name, err := proc.Name()
+		name, err := proc.NameWithContext(ctx)
 		if err != nil {
 			log.Printf("Error fetching process name for PID %s: %v", pid, err)
 			continue
 		}
-		username, err := proc.Username()
+		username, err := proc.UsernameWithContext(ctx)
 		if err != nil {
 			log.Printf("Error fetching username for PID %s: %v", pid, err)
 			continue
 		}
 
-		processMetrics.WithLabelValues(pid, name, username).Set(1)
+		ch <- prometheus.MustNewConstMetric(c.info, prometheus.GaugeValue, 1, pid, name, username)
 	}
+	return nil
 }
@@ -0,0 +1,280 @@
+package metrics
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Reasons a reboot is required.
+const (
+	// rebootReasonFlagFile is the /run/reboot-required file that Debian and
+	// Ubuntu package scripts create.
+	rebootReasonFlagFile = "flag_file"
+	// rebootReasonNewerKernel is a kernel newer than the running one.
+	rebootReasonNewerKernel = "newer_kernel"
+	// rebootReasonUpdatedPackages is an RPM package from rpmRebootPackages
+	// updated since boot.
+	rebootReasonUpdatedPackages = "updated_packages"
+)
+
+var rebootReasons = []string{rebootReasonFlagFile, rebootReasonNewerKernel, rebootReasonUpdatedPackages}
+
+// rpmRebootPackages are the packages whose update dnf needs-restarting -r
+// reports as requiring a reboot. Kernels are left to the comparison of the
+// running kernel with the installed ones.
+var rpmRebootPackages = []string{"glibc", "linux-firmware", "systemd", "dbus", "dbus-broker", "dbus-daemon", "microcode_ctl"}
+
+type rebootCollector struct {
+	required *prometheus.Desc
+	packages *prometheus.Desc
+	kernel   *prometheus.Desc
+	paths    Paths
+	cache    metricCache
+}
+
+func init() {
+	registerCollector("reboot", true, func(opts Options) Collector {
+		return newRebootCollector(opts.Paths, opts.CacheTTL)
+	})
+}
+
+// newRebootCollector returns a collector for pending reboots: after updates
+// to the kernel or to libraries every process uses, the host keeps running
+// the old code until it restarts. Checking for updated RPM packages reads
+// the whole RPM database, so results are reused for ttl.
+func newRebootCollector(paths Paths, ttl time.Duration) Collector {
+	return &rebootCollector{
+		required: prometheus.NewDesc(
+			"system_reboot_required",
+			"Whether a reboot is required to finish applying updates (1 for required, 0 for not), by reason",
+			[]string{"reason"}, nil,
+		),
+		packages: prometheus.NewDesc(
+			"system_reboot_required_package",
+			"Packages whose update requires a reboot",
+			[]string{"package"}, nil,
+		),
+		kernel: prometheus.NewDesc(
+			"system_kernel_info",
+			"Running kernel release and the newest installed one",
+			[]string{"running_version", "newest_installed_version"}, nil,
+		),
+		paths: paths,
+		cache: metricCache{ttl: ttl},
+	}
+}
+
+func (c *rebootCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.required
+	ch <- c.packages
+	ch <- c.kernel
+}
+
+func (c *rebootCollector) Update(ctx context.Context, ch chan<- prometheus.Metric) error {
+	if runtime.GOOS != "linux" {
+		return fmt.Errorf("reboot detection is not supported on %s", runtime.GOOS)
+	}
+	return c.cache.collect(ch, func(ch chan<- prometheus.Metric) error {
+		return c.update(ctx, ch)
+	})
+}
+
+func (c *rebootCollector) update(ctx context.Context, ch chan<- prometheus.Metric) error {
+	required := map[string]bool{}
+	var packages []string
+
+	flagged, flagPackages, err := readRebootRequiredFile(c.paths)
+	if err != nil {
+		return err
+	}
+	required[rebootReasonFlagFile] = flagged
+	packages = append(packages, flagPackages...)
+
+	running, err := runningKernelVersion(ctx, c.paths)
+	if err != nil {
+		return fmt.Errorf("fetching kernel version: %w", err)
+	}
+	kernels, err := installedKernels(c.paths)
+	if err != nil {
+		return err
+	}
+	// Releases of different flavours, such as 6.1.0-18-amd64 and
+	// 6.1.0-18-cloud-amd64, do not order, and the host keeps booting the
+	// flavour it runs
+	flavour := kernelFlavour(running)
+	kernels = slices.DeleteFunc(kernels, func(release string) bool {
+		return kernelFlavour(release) != flavour
+	})
+	if len(kernels) > 0 {
+		newest := kernels[len(kernels)-1]
+		required[rebootReasonNewerKernel] = rpmvercmp(newest, running) > 0
+		ch <- prometheus.MustNewConstMetric(c.kernel, prometheus.GaugeValue, 1, running, newest)
+	}
+
+	updated, err := rpmPackagesUpdatedSinceBoot(c.paths)
+	if err != nil {
+		return err
+	}
+	required[rebootReasonUpdatedPackages] = len(updated) > 0
+	packages = append(packages, updated...)
+
+	for _, reason := range rebootReasons {
+		value := 0.0
+		if required[reason] {
+			value = 1
+		}
+		ch <- prometheus.MustNewConstMetric(c.required, prometheus.GaugeValue, value, reason)
+	}
+	seen := labelSet{}
+	for _, pkg := range packages {
+		if seen.add(pkg) {
+			ch <- prometheus.MustNewConstMetric(c.packages, prometheus.GaugeValue, 1, pkg)
+		}
+	}
+	return nil
+}
+
+// readRebootRequiredFile reports whether /run/reboot-required exists and
+// returns the packages listed in reboot-required.pkgs next to it. /var/run
+// is checked too, for hosts where it is not a symlink to /run.
+func readRebootRequiredFile(paths Paths) (bool, []string, error) {
+	for _, dir := range []string{"/run", "/var/run"} {
+		if _, err := os.Stat(paths.rootfs(filepath.Join(dir, "reboot-required"))); err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return false, nil, err
+		}
+
+		data, err := os.ReadFile(paths.rootfs(filepath.Join(dir, "reboot-required.pkgs")))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return true, nil, err
+		}
+		return true, strings.Fields(string(data)), nil
+	}
+	return false, nil, nil
+}
+
+// installedKernels returns the releases of the kernels installed in /boot
+// as vmlinuz-<release>, or under /lib/modules/<release> with their modules
+// index or, as on Fedora and Arch, their image. Removing a kernel can leave
+// its modules directory behind, which is why an empty one does not count.
+// The releases are sorted oldest first.
+func installedKernels(paths Paths) ([]string, error) {
+	var candidates []string
+	images, err := filepath.Glob(paths.rootfs("/boot/vmlinuz-*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, image := range images {
+		candidates = append(candidates, strings.TrimPrefix(filepath.Base(image), "vmlinuz-"))
+	}
+	for _, dir := range []string{"/lib/modules", "/usr/lib/modules"} {
+		for _, name := range []string{"modules.dep", "vmlinuz"} {
+			matches, err := filepath.Glob(paths.rootfs(filepath.Join(dir, "*", name)))
+			if err != nil {
+				return nil, err
+			}
+			for _, match := range matches {
+				candidates = append(candidates, filepath.Base(filepath.Dir(match)))
+			}
+		}
+	}
+
+	// Images named after the flavour, such as Alpine's vmlinuz-lts or Arch's
+	// vmlinuz-linux, do not say which release they are
+	var kernels []string
+	seen := labelSet{}
+	for _, release := range candidates {
+		if release != "" && isDigit(release[0]) && seen.add(release) {
+			kernels = append(kernels, release)
+		}
+	}
+	sort.Slice(kernels, func(i, j int) bool {
+		return rpmvercmp(kernels[i], kernels[j]) < 0
+	})
+	return kernels, nil
+}
+
+// kernelFlavour returns the flavour of a kernel release: its trailing
+// hyphen-separated words that do not start with a digit, as in
+// 6.1.0-18-cloud-amd64, 5.15.0-101-lowlatency or 6.6.14-0-lts, followed by
+// the variant after a plus sign, as in 5.14.0-362.8.1.el9_3.x86_64+rt.
+func kernelFlavour(release string) string {
+	release, variant, hasVariant := strings.Cut(release, "+")
+	words := strings.Split(release, "-")
+	i := len(words)
+	for i > 1 && words[i-1] != "" && !isDigit(words[i-1][0]) {
+		i--
+	}
+	flavour := strings.Join(words[i:], "-")
+	if hasVariant {
+		flavour += "+" + variant
+	}
+	return flavour
+}
+
+// rpmPackagesUpdatedSinceBoot returns the packages of rpmRebootPackages
+// installed after the host booted, as dnf needs-restarting -r does. Hosts
+// without an RPM database have none.
+func rpmPackagesUpdatedSinceBoot(paths Paths) ([]string, error) {
+	installed, err := readRPMDatabase(paths)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	booted, err := bootTime(paths)
+	if err != nil {
+		return nil, err
+	}
+
+	var updated []string
+	for _, pkg := range installed {
+		for _, name := range rpmRebootPackages {
+			if pkg.name == name && pkg.installTime.After(booted) {
+				updated = append(updated, pkg.name)
+			}
+		}
+	}
+	sort.Strings(updated)
+	return updated, nil
+}
+
+// bootTime reads when the host booted from the btime line of /proc/stat.
+func bootTime(paths Paths) (time.Time, error) {
+	file, err := os.Open(paths.proc("stat"))
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), "btime "); ok {
+			seconds, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+			if err != nil {
+				return time.Time{}, fmt.Errorf("parsing boot time: %w", err)
+			}
+			return time.Unix(seconds, 0), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return time.Time{}, err
+	}
+	return time.Time{}, errors.New("no btime in /proc/stat")
+}
@@ -0,0 +1,23 @@
+package metrics
+
+import "testing"
+
+func TestKernelFlavour(t *testing.T) {
+	tests := []struct {
+		release, want string
+	}{
+		{"6.1.0-18-amd64", "amd64"},
+		{"6.1.0-18-cloud-amd64", "cloud-amd64"},
+		{"5.15.0-101-generic", "generic"},
+		{"6.6.14-0-lts", "lts"},
+		{"6.7.4-arch1-1", ""},
+		{"6.7.4-zen1-1-zen", "zen"},
+		{"5.14.0-362.18.1.el9_3.x86_64", ""},
+		{"5.14.0-362.8.1.el9_3.x86_64+rt", "+rt"},
+	}
+	for _, tt := range tests {
+		if got := kernelFlavour(tt.release); got != tt.want {
+			t.Errorf("kernelFlavour(%q) = %q, want %q", tt.release, got, tt.want)
+		}
+	}
+}
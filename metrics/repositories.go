@@ -0,0 +1,325 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// signingKeyDirs are the directories holding the keys package managers
+// trust, by manager. The rpm manager is resolved by rpmRepoManager.
+var signingKeyDirs = []struct {
+	manager string
+	dir     string
+}{
+	{"apt", "/etc/apt/trusted.gpg.d"},
+	{"apt", "/etc/apt/keyrings"},
+	{"rpm", "/etc/pki/rpm-gpg"},
+}
+
+type repositoriesCollector struct {
+	repository *prometheus.Desc
+	unsigned   *prometheus.Desc
+	key        *prometheus.Desc
+	keyExpiry  *prometheus.Desc
+	keyError   *prometheus.Desc
+	paths      Paths
+}
+
+func init() {
+	registerCollector("repositories", true, func(opts Options) Collector {
+		return newRepositoriesCollector(opts.Paths)
+	})
+}
+
+// newRepositoriesCollector returns a collector for the package repositories
+// configured for apt, dnf and yum, and for the keys their signatures are
+// checked with.
+func newRepositoriesCollector(paths Paths) Collector {
+	return &repositoriesCollector{
+		repository: prometheus.NewDesc(
+			"system_package_repository_info",
+			"Configured package repositories, with whether they are enabled, whether package signatures are checked and whether they are trusted without a signature",
+			[]string{"manager", "repository", "url", "file", "enabled", "gpgcheck", "trusted"}, nil,
+		),
+		unsigned: prometheus.NewDesc(
+			"system_package_repositories_unsigned",
+			"Number of enabled package repositories whose signatures are not checked",
+			[]string{"manager"}, nil,
+		),
+		key: prometheus.NewDesc(
+			"system_package_signing_key_info",
+			"OpenPGP keys and subkeys trusted to sign packages or repository metadata",
+			[]string{"manager", "file", "fingerprint", "uid", "subkey"}, nil,
+		),
+		keyExpiry: prometheus.NewDesc(
+			"system_package_signing_key_expiry_timestamp_seconds",
+			"Expiry time of a trusted signing key or subkey, for keys that expire",
+			[]string{"manager", "file", "fingerprint", "uid", "subkey"}, nil,
+		),
+		keyError: prometheus.NewDesc(
+			"system_package_signing_key_file_error",
+			"Files in the trusted key directories that could not be read or parsed, such as keys of an OpenPGP version that is not supported",
+			[]string{"manager", "file"}, nil,
+		),
+		paths: paths,
+	}
+}
+
+func (c *repositoriesCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.repository
+	ch <- c.unsigned
+	ch <- c.key
+	ch <- c.keyExpiry
+	ch <- c.keyError
+}
+
+func (c *repositoriesCollector) Update(ctx context.Context, ch chan<- prometheus.Metric) error {
+	if runtime.GOOS != "linux" {
+		return fmt.Errorf("repository inventory is not supported on %s", runtime.GOOS)
+	}
+
+	seen := labelSet{}
+	sources, err := loadAptSources(c.paths)
+	if err != nil {
+		return fmt.Errorf("reading apt sources: %w", err)
+	}
+	unsigned := 0
+	for _, source := range sources {
+		repository := source.kind + " " + source.uri + " " + source.suite
+		checked := !source.trusted && !source.allowInsecure
+		if source.enabled && !checked {
+			unsigned++
+		}
+		labels := []string{"apt", repository, source.uri, source.file, boolLabel(source.enabled), boolLabel(checked), boolLabel(source.trusted)}
+		if seen.add(labels...) {
+			ch <- prometheus.MustNewConstMetric(c.repository, prometheus.GaugeValue, 1, labels...)
+		}
+	}
+	if len(sources) > 0 {
+		ch <- prometheus.MustNewConstMetric(c.unsigned, prometheus.GaugeValue, float64(unsigned), "apt")
+	}
+
+	configs, err := loadRPMRepoConfigs(c.paths)
+	if err != nil {
+		return fmt.Errorf("reading repository configuration: %w", err)
+	}
+	rpmManager := rpmRepoManager(c.paths)
+	unsigned = 0
+	for id, config := range configs {
+		if config.enabled && !config.gpgcheck {
+			unsigned++
+		}
+		ch <- prometheus.MustNewConstMetric(c.repository, prometheus.GaugeValue, 1,
+			rpmManager, id, config.url, c.paths.hostPath(config.file), boolLabel(config.enabled), boolLabel(config.gpgcheck), "0")
+	}
+	if configs != nil {
+		ch <- prometheus.MustNewConstMetric(c.unsigned, prometheus.GaugeValue, float64(unsigned), rpmManager)
+	}
+
+	seenKeys := labelSet{}
+	for _, keyDir := range signingKeyDirs {
+		manager := keyDir.manager
+		if manager == "rpm" {
+			manager = rpmManager
+		}
+		files, err := listSigningKeyFiles(c.paths, keyDir.dir)
+		if err != nil {
+			return err
+		}
+		if keyDir.dir == "/etc/apt/trusted.gpg.d" {
+			// The legacy keyring apt-key adds to
+			files = append([]string{"/etc/apt/trusted.gpg"}, files...)
+		}
+		for _, file := range files {
+			data, err := os.ReadFile(c.paths.rootfs(file))
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			var keys []pgpKey
+			if err == nil {
+				if !isPGPData(data) {
+					continue
+				}
+				keys, err = parsePGPKeys(data)
+			}
+			if err != nil {
+				// One bad file must not hide the rest of the inventory
+				log.Printf("Skipping signing key file %s: %v", file, err)
+				ch <- prometheus.MustNewConstMetric(c.keyError, prometheus.GaugeValue, 1, manager, file)
+				continue
+			}
+			for _, key := range keys {
+				labels := []string{manager, file, key.fingerprint, key.uid, boolLabel(key.subkey)}
+				if !seenKeys.add(labels...) {
+					continue
+				}
+				ch <- prometheus.MustNewConstMetric(c.key, prometheus.GaugeValue, 1, labels...)
+				if !key.expires.IsZero() {
+					ch <- prometheus.MustNewConstMetric(c.keyExpiry, prometheus.GaugeValue, float64(key.expires.Unix()), labels...)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// boolLabel formats a flag as a "1" or "0" label value.
+func boolLabel(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+// rpmRepoManager names the manager of the .repo files: dnf where it is
+// installed and yum otherwise.
+func rpmRepoManager(paths Paths) string {
+	if _, err := os.Stat(paths.rootfs("/etc/dnf")); err == nil {
+		return "dnf"
+	}
+	return "yum"
+}
+
+// listSigningKeyFiles returns the files in dir, as paths on the host, sorted
+// by name.
+func listSigningKeyFiles(paths Paths, dir string) ([]string, error) {
+	entries, err := os.ReadDir(paths.rootfs(dir))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && !strings.HasPrefix(entry.Name(), ".") {
+			files = append(files, filepath.Join(dir, entry.Name()))
+		}
+	}
+	return files, nil
+}
+
+// aptSource is one suite of an apt source entry: deb822 stanzas and
+// one-line entries can list several.
+type aptSource struct {
+	file          string
+	kind          string
+	uri           string
+	suite         string
+	enabled       bool
+	trusted       bool
+	allowInsecure bool
+}
+
+// loadAptSources reads /etc/apt/sources.list and the .list and .sources
+// files in sources.list.d, in the order apt does. Commented out entries
+// are skipped, while deb822 stanzas with "Enabled: no" are kept.
+func loadAptSources(paths Paths) ([]aptSource, error) {
+	files := []string{"/etc/apt/sources.list"}
+	entries, err := os.ReadDir(paths.rootfs("/etc/apt/sources.list.d"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if ext := filepath.Ext(entry.Name()); !entry.IsDir() && (ext == ".list" || ext == ".sources") {
+			files = append(files, filepath.Join("/etc/apt/sources.list.d", entry.Name()))
+		}
+	}
+	sort.Strings(files[1:])
+
+	var sources []aptSource
+	for _, name := range files {
+		data, err := os.ReadFile(paths.rootfs(name))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if filepath.Ext(name) == ".sources" {
+			err = readControlFile(strings.NewReader(string(data)),
+				[]string{"Types", "URIs", "Suites", "Enabled", "Trusted", "Allow-Insecure"},
+				func(p controlParagraph) {
+					for _, kind := range strings.Fields(p["Types"]) {
+						for _, uri := range strings.Fields(p["URIs"]) {
+							for _, suite := range strings.Fields(p["Suites"]) {
+								sources = append(sources, aptSource{
+									file:          name,
+									kind:          kind,
+									uri:           uri,
+									suite:         suite,
+									enabled:       p["Enabled"] == "" || isTrueRepoValue(p["Enabled"]),
+									trusted:       isTrueRepoValue(p["Trusted"]),
+									allowInsecure: isTrueRepoValue(p["Allow-Insecure"]),
+								})
+							}
+						}
+					}
+				})
+			if err != nil {
+				return nil, fmt.Errorf("reading %s: %w", name, err)
+			}
+			continue
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if source, ok := parseAptSourceLine(line); ok {
+				source.file = name
+				sources = append(sources, source)
+			}
+		}
+	}
+	return sources, nil
+}
+
+// parseAptSourceLine parses a one-line entry such as
+// "deb [arch=amd64 trusted=yes] http://deb.debian.org/debian bookworm main".
+func parseAptSourceLine(line string) (aptSource, bool) {
+	line, _, _ = strings.Cut(line, "#")
+	fields := strings.Fields(line)
+	if len(fields) < 3 || (fields[0] != "deb" && fields[0] != "deb-src") {
+		return aptSource{}, false
+	}
+	source := aptSource{kind: fields[0], enabled: true}
+	fields = fields[1:]
+
+	if strings.HasPrefix(fields[0], "[") {
+		// Options are separated by spaces, and may be padded inside the
+		// brackets: "[ trusted=yes ]"
+		var options []string
+		for len(fields) > 0 {
+			option := fields[0]
+			fields = fields[1:]
+			closed := strings.HasSuffix(option, "]")
+			option = strings.Trim(option, "[]")
+			if option != "" {
+				options = append(options, option)
+			}
+			if closed {
+				break
+			}
+		}
+		for _, option := range options {
+			key, value, _ := strings.Cut(option, "=")
+			switch key {
+			case "trusted":
+				source.trusted = isTrueRepoValue(value)
+			case "allow-insecure":
+				source.allowInsecure = isTrueRepoValue(value)
+			}
+		}
+	}
+	if len(fields) < 2 {
+		return aptSource{}, false
+	}
+	source.uri, source.suite = fields[0], fields[1]
+	return source, true
+}
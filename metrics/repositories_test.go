@@ -0,0 +1,96 @@
+package metrics
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseAptSourceLine(t *testing.T) {
+	tests := []struct {
+		line string
+		want aptSource
+		ok   bool
+	}{
+		{
+			"deb http://deb.debian.org/debian bookworm main contrib",
+			aptSource{kind: "deb", uri: "http://deb.debian.org/debian", suite: "bookworm", enabled: true},
+			true,
+		},
+		{
+			"deb-src [arch=amd64 signed-by=/etc/apt/keyrings/example.asc] https://repo.example.com/apt stable main # comment",
+			aptSource{kind: "deb-src", uri: "https://repo.example.com/apt", suite: "stable", enabled: true},
+			true,
+		},
+		{
+			"deb [ trusted=yes ] http://10.0.0.5/debs ./",
+			aptSource{kind: "deb", uri: "http://10.0.0.5/debs", suite: "./", enabled: true, trusted: true},
+			true,
+		},
+		{
+			"deb [allow-insecure=yes trusted=no] http://example.com/ubuntu jammy main",
+			aptSource{kind: "deb", uri: "http://example.com/ubuntu", suite: "jammy", enabled: true, allowInsecure: true},
+			true,
+		},
+		{"# deb http://deb.debian.org/debian bookworm main", aptSource{}, false},
+		{"deb [trusted=yes] http://10.0.0.5/debs", aptSource{}, false},
+		{"rpm http://example.com/repo stable main", aptSource{}, false},
+		{"", aptSource{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseAptSourceLine(tt.line)
+		if ok != tt.ok || got != tt.want {
+			t.Errorf("parseAptSourceLine(%q) = %+v, %v, want %+v, %v", tt.line, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestParsePGPKeys(t *testing.T) {
+	// An armored certificate with an encryption and a signing subkey, each
+	// expiring before the primary key
+	data, err := os.ReadFile("testdata/rootfs/debian12/etc/apt/keyrings/example.asc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isPGPData(data) {
+		t.Fatal("isPGPData = false for an armored key")
+	}
+	keys, err := parsePGPKeys(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const uid = "Example Repository <repo@example.com>"
+	created := time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+	want := []pgpKey{
+		{fingerprint: "65DA44D6B52A397D8F2A5806BFD924A698532ACD", uid: uid, created: created, expires: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)},
+		{fingerprint: "ECC44F4D36AE76DB38A3EB8D311D25C22E6C9388", uid: uid, subkey: true, created: created, expires: time.Date(2024, 2, 20, 12, 0, 0, 0, time.UTC)},
+		{fingerprint: "9552FE21D0A398D3C4B22420B96D9A2CBAF14303", uid: uid, subkey: true, created: created, expires: time.Date(2024, 2, 20, 12, 0, 0, 0, time.UTC)},
+	}
+	if len(keys) != len(want) {
+		t.Fatalf("got %d keys, want %d", len(keys), len(want))
+	}
+	for i, key := range keys {
+		if key.fingerprint != want[i].fingerprint || key.uid != want[i].uid || key.subkey != want[i].subkey ||
+			!key.created.Equal(want[i].created) || !key.expires.Equal(want[i].expires) {
+			t.Errorf("key %d = %+v, want %+v", i, key, want[i])
+		}
+	}
+
+	// A binary keyring whose key does not expire
+	data, err = os.ReadFile("testdata/rootfs/ubuntu2204/etc/apt/trusted.gpg.d/ubuntu-keyring-2018-archive.gpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err = parsePGPKeys(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].fingerprint != "5B364F984775F44CFE27ECBB9AF37A99B5D368F0" || !keys[0].expires.IsZero() {
+		t.Errorf("got %+v, want one key that does not expire", keys)
+	}
+
+	if isPGPData([]byte("# not a key\n")) {
+		t.Error("isPGPData = true for a text file")
+	}
+}
@@ -0,0 +1,414 @@
+package metrics
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"time"
+)
+
+// installedRPM is a package read from the RPM database.
+type installedRPM struct {
+	rpmPackage
+	installTime time.Time
+	vendor      string
+	// sourceRPM is the file name of the source package, such as
+	// bash-5.1.8-6.el9_1.src.rpm.
+	sourceRPM string
+}
+
+// sourceName returns the name of the source package, the source RPM file
+// name without its version, release and suffix. Packages without a
+// recorded source RPM are their own source.
+func (p installedRPM) sourceName() string {
+	name := strings.TrimSuffix(strings.TrimSuffix(p.sourceRPM, ".src.rpm"), ".nosrc.rpm")
+	for i := 0; i < 2; i++ {
+		cut := strings.LastIndexByte(name, '-')
+		if cut <= 0 {
+			return p.name
+		}
+		name = name[:cut]
+	}
+	return name
+}
+
+// Header tags read from the RPM database, from rpmtag.h.
+const (
+	rpmTagName        = 1000
+	rpmTagVersion     = 1001
+	rpmTagRelease     = 1002
+	rpmTagEpoch       = 1003
+	rpmTagInstallTime = 1008
+	rpmTagVendor      = 1011
+	rpmTagArch        = 1022
+	rpmTagSourceRPM   = 1044
+)
+
+// Header entry types.
+const (
+	rpmTypeInt32       = 4
+	rpmTypeString      = 6
+	rpmTypeI18NString  = 9
+	rpmHeaderEntrySize = 16
+)
+
+// rpmDatabasePaths are the databases rpm may use, newest format first.
+// Fedora 36 and later keep the database in /usr/lib/sysimage/rpm and leave a
+// symlink in /var/lib/rpm.
+var rpmDatabasePaths = []struct {
+	path string
+	read func(path string, fn func([]byte) error) error
+}{
+	{"/usr/lib/sysimage/rpm/rpmdb.sqlite", readRPMDBSQLite},
+	{"/var/lib/rpm/rpmdb.sqlite", readRPMDBSQLite},
+	{"/usr/lib/sysimage/rpm/Packages.db", readRPMDBNDB},
+	{"/var/lib/rpm/Packages.db", readRPMDBNDB},
+	{"/var/lib/rpm/Packages", readRPMDBBerkeley},
+}
+
+// readRPMDatabase reads the installed packages from the RPM database: the
+// SQLite database of RHEL 9 and Fedora 33 and later, the ndb format of SUSE,
+// or the Berkeley DB hash database of older releases. It returns an error
+// wrapping fs.ErrNotExist when the host has no RPM database, and
+// errUnreadableRPMDatabase when it cannot read the one it has.
+func readRPMDatabase(paths Paths) ([]installedRPM, error) {
+	for _, db := range rpmDatabasePaths {
+		path := paths.rootfs(db.path)
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+
+		var packages []installedRPM
+		err := db.read(path, func(blob []byte) error {
+			pkg, err := parseRPMHeader(blob)
+			if err != nil {
+				return err
+			}
+			// Imported signing keys are stored as gpg-pubkey packages
+			// without an architecture
+			if pkg.arch != "" {
+				packages = append(packages, pkg)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("reading RPM database %s: %w: %w", db.path, errUnreadableRPMDatabase, err)
+		}
+		return packages, nil
+	}
+	return nil, fmt.Errorf("no RPM database found: %w", fs.ErrNotExist)
+}
+
+// errUnreadableRPMDatabase is wrapped by the errors of readRPMDatabase for
+// databases it found but could not read, being in a format it does not know
+// or corrupt, so that callers can ask rpm or yum instead.
+var errUnreadableRPMDatabase = errors.New("unsupported or corrupt database")
+
+// parseRPMHeader reads the fields of an installed package from a header
+// blob: the entry count and data size, the index entries, then the data
+// they point into. All integers are big-endian.
+func parseRPMHeader(blob []byte) (installedRPM, error) {
+	var pkg installedRPM
+	if len(blob) < 8 {
+		return pkg, errors.New("truncated package header")
+	}
+	count := int(binary.BigEndian.Uint32(blob))
+	size := int(binary.BigEndian.Uint32(blob[4:]))
+	dataStart := 8 + count*rpmHeaderEntrySize
+	if count > 0xffff || size > 256<<20 || dataStart+size > len(blob) {
+		return pkg, errors.New("invalid package header")
+	}
+	data := blob[dataStart : dataStart+size]
+
+	for i := 0; i < count; i++ {
+		entry := blob[8+i*rpmHeaderEntrySize:]
+		tag := binary.BigEndian.Uint32(entry)
+		typ := binary.BigEndian.Uint32(entry[4:])
+		offset := int(int32(binary.BigEndian.Uint32(entry[8:])))
+		if offset < 0 || offset >= len(data) {
+			continue
+		}
+
+		switch typ {
+		case rpmTypeString, rpmTypeI18NString:
+			value := headerString(data[offset:])
+			switch tag {
+			case rpmTagName:
+				pkg.name = value
+			case rpmTagVersion:
+				pkg.evr.version = value
+			case rpmTagRelease:
+				pkg.evr.release = value
+			case rpmTagVendor:
+				pkg.vendor = value
+			case rpmTagSourceRPM:
+				pkg.sourceRPM = value
+			case rpmTagArch:
+				pkg.arch = value
+			}
+		case rpmTypeInt32:
+			if offset+4 > len(data) {
+				continue
+			}
+			value := int32(binary.BigEndian.Uint32(data[offset:]))
+			switch tag {
+			case rpmTagEpoch:
+				pkg.evr.epoch = int(value)
+			case rpmTagInstallTime:
+				pkg.installTime = time.Unix(int64(uint32(value)), 0).UTC()
+			}
+		}
+	}
+
+	if pkg.name == "" || pkg.evr.version == "" {
+		return pkg, errors.New("package header without name or version")
+	}
+	return pkg, nil
+}
+
+// headerString returns the NUL-terminated string at the start of data. For
+// I18N strings this is the untranslated value.
+func headerString(data []byte) string {
+	for i, c := range data {
+		if c == 0 {
+			return string(data[:i])
+		}
+	}
+	return string(data)
+}
+
+// readRPMDBSQLite calls fn with every header in an rpmdb.sqlite database.
+// rpm writes it in WAL mode, so it is first opened read-only to see
+// committed transactions, and as immutable when that fails because the
+// shared-memory file cannot be created on a read-only root filesystem.
+func readRPMDBSQLite(path string, fn func([]byte) error) error {
+	err := querySQLiteBlobs("file:"+path+"?mode=ro", fn)
+	if err != nil {
+		err = querySQLiteBlobs("file:"+path+"?mode=ro&immutable=1", fn)
+	}
+	return err
+}
+
+func querySQLiteBlobs(dsn string, fn func([]byte) error) error {
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT blob FROM Packages")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	// Read everything before calling fn, so a failed first attempt does
+	// not report packages twice
+	var blobs [][]byte
+	for rows.Next() {
+		var blob []byte
+		if err := rows.Scan(&blob); err != nil {
+			return err
+		}
+		blobs = append(blobs, blob)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, blob := range blobs {
+		if err := fn(blob); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Layout of the ndb Packages.db format, from rpm's lib/backend/ndb/rpmpkg.c.
+// A 32-byte header is followed by slot pages of 16-byte slots, each locating
+// a package's blob in 16-byte blocks. The header occupies the first two
+// slots of the first page.
+const (
+	ndbHeaderMagic   = 'R' | 'p'<<8 | 'm'<<16 | 'P'<<24
+	ndbSlotMagic     = 'S' | 'l'<<8 | 'o'<<16 | 't'<<24
+	ndbBlobMagic     = 'B' | 'l'<<8 | 'b'<<16 | 'S'<<24
+	ndbPageSize      = 4096
+	ndbSlotSize      = 16
+	ndbBlockSize     = 16
+	ndbBlobHeadSize  = 16
+	ndbMaxSlotPages  = 2048
+	ndbHeaderVersion = 0
+)
+
+// readRPMDBNDB calls fn with every header in an ndb Packages.db database.
+func readRPMDBNDB(path string, fn func([]byte) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	// Lengths read from the file are checked against its size before
+	// anything is allocated for them, so a corrupt database cannot make the
+	// exporter run out of memory
+	size := info.Size()
+
+	header := make([]byte, 32)
+	if _, err := io.ReadFull(file, header); err != nil {
+		return fmt.Errorf("reading header: %w", err)
+	}
+	le := binary.LittleEndian
+	slotPages := le.Uint32(header[12:])
+	if le.Uint32(header) != ndbHeaderMagic || le.Uint32(header[4:]) != ndbHeaderVersion ||
+		slotPages == 0 || slotPages > ndbMaxSlotPages || int64(slotPages)*ndbPageSize > size {
+		return errors.New("not an ndb package database")
+	}
+
+	slots := make([]byte, int(slotPages)*ndbPageSize-len(header))
+	if _, err := io.ReadFull(file, slots); err != nil {
+		return fmt.Errorf("reading slots: %w", err)
+	}
+	for i := 0; i+ndbSlotSize <= len(slots); i += ndbSlotSize {
+		slot := slots[i:]
+		if le.Uint32(slot) != ndbSlotMagic {
+			return fmt.Errorf("bad slot %d", i/ndbSlotSize)
+		}
+		pkgIndex, blockOffset := le.Uint32(slot[4:]), le.Uint32(slot[8:])
+		if pkgIndex == 0 {
+			continue // free slot
+		}
+
+		head := make([]byte, ndbBlobHeadSize)
+		if _, err := file.ReadAt(head, int64(blockOffset)*ndbBlockSize); err != nil {
+			return fmt.Errorf("reading package %d: %w", pkgIndex, err)
+		}
+		if le.Uint32(head) != ndbBlobMagic || le.Uint32(head[4:]) != pkgIndex {
+			return fmt.Errorf("bad blob for package %d", pkgIndex)
+		}
+		start, length := int64(blockOffset)*ndbBlockSize+ndbBlobHeadSize, int64(le.Uint32(head[12:]))
+		if start+length > size {
+			return fmt.Errorf("package %d runs past the end of the database", pkgIndex)
+		}
+		blob := make([]byte, length)
+		if _, err := file.ReadAt(blob, start); err != nil {
+			return fmt.Errorf("reading package %d: %w", pkgIndex, err)
+		}
+		if err := fn(blob); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Layout of the Berkeley DB hash database used by rpm before 4.16. Every
+// page starts with a 26-byte header. Hash pages hold an array of offsets to
+// key/value items; headers are too large to be stored inline, so values are
+// references to chains of overflow pages.
+const (
+	bdbHashMagic        = 0x061561
+	bdbPageHeaderSize   = 26
+	bdbPageHash         = 13
+	bdbPageHashUnsorted = 2 // written by Berkeley DB before 4.6
+	bdbPageOverflow     = 7
+	bdbItemOffPage      = 3
+)
+
+// readRPMDBBerkeley calls fn with every header in a Berkeley DB Packages
+// database. The database is in the byte order of the host that wrote it,
+// which the magic number reveals.
+func readRPMDBBerkeley(path string, fn func([]byte) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	meta := make([]byte, 512)
+	if _, err := io.ReadFull(file, meta); err != nil {
+		return fmt.Errorf("reading metadata: %w", err)
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if order.Uint32(meta[12:]) != bdbHashMagic {
+		order = binary.BigEndian
+		if order.Uint32(meta[12:]) != bdbHashMagic {
+			return errors.New("not a Berkeley DB hash database")
+		}
+	}
+	if meta[24] != 0 {
+		return errors.New("encrypted Berkeley DB databases are not supported")
+	}
+	pageSize := order.Uint32(meta[20:])
+	if pageSize < 512 || pageSize > 64<<10 || pageSize&(pageSize-1) != 0 {
+		return fmt.Errorf("invalid page size %d", pageSize)
+	}
+	lastPage := order.Uint32(meta[32:])
+
+	page := make([]byte, pageSize)
+	readPage := func(buf []byte, n uint32) error {
+		_, err := file.ReadAt(buf, int64(n)*int64(pageSize))
+		return err
+	}
+
+	overflow := make([]byte, pageSize)
+	for n := uint32(1); n <= lastPage; n++ {
+		if err := readPage(page, n); err != nil {
+			return fmt.Errorf("reading page %d: %w", n, err)
+		}
+		if page[25] != bdbPageHash && page[25] != bdbPageHashUnsorted {
+			continue
+		}
+
+		// Items alternate between keys and values
+		entries := int(order.Uint16(page[20:]))
+		for i := 1; i < entries; i += 2 {
+			at := bdbPageHeaderSize + 2*i
+			if at+2 > len(page) {
+				break
+			}
+			offset := int(order.Uint16(page[at:]))
+			if offset+12 > len(page) || page[offset] != bdbItemOffPage {
+				// Small values such as rpm's instance counter are inline
+				continue
+			}
+
+			next := order.Uint32(page[offset+4:])
+			length := order.Uint32(page[offset+8:])
+			if int64(length) > info.Size() {
+				return fmt.Errorf("item %d of page %d is longer than the database", i, n)
+			}
+			blob := make([]byte, 0, length)
+			for next != 0 && uint32(len(blob)) < length {
+				if err := readPage(overflow, next); err != nil {
+					return fmt.Errorf("reading overflow page %d: %w", next, err)
+				}
+				if overflow[25] != bdbPageOverflow {
+					return fmt.Errorf("page %d is not an overflow page", next)
+				}
+				// The free-area offset holds the number of bytes used
+				used := int(order.Uint16(overflow[22:]))
+				if used == 0 || bdbPageHeaderSize+used > len(overflow) {
+					return fmt.Errorf("invalid overflow page %d", next)
+				}
+				blob = append(blob, overflow[bdbPageHeaderSize:bdbPageHeaderSize+used]...)
+				next = order.Uint32(overflow[16:])
+			}
+			if err := fn(blob); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package metrics
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReadRPMDatabase(t *testing.T) {
+	const vendor = "Rocky Enterprise Software Foundation"
+	want := []installedRPM{
+		{rpmPackage{"bash", "x86_64", rpmEVR{0, "5.1.8", "6.el9_1"}}, time.Unix(1700000100, 0).UTC(), vendor, "bash-5.1.8-6.el9_1.src.rpm"},
+		{rpmPackage{"openssl", "x86_64", rpmEVR{1, "3.0.7", "24.el9"}}, time.Unix(1700000200, 0).UTC(), vendor, "openssl-3.0.7-24.el9.src.rpm"},
+		{rpmPackage{"tzdata", "noarch", rpmEVR{0, "2023c", "1.el9"}}, time.Unix(1700000300, 0).UTC(), vendor, ""},
+	}
+
+	// The openssl header spans several Berkeley DB overflow pages
+	for _, format := range []string{"sqlite", "ndb", "bdb", "bdb-big-endian"} {
+		t.Run(format, func(t *testing.T) {
+			got, err := readRPMDatabase(Paths{RootFS: filepath.Join("testdata", "rpmdb", format)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %+v, want %+v", got, want)
+			}
+		})
+	}
+
+	t.Run("missing", func(t *testing.T) {
+		if _, err := readRPMDatabase(Paths{RootFS: t.TempDir()}); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("got %v, want fs.ErrNotExist", err)
+		}
+	})
+}
+
+func TestReadRPMDatabaseRejectsCorruptLengths(t *testing.T) {
+	data, err := os.ReadFile("testdata/rpmdb/ndb/var/lib/rpm/Packages.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Make the blob of the first package claim 4GB
+	var blob int
+	for i := 32; i+16 <= len(data); i += 16 {
+		if binary.LittleEndian.Uint32(data[i+4:]) != 0 {
+			blob = int(binary.LittleEndian.Uint32(data[i+8:])) * ndbBlockSize
+			break
+		}
+	}
+	binary.LittleEndian.PutUint32(data[blob+12:], 0xffffffff)
+
+	root := t.TempDir()
+	path := filepath.Join(root, "var", "lib", "rpm", "Packages.db")
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = readRPMDatabase(Paths{RootFS: root})
+	if !errors.Is(err, errUnreadableRPMDatabase) {
+		t.Errorf("got %v, want errUnreadableRPMDatabase", err)
+	}
+}
+
+func TestParseRPMHeaderRejectsTruncatedHeaders(t *testing.T) {
+	for _, blob := range [][]byte{
+		nil,
+		{0, 0, 0, 1},
+		{0, 0, 0, 2, 0, 0, 0, 0}, // two entries without an index
+	} {
+		if _, err := parseRPMHeader(blob); err == nil {
+			t.Errorf("parseRPMHeader(%v) succeeded", blob)
+		}
+	}
+}
+
+func TestInstalledRPMSourceName(t *testing.T) {
+	for _, tt := range []struct {
+		pkg  installedRPM
+		want string
+	}{
+		{installedRPM{rpmPackage: rpmPackage{name: "kernel-core"}, sourceRPM: "kernel-5.14.0-362.13.1.el9_3.src.rpm"}, "kernel"},
+		{installedRPM{rpmPackage: rpmPackage{name: "python3-libs"}, sourceRPM: "python3.11-3.11.5-1.el9_3.nosrc.rpm"}, "python3.11"},
+		{installedRPM{rpmPackage: rpmPackage{name: "gpg-pubkey"}}, "gpg-pubkey"},
+		{installedRPM{rpmPackage: rpmPackage{name: "broken"}, sourceRPM: "broken.src.rpm"}, "broken"},
+	} {
+		if got := tt.pkg.sourceName(); got != tt.want {
+			t.Errorf("sourceName() of %q = %q, want %q", tt.pkg.sourceRPM, got, tt.want)
+		}
+	}
+}
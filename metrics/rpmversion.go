@@ -0,0 +1,176 @@
+package metrics
+
+import (
+	"strconv"
+	"strings"
+)
+
+// rpmEVR is an RPM package version split into epoch, version and release.
+type rpmEVR struct {
+	epoch   int
+	version string
+	release string
+}
+
+// parseRPMVersion splits [epoch:]version[-release]. The release starts after
+// the last hyphen, since versions may not contain one. A missing or
+// malformed epoch is 0.
+func parseRPMVersion(evr string) rpmEVR {
+	var v rpmEVR
+	evr = strings.TrimSpace(evr)
+	if i := strings.IndexByte(evr, ':'); i >= 0 {
+		v.epoch, _ = strconv.Atoi(evr[:i])
+		evr = evr[i+1:]
+	}
+	if i := strings.LastIndexByte(evr, '-'); i >= 0 {
+		v.version, v.release = evr[:i], evr[i+1:]
+	} else {
+		v.version = evr
+	}
+	return v
+}
+
+// String formats the version as [epoch:]version-release, leaving out a
+// zero epoch like rpm -q does.
+func (v rpmEVR) String() string {
+	s := v.version
+	if v.release != "" {
+		s += "-" + v.release
+	}
+	if v.epoch != 0 {
+		s = strconv.Itoa(v.epoch) + ":" + s
+	}
+	return s
+}
+
+// CompareRPMVersions compares two package versions of the form
+// [epoch:]version-release the way rpm and dnf order them. It returns a
+// negative number when a is older than b, zero when they are equal and a
+// positive number when a is newer.
+func CompareRPMVersions(a, b string) int {
+	return compareRPMEVR(parseRPMVersion(a), parseRPMVersion(b))
+}
+
+func compareRPMEVR(a, b rpmEVR) int {
+	if a.epoch != b.epoch {
+		if a.epoch < b.epoch {
+			return -1
+		}
+		return 1
+	}
+	if c := rpmvercmp(a.version, b.version); c != 0 {
+		return c
+	}
+	return rpmvercmp(a.release, b.release)
+}
+
+// rpmvercmp is rpm's segment comparison. Versions are split into runs of
+// digits and runs of letters; everything else only separates them. Numeric
+// runs compare as numbers and are newer than alphabetic ones. A tilde sorts
+// before anything, even the end of the string, and a caret sorts after the
+// end of the string but before anything else, so 1.0~rc1 < 1.0 < 1.0^git1 <
+// 1.0.1.
+func rpmvercmp(a, b string) int {
+	if a == b {
+		return 0
+	}
+
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		for i < len(a) && !isAlnum(a[i]) && a[i] != '~' && a[i] != '^' {
+			i++
+		}
+		for j < len(b) && !isAlnum(b[j]) && b[j] != '~' && b[j] != '^' {
+			j++
+		}
+
+		ca, cb := byteAt(a, i), byteAt(b, j)
+		if ca == '~' || cb == '~' {
+			if ca != '~' {
+				return 1
+			}
+			if cb != '~' {
+				return -1
+			}
+			i++
+			j++
+			continue
+		}
+		if ca == '^' || cb == '^' {
+			switch {
+			case i == len(a):
+				return -1
+			case j == len(b):
+				return 1
+			case ca != '^':
+				return 1
+			case cb != '^':
+				return -1
+			}
+			i++
+			j++
+			continue
+		}
+		if i == len(a) || j == len(b) {
+			break
+		}
+
+		isNum := isDigit(a[i])
+		segment := isAlpha
+		if isNum {
+			segment = isDigit
+		}
+		endA, endB := i, j
+		for endA < len(a) && segment(a[endA]) {
+			endA++
+		}
+		for endB < len(b) && segment(b[endB]) {
+			endB++
+		}
+		if endB == j {
+			// The segments are of different types; numbers are newer
+			if isNum {
+				return 1
+			}
+			return -1
+		}
+
+		segA, segB := a[i:endA], b[j:endB]
+		if isNum {
+			segA, segB = strings.TrimLeft(segA, "0"), strings.TrimLeft(segB, "0")
+			if len(segA) != len(segB) {
+				if len(segA) > len(segB) {
+					return 1
+				}
+				return -1
+			}
+		}
+		if c := strings.Compare(segA, segB); c != 0 {
+			return c
+		}
+		i, j = endA, endB
+	}
+
+	switch {
+	case i >= len(a) && j >= len(b):
+		return 0
+	case i >= len(a):
+		return -1
+	}
+	return 1
+}
+
+func byteAt(s string, i int) byte {
+	if i < len(s) {
+		return s[i]
+	}
+	return 0
+}
+
+func isAlpha(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isAlnum(c byte) bool {
+	return isAlpha(c) || isDigit(c)
+}
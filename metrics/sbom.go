@@ -0,0 +1,487 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sbomToolName identifies the exporter as the creator of the documents.
+const sbomToolName = "system_os_info"
+
+// newUUID returns a random UUID identifying a generated document. Tests
+// replace it for stable output.
+var newUUID = func() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// hostInventory is what a software bill of materials describes: the
+// operating system and the packages installed on it.
+type hostInventory struct {
+	hostname string
+	// release holds the fields of /etc/os-release.
+	release  map[string]string
+	kernel   string
+	packages []installedPackage
+	created  time.Time
+}
+
+// readHostInventory lists the installed packages the same way the packages
+// collector does.
+func readHostInventory(ctx context.Context, paths Paths) (hostInventory, error) {
+	if runtime.GOOS != "linux" {
+		return hostInventory{}, fmt.Errorf("SBOM export is not supported on %s", runtime.GOOS)
+	}
+
+	inv := hostInventory{hostname: readHostname(paths), created: timeNow().UTC()}
+	var err error
+	if inv.release, err = readOSRelease(paths); err != nil {
+		return inv, err
+	}
+	if inv.kernel, err = runningKernelVersion(ctx, paths); err != nil {
+		return inv, fmt.Errorf("fetching kernel version: %w", err)
+	}
+	packages, err := collectLinuxPackageVersions(ctx, false, paths)
+	if err != nil {
+		return inv, err
+	}
+
+	seen := labelSet{}
+	for _, pkg := range packages {
+		if seen.add(pkg.name, pkg.version, pkg.architecture) {
+			inv.packages = append(inv.packages, pkg)
+		}
+	}
+	sort.Slice(inv.packages, func(i, j int) bool {
+		a, b := inv.packages[i], inv.packages[j]
+		if a.name != b.name {
+			return a.name < b.name
+		}
+		if a.version != b.version {
+			return a.version < b.version
+		}
+		return a.architecture < b.architecture
+	})
+	return inv, nil
+}
+
+// readHostname returns the host's name from /etc/hostname, which unlike
+// os.Hostname is not the container's when the exporter runs in one.
+func readHostname(paths Paths) string {
+	if data, err := os.ReadFile(paths.rootfs("/etc/hostname")); err == nil {
+		if name := strings.TrimSpace(string(data)); name != "" {
+			return name
+		}
+	}
+	name, _ := os.Hostname()
+	return name
+}
+
+// osVersion returns the VERSION_ID of the distribution, or BUILD_ID for
+// rolling releases.
+func (inv hostInventory) osVersion() string {
+	if version := inv.release["VERSION_ID"]; version != "" {
+		return version
+	}
+	return inv.release["BUILD_ID"]
+}
+
+// purl returns the package URL of pkg, such as
+// pkg:deb/debian/curl@7.88.1-10%2Bdeb12u5?arch=amd64&distro=debian-12, or ""
+// for package managers without a purl type. The namespace is the
+// distribution ID and, as for rpm purls, an epoch is a qualifier.
+func (inv hostInventory) purl(pkg installedPackage) string {
+	if pkg.purlType == "" {
+		return ""
+	}
+
+	version := pkg.version
+	qualifiers := map[string]string{"arch": pkg.architecture}
+	if pkg.purlType == "rpm" {
+		if epoch, rest, ok := strings.Cut(version, ":"); ok {
+			qualifiers["epoch"] = epoch
+			version = rest
+		}
+	}
+	if id, versionID := inv.release["ID"], inv.release["VERSION_ID"]; id != "" && versionID != "" {
+		qualifiers["distro"] = id + "-" + versionID
+	}
+	if pkg.source != "" && pkg.source != pkg.name {
+		qualifiers["upstream"] = pkg.source
+	}
+
+	var b strings.Builder
+	b.WriteString("pkg:" + pkg.purlType + "/")
+	if namespace := strings.ToLower(inv.release["ID"]); namespace != "" {
+		b.WriteString(purlEscape(namespace) + "/")
+	}
+	b.WriteString(purlEscape(pkg.name) + "@" + purlEscape(version))
+
+	keys := make([]string, 0, len(qualifiers))
+	for key, value := range qualifiers {
+		if value != "" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for i, key := range keys {
+		if i == 0 {
+			b.WriteByte('?')
+		} else {
+			b.WriteByte('&')
+		}
+		b.WriteString(key + "=" + purlEscape(qualifiers[key]))
+	}
+	return b.String()
+}
+
+// purlEscape percent-encodes everything but unreserved characters, as
+// scanners such as syft do, so that versions like 1:9.2p1-2+deb12u2 match
+// the purls in vulnerability databases.
+func purlEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if isAlnum(c) || c == '-' || c == '.' || c == '_' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// CycloneDX 1.5 JSON document, with the fields the exporter fills in.
+type (
+	cdxBOM struct {
+		BOMFormat    string         `json:"bomFormat"`
+		SpecVersion  string         `json:"specVersion"`
+		SerialNumber string         `json:"serialNumber"`
+		Version      int            `json:"version"`
+		Metadata     cdxMetadata    `json:"metadata"`
+		Components   []cdxComponent `json:"components"`
+	}
+	cdxMetadata struct {
+		Timestamp string        `json:"timestamp"`
+		Tools     cdxTools      `json:"tools"`
+		Component *cdxComponent `json:"component"`
+	}
+	cdxTools struct {
+		Components []cdxComponent `json:"components"`
+	}
+	cdxComponent struct {
+		Type        string        `json:"type"`
+		BOMRef      string        `json:"bom-ref,omitempty"`
+		Supplier    *cdxSupplier  `json:"supplier,omitempty"`
+		Name        string        `json:"name"`
+		Version     string        `json:"version,omitempty"`
+		Description string        `json:"description,omitempty"`
+		PURL        string        `json:"purl,omitempty"`
+		Properties  []cdxProperty `json:"properties,omitempty"`
+	}
+	cdxSupplier struct {
+		Name string `json:"name"`
+	}
+	cdxProperty struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}
+)
+
+// writeCycloneDX writes inv as a CycloneDX document. The operating system
+// is the component the document describes and the packages are its
+// components. Fields CycloneDX has no place for are properties named
+// system_os_info:<field>.
+func writeCycloneDX(w io.Writer, inv hostInventory) error {
+	bom := cdxBOM{
+		BOMFormat:    "CycloneDX",
+		SpecVersion:  "1.5",
+		SerialNumber: "urn:uuid:" + newUUID(),
+		Version:      1,
+		Metadata: cdxMetadata{
+			Timestamp: inv.created.Format(time.RFC3339),
+			Tools: cdxTools{Components: []cdxComponent{
+				{Type: "application", Name: sbomToolName},
+			}},
+			Component: &cdxComponent{
+				Type:        "operating-system",
+				BOMRef:      "os",
+				Name:        inv.release["ID"],
+				Version:     inv.osVersion(),
+				Description: inv.release["PRETTY_NAME"],
+				Properties: []cdxProperty{
+					{Name: sbomToolName + ":hostname", Value: inv.hostname},
+					{Name: sbomToolName + ":kernel_version", Value: inv.kernel},
+				},
+			},
+		},
+		Components: []cdxComponent{},
+	}
+
+	for i, pkg := range inv.packages {
+		component := cdxComponent{
+			Type:    "library",
+			BOMRef:  inv.purl(pkg),
+			Name:    pkg.name,
+			Version: pkg.version,
+			PURL:    inv.purl(pkg),
+		}
+		if component.BOMRef == "" {
+			component.BOMRef = fmt.Sprintf("package-%d", i+1)
+		}
+		if pkg.vendor != "" {
+			component.Supplier = &cdxSupplier{Name: pkg.vendor}
+		}
+		if pkg.architecture != "" {
+			component.Properties = append(component.Properties, cdxProperty{Name: sbomToolName + ":architecture", Value: pkg.architecture})
+		}
+		if pkg.source != "" {
+			component.Properties = append(component.Properties, cdxProperty{Name: sbomToolName + ":source_package", Value: pkg.source})
+		}
+		if !pkg.installTime.IsZero() {
+			component.Properties = append(component.Properties, cdxProperty{Name: sbomToolName + ":install_time", Value: pkg.installTime.UTC().Format(time.RFC3339)})
+		}
+		bom.Components = append(bom.Components, component)
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.SetEscapeHTML(false)
+	return encoder.Encode(bom)
+}
+
+// SPDX 2.3 JSON document, with the fields the exporter fills in.
+type (
+	spdxDocument struct {
+		SPDXVersion       string             `json:"spdxVersion"`
+		DataLicense       string             `json:"dataLicense"`
+		SPDXID            string             `json:"SPDXID"`
+		Name              string             `json:"name"`
+		DocumentNamespace string             `json:"documentNamespace"`
+		CreationInfo      spdxCreationInfo   `json:"creationInfo"`
+		Packages          []spdxPackage      `json:"packages"`
+		Relationships     []spdxRelationship `json:"relationships"`
+	}
+	spdxCreationInfo struct {
+		Created  string   `json:"created"`
+		Creators []string `json:"creators"`
+	}
+	spdxPackage struct {
+		Name                  string            `json:"name"`
+		SPDXID                string            `json:"SPDXID"`
+		VersionInfo           string            `json:"versionInfo,omitempty"`
+		Supplier              string            `json:"supplier,omitempty"`
+		DownloadLocation      string            `json:"downloadLocation"`
+		FilesAnalyzed         bool              `json:"filesAnalyzed"`
+		SourceInfo            string            `json:"sourceInfo,omitempty"`
+		Description           string            `json:"description,omitempty"`
+		PrimaryPackagePurpose string            `json:"primaryPackagePurpose,omitempty"`
+		ExternalRefs          []spdxExternalRef `json:"externalRefs,omitempty"`
+		Annotations           []spdxAnnotation  `json:"annotations,omitempty"`
+	}
+	spdxExternalRef struct {
+		ReferenceCategory string `json:"referenceCategory"`
+		ReferenceType     string `json:"referenceType"`
+		ReferenceLocator  string `json:"referenceLocator"`
+	}
+	spdxAnnotation struct {
+		AnnotationDate string `json:"annotationDate"`
+		AnnotationType string `json:"annotationType"`
+		Annotator      string `json:"annotator"`
+		Comment        string `json:"comment"`
+	}
+	spdxRelationship struct {
+		SPDXElementID      string `json:"spdxElementId"`
+		RelationshipType   string `json:"relationshipType"`
+		RelatedSPDXElement string `json:"relatedSpdxElement"`
+	}
+)
+
+// writeSPDX writes inv as an SPDX document that describes the operating
+// system, which contains every package. SPDX has no field for the install
+// time, so it is an annotation of the package.
+func writeSPDX(w io.Writer, inv hostInventory) error {
+	created := inv.created.Format(time.RFC3339)
+	tool := "Tool: " + sbomToolName
+	doc := spdxDocument{
+		SPDXVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              inv.hostname,
+		DocumentNamespace: "https://spdx.org/spdxdocs/" + sbomToolName + "-" + purlEscape(inv.hostname) + "-" + newUUID(),
+		CreationInfo:      spdxCreationInfo{Created: created, Creators: []string{tool}},
+		Packages: []spdxPackage{{
+			Name:                  inv.release["ID"],
+			SPDXID:                "SPDXRef-OperatingSystem",
+			VersionInfo:           inv.osVersion(),
+			DownloadLocation:      "NOASSERTION",
+			Description:           inv.release["PRETTY_NAME"],
+			PrimaryPackagePurpose: "OPERATING-SYSTEM",
+		}},
+		Relationships: []spdxRelationship{
+			{SPDXElementID: "SPDXRef-DOCUMENT", RelationshipType: "DESCRIBES", RelatedSPDXElement: "SPDXRef-OperatingSystem"},
+		},
+	}
+
+	for i, pkg := range inv.packages {
+		id := fmt.Sprintf("SPDXRef-Package-%d", i+1)
+		p := spdxPackage{
+			Name:             pkg.name,
+			SPDXID:           id,
+			VersionInfo:      pkg.version,
+			DownloadLocation: "NOASSERTION",
+		}
+		if pkg.vendor != "" {
+			p.Supplier = "Organization: " + pkg.vendor
+		}
+		if pkg.source != "" && pkg.source != pkg.name {
+			p.SourceInfo = "built from source package " + pkg.source
+		}
+		if purl := inv.purl(pkg); purl != "" {
+			p.ExternalRefs = []spdxExternalRef{{ReferenceCategory: "PACKAGE-MANAGER", ReferenceType: "purl", ReferenceLocator: purl}}
+		}
+		if !pkg.installTime.IsZero() {
+			p.Annotations = []spdxAnnotation{{
+				AnnotationDate: created,
+				AnnotationType: "OTHER",
+				Annotator:      tool,
+				Comment:        "Installed at " + pkg.installTime.UTC().Format(time.RFC3339),
+			}}
+		}
+		doc.Packages = append(doc.Packages, p)
+		doc.Relationships = append(doc.Relationships, spdxRelationship{SPDXElementID: "SPDXRef-OperatingSystem", RelationshipType: "CONTAINS", RelatedSPDXElement: id})
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.SetEscapeHTML(false)
+	return encoder.Encode(doc)
+}
+
+// errInventoryShed is returned when the host inventory is not read because
+// the exporter is short on memory or CPU.
+var errInventoryShed = errors.New("the exporter is short on resources, try again later")
+
+// inventoryCache keeps the host inventory read for the previous SBOM request
+// for the cache TTL of the expensive collectors.
+type inventoryCache struct {
+	mu      sync.Mutex
+	inv     hostInventory
+	expires time.Time
+}
+
+// hostInventory returns the cached host inventory, reading it again once it
+// has expired. Reading it is limited like an expensive collector: it takes a
+// worker, is skipped under memory pressure or once the CPU budget is used
+// up, and gives up at the scrape timeout. Requests arriving meanwhile wait
+// for its result.
+func (s *CollectorSet) hostInventory(ctx context.Context) (hostInventory, error) {
+	s.collectorsMu.RLock()
+	paths, ttl, timeout := s.paths, s.cacheTTL, s.timeout
+	s.collectorsMu.RUnlock()
+
+	c := &s.inventory
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ttl > 0 && time.Now().Before(c.expires) {
+		return c.inv, nil
+	}
+
+	select {
+	case s.workers <- struct{}{}:
+		defer func() { <-s.workers }()
+	case <-ctx.Done():
+		return hostInventory{}, ctx.Err()
+	case <-s.ctx.Done():
+		return hostInventory{}, s.ctx.Err()
+	}
+	if underMemoryPressure() {
+		log.Printf("Skipping SBOM export: memory use is close to the limit")
+		return hostInventory{}, errInventoryShed
+	}
+	start := time.Now()
+	if !s.throttle.allow("sbom", start) {
+		log.Printf("Skipping SBOM export: its previous run used up the CPU budget")
+		return hostInventory{}, errInventoryShed
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	cpuStart := processCPUTime()
+	inv, err := readHostInventory(ctx, paths)
+	s.throttle.charge("sbom", start, processCPUTime()-cpuStart)
+	if err != nil {
+		return hostInventory{}, err
+	}
+	c.inv, c.expires = inv, time.Now().Add(ttl)
+	return inv, nil
+}
+
+// SBOMHandler returns the handler of /api/v1/sbom, which lists the
+// operating system and installed packages of the host as a software bill of
+// materials. The format query parameter selects CycloneDX (the default) or
+// SPDX, both as JSON.
+func (s *CollectorSet) SBOMHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "Only GET requests allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var (
+			contentType string
+			write       func(io.Writer, hostInventory) error
+		)
+		switch format := r.URL.Query().Get("format"); format {
+		case "", "cyclonedx":
+			contentType, write = "application/vnd.cyclonedx+json; version=1.5", writeCycloneDX
+		case "spdx":
+			contentType, write = "application/spdx+json", writeSPDX
+		default:
+			http.Error(w, fmt.Sprintf("unknown format %q, use cyclonedx or spdx", format), http.StatusBadRequest)
+			return
+		}
+
+		inv, err := s.hostInventory(r.Context())
+		if errors.Is(err, errInventoryShed) {
+			w.Header().Set("Retry-After", "60")
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to list installed packages: %s", err), http.StatusInternalServerError)
+			return
+		}
+		// Encoded in full first, so that a failure is not sent after part of
+		// a successful response
+		var buf bytes.Buffer
+		if err := write(&buf, inv); err != nil {
+			http.Error(w, fmt.Sprintf("failed to write SBOM: %s", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Write(buf.Bytes())
+	})
+}
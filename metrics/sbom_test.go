@@ -0,0 +1,134 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestSBOMGolden(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("fixtures describe Linux hosts")
+	}
+
+	fixtures, err := os.ReadDir(filepath.Join("testdata", "rootfs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	formats := []struct {
+		query, golden, contentType string
+	}{
+		{"", "sbom.cdx.json", "application/vnd.cyclonedx+json; version=1.5"},
+		{"?format=spdx", "sbom.spdx.json", "application/spdx+json"},
+	}
+	for _, fixture := range fixtures {
+		if !fixture.IsDir() {
+			continue
+		}
+		for _, format := range formats {
+			t.Run(fixture.Name()+"/"+format.golden, func(t *testing.T) {
+				opts := fixtureOptions(t, fixture.Name())
+				origUUID := newUUID
+				t.Cleanup(func() { newUUID = origUUID })
+				newUUID = func() string { return "00000000-0000-4000-8000-000000000000" }
+
+				rec := httptest.NewRecorder()
+				newTestCollectorSet(t, opts).SBOMHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/sbom"+format.query, nil))
+				if rec.Code != http.StatusOK {
+					t.Fatalf("status %d: %s", rec.Code, rec.Body)
+				}
+				if got := rec.Header().Get("Content-Type"); got != format.contentType {
+					t.Errorf("Content-Type = %q, want %q", got, format.contentType)
+				}
+				compareGolden(t, filepath.Join(fixture.Name(), format.golden), rec.Body.Bytes())
+			})
+		}
+	}
+}
+
+func TestSBOMHandlerRejectsUnknownFormat(t *testing.T) {
+	rec := httptest.NewRecorder()
+	newTestCollectorSet(t, Options{Paths: Paths{}}).SBOMHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/sbom?format=swid", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestSBOMHandlerCachesInventory(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("fixtures describe Linux hosts")
+	}
+	opts := fixtureOptions(t, "debian12")
+	opts.CacheTTL = time.Hour
+	handler := newTestCollectorSet(t, opts).SBOMHandler()
+
+	first := httptest.NewRecorder()
+	handler.ServeHTTP(first, httptest.NewRequest(http.MethodGet, "/api/v1/sbom", nil))
+	if first.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", first.Code, first.Body)
+	}
+	// Served from the cache, without reading the package database again
+	if err := os.Remove(opts.Paths.rootfs("/var/lib/dpkg/status")); err != nil {
+		t.Fatal(err)
+	}
+	second := httptest.NewRecorder()
+	handler.ServeHTTP(second, httptest.NewRequest(http.MethodGet, "/api/v1/sbom", nil))
+	if second.Code != http.StatusOK || !bytes.Contains(second.Body.Bytes(), []byte(`"name": "openssh-server"`)) {
+		t.Errorf("second request not served from the cache: status %d\n%s", second.Code, second.Body)
+	}
+}
+
+// newTestCollectorSet returns a set without collectors, for its handlers.
+func newTestCollectorSet(t *testing.T, opts Options) *CollectorSet {
+	t.Helper()
+	set, err := NewCollectorSet(opts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(set.Stop)
+	return set
+}
+
+func TestPURL(t *testing.T) {
+	debian := hostInventory{release: map[string]string{"ID": "debian", "VERSION_ID": "12"}}
+	rocky := hostInventory{release: map[string]string{"ID": "rocky", "VERSION_ID": "9.3"}}
+	arch := hostInventory{release: map[string]string{"ID": "arch", "BUILD_ID": "rolling"}}
+
+	tests := []struct {
+		inv  hostInventory
+		pkg  installedPackage
+		want string
+	}{
+		{
+			debian,
+			installedPackage{name: "openssh-client", version: "1:9.2p1-2+deb12u2", architecture: "amd64", source: "openssh", purlType: "deb"},
+			"pkg:deb/debian/openssh-client@1%3A9.2p1-2%2Bdeb12u2?arch=amd64&distro=debian-12&upstream=openssh",
+		},
+		{
+			rocky,
+			installedPackage{name: "openssl", version: "1:3.0.7-24.el9", architecture: "x86_64", source: "openssl", purlType: "rpm"},
+			"pkg:rpm/rocky/openssl@3.0.7-24.el9?arch=x86_64&distro=rocky-9.3&epoch=1",
+		},
+		{
+			arch,
+			installedPackage{name: "gcc-libs", version: "13.2.1-5", architecture: "x86_64", source: "gcc", purlType: "alpm"},
+			"pkg:alpm/arch/gcc-libs@13.2.1-5?arch=x86_64&upstream=gcc",
+		},
+		{
+			debian,
+			installedPackage{name: "curl", version: "7.88.1-10+deb12u5"},
+			"",
+		},
+	}
+	for _, tt := range tests {
+		if got := tt.inv.purl(tt.pkg); got != tt.want {
+			t.Errorf("purl(%s %s) = %q, want %q", tt.pkg.name, tt.pkg.version, got, tt.want)
+		}
+	}
+}
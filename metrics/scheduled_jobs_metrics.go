@@ -2,6 +2,9 @@ package metrics
 
 import (
 	"bufio"
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"os"
 	"strings"
@@ -9,26 +12,51 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 )
 
-var (
-	scheduledJobsMetrics = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "system_scheduled_jobs_info",
-			Help: "Information about scheduled jobs",
-		},
-		[]string{"job_name", "schedule", "last_run_status"},
-	)
-)
+type scheduledJobsCollector struct {
+	info      *prometheus.Desc
+	cronFiles []string
+	paths     Paths
+}
+
+func init() {
+	registerCollector("scheduled_jobs", false, func(opts Options) Collector {
+		return newScheduledJobsCollector(opts.Config.ScheduledJobs, opts.Paths)
+	})
+}
+
+// newScheduledJobsCollector returns a collector for the jobs in the
+// configured crontab files.
+func newScheduledJobsCollector(cfg ScheduledJobsConfig, paths Paths) Collector {
+	return &scheduledJobsCollector{
+		info: prometheus.NewDesc(
+			"system_scheduled_jobs_info",
+			"Information about scheduled jobs",
+			[]string{"job_name", "schedule", "last_run_status"}, nil,
+		),
+		cronFiles: cfg.CronFiles,
+		paths:     paths,
+	}
+}
+
+func (c *scheduledJobsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.info
+}
 
-func RegisterScheduledJobsMetrics() {
-	prometheus.MustRegister(scheduledJobsMetrics)
+func (c *scheduledJobsCollector) Update(ctx context.Context, ch chan<- prometheus.Metric) error {
+	var errs []error
+	seen := labelSet{}
+	for _, cronFile := range c.cronFiles {
+		if err := c.collectCronFile(ch, cronFile, seen); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
 }
 
-func CollectScheduledJobsMetrics() {
-	cronFile := "/etc/crontab" // Path to the system crontab file
-	file, err := os.Open(cronFile)
+func (c *scheduledJobsCollector) collectCronFile(ch chan<- prometheus.Metric, cronFile string, seen labelSet) error {
+	file, err := os.Open(c.paths.rootfs(cronFile))
 	if err != nil {
-		log.Printf("Error opening crontab file: %v", err)
-		return
+		return fmt.Errorf("opening crontab file: %w", err)
 	}
 	defer file.Close()
 
@@ -52,10 +80,13 @@ func CollectScheduledJobsMetrics() {
 		lastRunStatus := "unknown" // Placeholder for last run status
 
 		// Add the job details to the Prometheus metric
-		scheduledJobsMetrics.WithLabelValues(jobName, schedule, lastRunStatus).Set(1)
+		if seen.add(jobName, schedule) {
+			ch <- prometheus.MustNewConstMetric(c.info, prometheus.GaugeValue, 1, jobName, schedule, lastRunStatus)
+		}
 	}
 
 	if err := scanner.Err(); err != nil {
-		log.Printf("Error reading crontab file: %v", err)
+		return fmt.Errorf("reading crontab file %s: %w", cronFile, err)
 	}
+	return nil
 }
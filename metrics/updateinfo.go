@@ -0,0 +1,132 @@
+package metrics
+
+import (
+	"encoding/xml"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Update classes, from the most to the least urgent. Updates without an
+// advisory, and all non-security APT updates, are "other".
+const (
+	updateClassSecurity    = "security"
+	updateClassBugfix      = "bugfix"
+	updateClassEnhancement = "enhancement"
+	updateClassOther       = "other"
+)
+
+var updateClassRank = map[string]int{
+	updateClassSecurity:    3,
+	updateClassBugfix:      2,
+	updateClassEnhancement: 1,
+	updateClassOther:       0,
+}
+
+// advisorySeverityRank orders the severities used by Red Hat, Fedora and
+// SUSE advisories.
+var advisorySeverityRank = map[string]int{
+	"critical":  4,
+	"important": 3,
+	"moderate":  2,
+	"low":       1,
+}
+
+// updateClassification says why a pending update was published.
+type updateClassification struct {
+	class string
+	// severity is the highest severity of the security advisories fixed by
+	// the update, "unknown" when they do not say, and "none" for other
+	// classes.
+	severity string
+	// issued is when the oldest security advisory fixed by the update was
+	// published, or zero when unknown.
+	issued time.Time
+}
+
+// unclassifiedUpdate is the classification of an update no advisory
+// mentions.
+var unclassifiedUpdate = updateClassification{class: updateClassOther, severity: "none"}
+
+// merge combines the classifications of the advisories fixed by one update:
+// the most urgent class and severity win and the oldest issue date is kept.
+func (c updateClassification) merge(o updateClassification) updateClassification {
+	if updateClassRank[o.class] > updateClassRank[c.class] {
+		c.class = o.class
+		c.severity, c.issued = o.severity, o.issued
+		return c
+	}
+	if o.class != c.class || o.class != updateClassSecurity {
+		return c
+	}
+	if advisorySeverityRank[o.severity] > advisorySeverityRank[c.severity] {
+		c.severity = o.severity
+	}
+	if !o.issued.IsZero() && (c.issued.IsZero() || o.issued.Before(c.issued)) {
+		c.issued = o.issued
+	}
+	return c
+}
+
+// rpmAdvisory is an <update> element of updateinfo.xml.
+type rpmAdvisory struct {
+	ID       string `xml:"id"`
+	Type     string `xml:"type,attr"`
+	Severity string `xml:"severity"`
+	Issued   struct {
+		Date string `xml:"date,attr"`
+	} `xml:"issued"`
+	Packages []struct {
+		Name    string `xml:"name,attr"`
+		Arch    string `xml:"arch,attr"`
+		Epoch   string `xml:"epoch,attr"`
+		Version string `xml:"version,attr"`
+		Release string `xml:"release,attr"`
+	} `xml:"pkglist>collection>package"`
+}
+
+// classification maps the advisory type to an update class. Fedora's
+// "newpackage" advisories count as enhancements.
+func (a rpmAdvisory) classification() updateClassification {
+	switch strings.ToLower(a.Type) {
+	case updateClassSecurity:
+		severity := strings.ToLower(strings.TrimSpace(a.Severity))
+		if _, ok := advisorySeverityRank[severity]; !ok {
+			severity = "unknown"
+		}
+		return updateClassification{class: updateClassSecurity, severity: severity, issued: parseAdvisoryDate(a.Issued.Date)}
+	case updateClassBugfix:
+		return updateClassification{class: updateClassBugfix, severity: "none"}
+	case updateClassEnhancement, "newpackage":
+		return updateClassification{class: updateClassEnhancement, severity: "none"}
+	}
+	return unclassifiedUpdate
+}
+
+// parseAdvisoryDate parses the issued date of an advisory. Red Hat and
+// Fedora write "2006-01-02 15:04:05" or just the date, SUSE writes a Unix
+// timestamp.
+func parseAdvisoryDate(date string) time.Time {
+	date = strings.TrimSpace(date)
+	for _, layout := range []string{time.DateTime, time.DateOnly} {
+		if t, err := time.Parse(layout, date); err == nil {
+			return t
+		}
+	}
+	if seconds, err := strconv.ParseInt(date, 10, 64); err == nil {
+		return time.Unix(seconds, 0).UTC()
+	}
+	return time.Time{}
+}
+
+// readUpdateInfo calls fn for every advisory in an updateinfo.xml file.
+func readUpdateInfo(path string, fn func(rpmAdvisory)) error {
+	return decodeRepoXML(path, "update", func(decoder *xml.Decoder, start *xml.StartElement) error {
+		var advisory rpmAdvisory
+		if err := decoder.DecodeElement(&advisory, start); err != nil {
+			return err
+		}
+		fn(advisory)
+		return nil
+	})
+}
@@ -0,0 +1,109 @@
+package metrics
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseAdvisoryDate(t *testing.T) {
+	want := time.Date(2024, 1, 15, 8, 30, 0, 0, time.UTC)
+	for _, date := range []string{"2024-01-15 08:30:00", "1705307400", " 2024-01-15 08:30:00 "} {
+		if got := parseAdvisoryDate(date); !got.Equal(want) {
+			t.Errorf("parseAdvisoryDate(%q) = %v, want %v", date, got, want)
+		}
+	}
+	if got := parseAdvisoryDate("2024-01-15"); !got.Equal(time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("parseAdvisoryDate(date only) = %v", got)
+	}
+	if got := parseAdvisoryDate("soon"); !got.IsZero() {
+		t.Errorf("parseAdvisoryDate(invalid) = %v, want zero", got)
+	}
+}
+
+func TestUpdateClassificationMerge(t *testing.T) {
+	older := time.Date(2023, 12, 20, 0, 0, 0, 0, time.UTC)
+	newer := time.Date(2024, 1, 30, 0, 0, 0, 0, time.UTC)
+	bugfix := updateClassification{class: updateClassBugfix, severity: "none"}
+	moderate := updateClassification{class: updateClassSecurity, severity: "moderate", issued: newer}
+	critical := updateClassification{class: updateClassSecurity, severity: "critical", issued: older}
+
+	tests := []struct {
+		name  string
+		merge []updateClassification
+		want  updateClassification
+	}{
+		{"no advisory", nil, unclassifiedUpdate},
+		{"bugfix", []updateClassification{bugfix}, bugfix},
+		{"security over bugfix", []updateClassification{moderate, bugfix}, moderate},
+		{"highest severity and oldest date", []updateClassification{moderate, critical}, updateClassification{updateClassSecurity, "critical", older}},
+		{"unknown severity", []updateClassification{{class: updateClassSecurity, severity: "unknown"}, moderate}, moderate},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := unclassifiedUpdate
+			for _, c := range tt.merge {
+				got = got.merge(c)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSecurityUpdateAgeAdvancesWhileCached(t *testing.T) {
+	opts := fixtureOptions(t, "debian12")
+	c := &updateCollector{Collector: newPackageUpdatesCollector(opts.Paths, time.Hour)}
+
+	// The Date of the bookworm-security Release file is 07:51:12
+	if got := collectText(t, c); !bytes.Contains(got, []byte(`system_package_security_update_oldest_age_seconds{manager="apt"} 7728`)) {
+		t.Errorf("age of the security update not reported:\n%s", got)
+	}
+	timeNow = func() time.Time { return fixtureTime.Add(time.Minute) }
+	if got := collectText(t, c); !bytes.Contains(got, []byte(`system_package_security_update_oldest_age_seconds{manager="apt"} 7788`)) {
+		t.Errorf("age did not advance with cached updates:\n%s", got)
+	}
+}
+
+func TestUpdateHeldForOneArchitecture(t *testing.T) {
+	opts := fixtureOptions(t, "debian12")
+	status := opts.Paths.rootfs("/var/lib/dpkg/status")
+	data, err := os.ReadFile(status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only libc6:amd64 is on hold
+	data = []byte(strings.Replace(string(data), "Package: libc6\nStatus: install ok installed\n", "Package: libc6\nStatus: hold ok installed\n", 1))
+	if err := os.WriteFile(status, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	got := collectText(t, &updateCollector{Collector: newPackageUpdatesCollector(opts.Paths, 0)})
+	for _, want := range []string{
+		`system_package_update_available{candidate_version="2.36-9+deb12u7",installed_version="2.36-9+deb12u4",package="libc6"} 1`,
+		`system_package_update_held{candidate_version="2.36-9+deb12u7",installed_version="2.36-9+deb12u4",package="libc6",reason="hold"} 1`,
+		`system_package_updates_held{manager="apt"} 2`,
+		`system_package_updates_pending{manager="apt"} 3`,
+	} {
+		if !bytes.Contains(got, []byte(want)) {
+			t.Errorf("missing %s:\n%s", want, got)
+		}
+	}
+}
+
+func TestUpdatesDetectSingleQuotedOSRelease(t *testing.T) {
+	opts := fixtureOptions(t, "rocky9")
+	release := "NAME='Rocky Linux'\nID='rocky'\nID_LIKE='rhel fedora'\nVERSION_ID='9.3'\n"
+	if err := os.WriteFile(opts.Paths.rootfs("/etc/os-release"), []byte(release), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	got := collectText(t, &updateCollector{Collector: newPackageUpdatesCollector(opts.Paths, 0)})
+	if !bytes.Contains(got, []byte(`system_package_updates_pending{manager="dnf"} 5`)) {
+		t.Errorf("dnf updates not collected:\n%s", got)
+	}
+}
@@ -2,51 +2,77 @@ package metrics
 
 import (
 	"bufio"
+	"context"
+	"fmt"
 	"log"
 	"os"
 	"os/exec"
 	"os/user"
+	"slices"
 	"strconv"
 	"strings"
-	"syscall"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
 
-var (
-	systemUserMetrics = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "system_user_info",
-			Help: "Information about system users, including username, home directory, UID, GID, and active status",
-		},
-		[]string{"username", "home_directory", "uid", "gid", "active"},
-	)
-)
+type systemUserCollector struct {
+	info   *prometheus.Desc
+	debug  bool
+	filter UsersConfig
+	paths  Paths
+}
 
 func init() {
-	prometheus.MustRegister(systemUserMetrics)
+	registerCollector("users", true, func(opts Options) Collector {
+		return newSystemUserCollector(opts.Debug, opts.Config.Users, opts.Paths)
+	})
+}
+
+// newSystemUserCollector returns a collector for the login users found in
+// /etc/passwd that pass filter, and the user the exporter runs as when it
+// runs on the host.
+func newSystemUserCollector(debug bool, filter UsersConfig, paths Paths) Collector {
+	return &systemUserCollector{
+		info: prometheus.NewDesc(
+			"system_user_info",
+			"Information about system users, including username, home directory, UID, GID, and active status",
+			[]string{"username", "home_directory", "uid", "gid", "active"}, nil,
+		),
+		debug:  debug,
+		filter: filter,
+		paths:  paths,
+	}
+}
+
+func (c *systemUserCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.info
 }
 
-func CollectSystemUserMetrics(debug bool) {
+func (c *systemUserCollector) Update(ctx context.Context, ch chan<- prometheus.Metric) error {
+	debug := c.debug
 	if debug {
 		log.Println("Debug: Starting system user metrics collection")
 	}
 
-	users, err := fetchAllUsers(debug) // Pass debug flag
+	users, err := fetchAllUsers(debug, c.filter, c.paths)
 	if err != nil {
-		log.Printf("Error fetching user information: %v", err)
-		return
+		return fmt.Errorf("fetching user information: %w", err)
 	}
 
 	if debug {
 		log.Printf("Debug: Fetched %d users from /etc/passwd", len(users))
 	}
 
+	seen := labelSet{}
 	for _, user := range users {
 		if debug {
 			log.Printf("Debug: Processing user: %s (UID: %s, GID: %s, HomeDir: %s)", user.Username, user.Uid, user.Gid, user.HomeDir)
 		}
 
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		uid, err := strconv.Atoi(user.Uid)
 		if err != nil {
 			log.Printf("Error parsing UID for user %s: %v", user.Username, err)
@@ -54,27 +80,43 @@ func CollectSystemUserMetrics(debug bool) {
 		}
 
 		active := "0"
-		if isUserActive(uid) {
+		if isUserActive(ctx, c.paths, uid) {
 			active = "1"
 		}
 
-		systemUserMetrics.WithLabelValues(user.Username, user.HomeDir, user.Uid, user.Gid, active).Set(1)
+		// A user listed twice in /etc/passwd is reported once, as the
+		// first entry is the one the system uses
+		if !seen.add(user.Username) {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(c.info, prometheus.GaugeValue, 1, user.Username, user.HomeDir, user.Uid, user.Gid, active)
 
 		if debug {
 			log.Printf("Debug: Updated metric for user: %s (Active: %s)", user.Username, active)
 		}
 	}
 
+	// The user running the exporter is always reported as active. In a
+	// container that user does not exist on the host, so it is skipped.
+	if c.paths.isHostRoot() {
+		if current, err := user.Current(); err != nil {
+			log.Printf("Error fetching current user info: %v", err)
+		} else if seen.add(current.Username) {
+			ch <- prometheus.MustNewConstMetric(c.info, prometheus.GaugeValue, 1, current.Username, current.HomeDir, current.Uid, current.Gid, "1")
+		}
+	}
+
 	if debug {
 		log.Println("Debug: All users have been processed and metrics updated.")
 	}
+	return nil
 }
 
-func fetchAllUsers(debug bool) ([]*user.User, error) {
+func fetchAllUsers(debug bool, filter UsersConfig, paths Paths) ([]*user.User, error) {
 	users := []*user.User{}
 
 	// Open /etc/passwd to read all users
-	file, err := os.Open("/etc/passwd")
+	file, err := os.Open(paths.rootfs("/etc/passwd"))
 	if err != nil {
 		return nil, err
 	}
@@ -87,32 +129,27 @@ func fetchAllUsers(debug bool) ([]*user.User, error) {
 		if len(fields) >= 7 {
 			// Filter out system/application users by UID
 			uid, err := strconv.Atoi(fields[2])
-			if err != nil || uid < 1000 {
+			if err != nil || uid < filter.MinUID {
 				continue
 			}
 
 			// Filter users by shell
 			shell := fields[6]
-			if shell != "/bin/bash" && shell != "/bin/sh" {
-				continue
-			}
-
-			// Use os/user package to fetch user details
-			usr, err := user.Lookup(fields[0])
-			if err != nil {
-				log.Printf("Error looking up user %s: %v", fields[0], err)
+			if len(filter.Shells) > 0 && !slices.Contains(filter.Shells, shell) {
 				continue
 			}
 
+			// Take the details from the host's /etc/passwd rather than the
+			// exporter's own user database, which differs in a container
 			users = append(users, &user.User{
-				Username: usr.Username,
-				Uid:      usr.Uid,
-				Gid:      fields[3], // Extract GID directly from /etc/passwd
-				HomeDir:  usr.HomeDir,
+				Username: fields[0],
+				Uid:      fields[2],
+				Gid:      fields[3],
+				HomeDir:  fields[5],
 			})
 
 			if debug {
-				log.Printf("Debug: Fetched user: %s (UID: %s, GID: %s, HomeDir: %s, Shell: %s)", usr.Username, usr.Uid, fields[3], usr.HomeDir, shell)
+				log.Printf("Debug: Fetched user: %s (UID: %s, GID: %s, HomeDir: %s, Shell: %s)", fields[0], fields[2], fields[3], fields[5], shell)
 			}
 		}
 	}
@@ -123,8 +160,8 @@ func fetchAllUsers(debug bool) ([]*user.User, error) {
 	return users, nil
 }
 
-func isUserActive(uid int) bool {
-	procDir := "/proc"
+func isUserActive(ctx context.Context, paths Paths, uid int) bool {
+	procDir := paths.proc()
 	entries, err := os.ReadDir(procDir)
 	if err != nil {
 		log.Printf("Error reading %s: %v", procDir, err)
@@ -133,16 +170,21 @@ func isUserActive(uid int) bool {
 
 	// Check active processes in /proc
 	for _, entry := range entries {
-		if _, err := strconv.Atoi(entry.Name()); err == nil {
-			stat := &syscall.Stat_t{}
-			if err := syscall.Stat(procDir+"/"+entry.Name(), stat); err == nil && int(stat.Uid) == uid {
-				return true
-			}
+		if _, err := strconv.Atoi(entry.Name()); err != nil {
+			continue
+		}
+		_, procUID, err := readProcessStatus(paths.proc(entry.Name(), "status"))
+		if err == nil && procUID == strconv.Itoa(uid) {
+			return true
 		}
 	}
 
-	// Fallback: Check active users using the `w` command
-	output, err := exec.Command("w", "-h").Output()
+	// Fallback: Check active users using the `w` command, which only sees
+	// the host's sessions when running on the host
+	if !paths.isHostRoot() {
+		return false
+	}
+	output, err := exec.CommandContext(ctx, "w", "-h").Output()
 	if err != nil {
 		log.Printf("Error executing 'w' command: %v", err)
 		return false
@@ -0,0 +1,29 @@
+package metrics
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestUsersListedTwiceReportedOnce(t *testing.T) {
+	opts := fixtureOptions(t, "debian12")
+	passwd := opts.Paths.rootfs("/etc/passwd")
+	data, err := os.ReadFile(passwd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = append(data, "bob:x:1001:1001:Bob:/home/bob2:/bin/bash\n"...)
+	if err := os.WriteFile(passwd, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &updateCollector{Collector: newSystemUserCollector(false, opts.Config.Users, opts.Paths)}
+	got := collectText(t, c)
+	if !bytes.Contains(got, []byte(`home_directory="/home/bob",uid="1001",username="bob"} 1`)) {
+		t.Errorf("first entry of bob not reported:\n%s", got)
+	}
+	if bytes.Contains(got, []byte(`home_directory="/home/bob2"`)) {
+		t.Errorf("second entry of bob reported:\n%s", got)
+	}
+}
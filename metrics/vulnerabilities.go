@@ -0,0 +1,323 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Severities vulnerabilities are counted by. Ratings such as Red Hat's
+// Important or Debian's unimportant urgency are mapped to the nearest.
+const (
+	severityCritical = "critical"
+	severityHigh     = "high"
+	severityMedium   = "medium"
+	severityLow      = "low"
+	severityUnknown  = "unknown"
+)
+
+var vulnerabilitySeverities = []string{severityCritical, severityHigh, severityMedium, severityLow, severityUnknown}
+
+// normalizeSeverity maps the rating of an advisory to one of
+// vulnerabilitySeverities.
+func normalizeSeverity(rating string) string {
+	switch strings.ToLower(strings.Trim(rating, " *")) {
+	case "critical":
+		return severityCritical
+	case "high", "important":
+		return severityHigh
+	case "medium", "moderate":
+		return severityMedium
+	case "low", "negligible", "unimportant":
+		return severityLow
+	}
+	return severityUnknown
+}
+
+type vulnerabilitiesCollector struct {
+	packageVulns *prometheus.Desc
+	hostVulns    *prometheus.Desc
+	dbModified   *prometheus.Desc
+	dbPath       string
+	paths        Paths
+	cache        metricCache
+
+	// db is the parsed database, reused while its files are unchanged.
+	db *vulnDatabase
+}
+
+func init() {
+	registerCollector("vulnerabilities", true, func(opts Options) Collector {
+		return newVulnerabilitiesCollector(opts.VulnDBPath, opts.Paths, opts.CacheTTL)
+	})
+}
+
+// newVulnerabilitiesCollector returns a collector matching the installed
+// packages against the OSV records and OVAL definitions in dbPath. Without
+// a database it exports nothing.
+func newVulnerabilitiesCollector(dbPath string, paths Paths, ttl time.Duration) Collector {
+	return &vulnerabilitiesCollector{
+		packageVulns: prometheus.NewDesc(
+			"system_package_vulnerabilities",
+			"Number of known vulnerabilities (CVEs) affecting the installed version of a package, by severity",
+			[]string{"package", "severity"}, nil,
+		),
+		hostVulns: prometheus.NewDesc(
+			"system_vulnerabilities",
+			"Number of known vulnerabilities (CVEs) affecting at least one installed package, by severity",
+			[]string{"severity"}, nil,
+		),
+		dbModified: prometheus.NewDesc(
+			"system_vulnerability_database_last_modified_timestamp_seconds",
+			"Modification time of the newest file in the vulnerability database",
+			nil, nil,
+		),
+		dbPath: dbPath,
+		paths:  paths,
+		cache:  metricCache{ttl: ttl},
+	}
+}
+
+func (c *vulnerabilitiesCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.packageVulns
+	ch <- c.hostVulns
+	ch <- c.dbModified
+}
+
+func (c *vulnerabilitiesCollector) Update(ctx context.Context, ch chan<- prometheus.Metric) error {
+	if c.dbPath == "" {
+		return nil
+	}
+	return c.cache.collect(ch, func(ch chan<- prometheus.Metric) error {
+		return c.update(ctx, ch)
+	})
+}
+
+func (c *vulnerabilitiesCollector) update(ctx context.Context, ch chan<- prometheus.Metric) error {
+	if runtime.GOOS != "linux" {
+		return fmt.Errorf("vulnerability matching is not supported on %s", runtime.GOOS)
+	}
+
+	release, err := readOSRelease(c.paths)
+	if err != nil {
+		return err
+	}
+	packages, err := collectLinuxPackageVersions(ctx, false, c.paths)
+	if err != nil {
+		return err
+	}
+
+	files, fingerprint, modified, err := listVulnDatabase(c.dbPath)
+	if err != nil {
+		return err
+	}
+	fingerprint += "\x00" + release["NAME"] + "\x00" + release["VERSION_ID"]
+	if c.db == nil || c.db.fingerprint != fingerprint {
+		// Parsing a full mirror can outlast the scrape deadline, so it does
+		// not stop when the scrape gives up: the collection then finishes in
+		// the background and later scrapes are served from the cache,
+		// instead of every scrape starting over.
+		db, err := loadVulnDatabase(files, release)
+		if err != nil {
+			return err
+		}
+		db.fingerprint = fingerprint
+		c.db = db
+	}
+
+	perPackage := map[string]map[string]string{}
+	host := map[string]string{}
+	for _, match := range c.db.match(c.paths, packages) {
+		if perPackage[match.pkg] == nil {
+			perPackage[match.pkg] = map[string]string{}
+		}
+		if _, ok := perPackage[match.pkg][match.cve]; !ok {
+			perPackage[match.pkg][match.cve] = match.severity
+		}
+		if _, ok := host[match.cve]; !ok {
+			host[match.cve] = match.severity
+		}
+	}
+
+	for pkg, cves := range perPackage {
+		counts := map[string]int{}
+		for _, severity := range cves {
+			counts[severity]++
+		}
+		for severity, count := range counts {
+			ch <- prometheus.MustNewConstMetric(c.packageVulns, prometheus.GaugeValue, float64(count), pkg, severity)
+		}
+	}
+	counts := map[string]int{}
+	for _, severity := range host {
+		counts[severity]++
+	}
+	for _, severity := range vulnerabilitySeverities {
+		ch <- prometheus.MustNewConstMetric(c.hostVulns, prometheus.GaugeValue, float64(counts[severity]), severity)
+	}
+	if !modified.IsZero() {
+		ch <- prometheus.MustNewConstMetric(c.dbModified, prometheus.GaugeValue, float64(modified.Unix()))
+	}
+	return nil
+}
+
+// vulnDatabase is the content of the database relevant to the host.
+type vulnDatabase struct {
+	fingerprint string
+	// osv holds the affected packages of OSV records by package name.
+	osv  map[string][]osvEntry
+	oval []*ovalDocument
+}
+
+// vulnMatch is a vulnerability affecting an installed package.
+type vulnMatch struct {
+	pkg      string
+	cve      string
+	severity string
+}
+
+// listVulnDatabase returns the database files under dir: OSV records as
+// .json files or .zip archives of them, and OVAL definitions as .xml or
+// .xml.bz2 files. The fingerprint changes whenever a file does.
+func listVulnDatabase(dir string) ([]string, string, time.Time, error) {
+	var (
+		files       []string
+		fingerprint strings.Builder
+		modified    time.Time
+	)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || vulnFileFormat(path) == "" {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files = append(files, path)
+		fmt.Fprintf(&fingerprint, "%s\x00%d\x00%d\n", path, info.Size(), info.ModTime().UnixNano())
+		if info.ModTime().After(modified) {
+			modified = info.ModTime()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", time.Time{}, fmt.Errorf("reading vulnerability database: %w", err)
+	}
+	return files, fingerprint.String(), modified, nil
+}
+
+func vulnFileFormat(path string) string {
+	switch {
+	case strings.HasSuffix(path, ".json"), strings.HasSuffix(path, ".zip"):
+		return "osv"
+	case strings.HasSuffix(path, ".xml"), strings.HasSuffix(path, ".xml.bz2"):
+		return "oval"
+	}
+	return ""
+}
+
+// loadVulnDatabase parses files, keeping OSV records for the host's
+// ecosystem and OVAL definitions for its platform.
+func loadVulnDatabase(files []string, release map[string]string) (*vulnDatabase, error) {
+	db := &vulnDatabase{osv: map[string][]osvEntry{}}
+	ecosystem := osvEcosystem(release)
+	for _, path := range files {
+		switch vulnFileFormat(path) {
+		case "osv":
+			if ecosystem == "" {
+				continue
+			}
+			if err := loadOSVFile(path, ecosystem, db.osv); err != nil {
+				return nil, err
+			}
+		case "oval":
+			doc, err := loadOVALFile(path, release)
+			if err != nil {
+				return nil, fmt.Errorf("parsing %s: %w", path, err)
+			}
+			if len(doc.definitions) > 0 {
+				db.oval = append(db.oval, doc)
+			}
+		}
+	}
+	return db, nil
+}
+
+// match returns the vulnerabilities affecting packages. OSV records name
+// source packages for Debian, Ubuntu and Alpine and binary ones elsewhere,
+// so both names are looked up.
+func (db *vulnDatabase) match(paths Paths, packages []installedPackage) []vulnMatch {
+	var matches []vulnMatch
+	for _, pkg := range packages {
+		compare := versionComparator(pkg.purlType)
+		if compare == nil {
+			continue
+		}
+		names := []string{pkg.name}
+		if pkg.source != "" && pkg.source != pkg.name {
+			names = append(names, pkg.source)
+		}
+		for _, name := range names {
+			for _, entry := range db.osv[name] {
+				if !entry.affected.affects(pkg.version, compare) {
+					continue
+				}
+				for _, cve := range entry.cves {
+					matches = append(matches, vulnMatch{pkg: pkg.name, cve: cve, severity: entry.severity})
+				}
+			}
+		}
+	}
+
+	for _, doc := range db.oval {
+		evaluator := newOVALEvaluator(doc, paths, packages)
+		ids := make([]string, 0, len(doc.definitions))
+		for id := range doc.definitions {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			def := doc.definitions[id]
+			if def.Class != "vulnerability" && def.Class != "patch" {
+				continue
+			}
+			result := evaluator.definition(id)
+			if result.result != ovalTrue {
+				continue
+			}
+			severity := normalizeSeverity(def.Metadata.Severity)
+			for _, pkg := range result.packages {
+				for _, cve := range def.cves() {
+					matches = append(matches, vulnMatch{pkg: pkg, cve: cve, severity: severity})
+				}
+			}
+		}
+	}
+	return matches
+}
+
+// versionComparator returns the version ordering of a package manager, by
+// package URL type.
+func versionComparator(purlType string) func(a, b string) int {
+	switch purlType {
+	case "deb":
+		return CompareDebianVersions
+	case "rpm":
+		return CompareRPMVersions
+	case "apk":
+		return CompareAPKVersions
+	case "alpm":
+		return ComparePacmanVersions
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package metrics
+
+import "testing"
+
+func TestOSVRangeAffects(t *testing.T) {
+	// Affected from the start until 2.0, again from 3.0 until 3.5, and from
+	// 4.0 up to and including 4.2
+	r := osvRange{Type: "ECOSYSTEM", Events: []osvEvent{
+		{Introduced: "3.0"},
+		{Fixed: "3.5"},
+		{Introduced: "0"},
+		{Fixed: "2.0"},
+		{Introduced: "4.0"},
+		{LastAffected: "4.2"},
+	}}
+	tests := []struct {
+		version string
+		want    bool
+	}{
+		{"1.0", true},
+		{"2.0", false},
+		{"2.9", false},
+		{"3.0", true},
+		{"3.4.9", true},
+		{"3.5", false},
+		{"4.2", true},
+		{"4.2.1", false},
+	}
+	for _, tt := range tests {
+		if got := r.affects(tt.version, CompareDebianVersions); got != tt.want {
+			t.Errorf("affects(%s) = %v, want %v", tt.version, got, tt.want)
+		}
+	}
+}
+
+func TestCVSS3BaseScore(t *testing.T) {
+	tests := []struct {
+		vector string
+		want   float64
+	}{
+		{"CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:H/I:H/A:H", 9.8},
+		{"CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:C/C:H/I:H/A:H", 10.0},
+		{"CVSS:3.1/AV:N/AC:H/PR:N/UI:N/S:U/C:H/I:H/A:H", 8.1},
+		{"CVSS:3.1/AV:L/AC:L/PR:L/UI:N/S:C/C:H/I:N/A:N", 6.5},
+		{"CVSS:3.0/AV:L/AC:L/PR:N/UI:R/S:U/C:N/I:N/A:H", 5.5},
+		{"CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:N/I:N/A:N", 0},
+	}
+	for _, tt := range tests {
+		got, err := cvss3BaseScore(tt.vector)
+		if err != nil {
+			t.Errorf("cvss3BaseScore(%s): %v", tt.vector, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("cvss3BaseScore(%s) = %v, want %v", tt.vector, got, tt.want)
+		}
+	}
+
+	for _, vector := range []string{"AV:N/AC:L/Au:N/C:P/I:P/A:P", "CVSS:3.1/AV:N/AC:L"} {
+		if _, err := cvss3BaseScore(vector); err == nil {
+			t.Errorf("cvss3BaseScore(%s) succeeded, want an error", vector)
+		}
+	}
+}
+
+func TestOVALCriteria(t *testing.T) {
+	doc := &ovalDocument{
+		tests: map[string]*ovalTest{
+			"vulnerable": {kind: "dpkginfo_test", States: []ovalStateRef{{Ref: "before-16"}}},
+			"fixed":      {kind: "dpkginfo_test", States: []ovalStateRef{{Ref: "before-10"}}},
+			"kernel":     {kind: "variable_test"},
+		},
+		objects: map[string]*ovalObject{
+			"openssl": {Name: ovalValue{Value: "openssl"}},
+		},
+		states: map[string]*ovalState{
+			"before-16": {EVR: &ovalValue{Value: "0:3.0.2-0ubuntu1.16", Operation: "less than"}},
+			"before-10": {EVR: &ovalValue{Value: "0:3.0.2-0ubuntu1.10", Operation: "less than"}},
+		},
+	}
+	doc.tests["vulnerable"].Object.Ref = "openssl"
+	doc.tests["fixed"].Object.Ref = "openssl"
+	e := newOVALEvaluator(doc, Paths{}, []installedPackage{{name: "openssl", version: "3.0.2-0ubuntu1.15"}})
+
+	criteria := func(operator string, negate bool, tests ...string) *ovalCriteria {
+		c := &ovalCriteria{Operator: operator, Negate: negate}
+		for _, test := range tests {
+			c.Criterions = append(c.Criterions, ovalCriterion{TestRef: test})
+		}
+		return c
+	}
+	tests := []struct {
+		name     string
+		criteria *ovalCriteria
+		want     ovalResult
+		packages int
+	}{
+		{"true test", criteria("AND", false, "vulnerable"), ovalTrue, 1},
+		{"false test", criteria("AND", false, "fixed"), ovalFalse, 0},
+		{"unsupported test", criteria("AND", false, "kernel"), ovalUnknown, 0},
+		{"missing test", criteria("AND", false, "missing"), ovalUnknown, 0},
+		{"AND with unknown", criteria("AND", false, "vulnerable", "kernel"), ovalUnknown, 0},
+		{"AND with false", criteria("AND", false, "fixed", "kernel"), ovalFalse, 0},
+		{"OR with true", criteria("OR", false, "kernel", "vulnerable"), ovalTrue, 1},
+		{"OR with unknown", criteria("OR", false, "fixed", "kernel"), ovalUnknown, 0},
+		{"negated", criteria("AND", true, "fixed"), ovalTrue, 0},
+		{"negated unknown", criteria("OR", true, "kernel"), ovalUnknown, 0},
+	}
+	for _, tt := range tests {
+		got := e.criteria(tt.criteria)
+		if got.result != tt.want || len(got.packages) != tt.packages {
+			t.Errorf("%s: got %v with packages %q, want %v with %d", tt.name, got.result, got.packages, tt.want, tt.packages)
+		}
+	}
+}
+
+func TestOVALPackageTestSourceNames(t *testing.T) {
+	doc := &ovalDocument{
+		tests: map[string]*ovalTest{
+			"dpkg": {kind: "dpkginfo_test"},
+			"rpm":  {kind: "rpminfo_test"},
+		},
+		objects: map[string]*ovalObject{
+			"glibc": {Name: ovalValue{Value: "glibc"}},
+		},
+		states: map[string]*ovalState{},
+	}
+	doc.tests["dpkg"].Object.Ref = "glibc"
+	doc.tests["rpm"].Object.Ref = "glibc"
+	e := newOVALEvaluator(doc, Paths{}, []installedPackage{
+		{name: "libc6", version: "2.36-9+deb12u4", source: "glibc"},
+		{name: "glibc-common", version: "2.34-83.el9_3.12", source: "glibc"},
+	})
+
+	// Debian definitions name the source package
+	if got := e.test("dpkg"); got.result != ovalTrue {
+		t.Errorf("dpkginfo test of the source package: got %v, want true", got.result)
+	}
+	// glibc-common does not make glibc installed
+	if got := e.test("rpm"); got.result != ovalFalse {
+		t.Errorf("rpminfo test of a binary package that is not installed: got %v, want false", got.result)
+	}
+}
@@ -0,0 +1,563 @@
+package metrics
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	_ "modernc.org/sqlite"
+)
+
+// rpmDefaultRepoPriority is the priority of a repository without a
+// priority= setting. Lower values win.
+const rpmDefaultRepoPriority = 99
+
+// rpmPackage is an installed or available RPM package.
+type rpmPackage struct {
+	name string
+	arch string
+	evr  rpmEVR
+}
+
+// key identifies the package among the architectures installed side by
+// side, e.g. glibc.x86_64 and glibc.i686.
+func (p rpmPackage) key() string {
+	return p.name + "." + p.arch
+}
+
+// installedRPMs lists the installed packages from the RPM database, and with
+// rpm -qa when there is none or it is in a format readRPMDatabase does not
+// know or cannot parse.
+func installedRPMs(ctx context.Context, paths Paths) ([]rpmPackage, error) {
+	installed, err := readRPMDatabase(paths)
+	if err == nil {
+		packages := make([]rpmPackage, 0, len(installed))
+		for _, pkg := range installed {
+			packages = append(packages, pkg.rpmPackage)
+		}
+		return packages, nil
+	}
+	if errors.Is(err, errUnreadableRPMDatabase) {
+		log.Printf("Falling back to rpm -qa: %v", err)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	args := []string{"-qa", "--queryformat", `%{NAME} %{ARCH} %{EPOCHNUM}:%{VERSION}-%{RELEASE}\n`}
+	if !paths.isHostRoot() {
+		args = append(args, "--root", paths.RootFS)
+	}
+	output, err := exec.CommandContext(ctx, "rpm", args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("querying installed packages using rpm: %w", err)
+	}
+	return parseRPMQueryOutput(output), nil
+}
+
+// parseRPMQueryOutput parses "name arch epoch:version-release" lines.
+// Imported GPG keys are listed as packages without an architecture and are
+// skipped.
+func parseRPMQueryOutput(output []byte) []rpmPackage {
+	var packages []rpmPackage
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || fields[1] == "(none)" {
+			continue
+		}
+		packages = append(packages, rpmPackage{name: fields[0], arch: fields[1], evr: parseRPMVersion(fields[2])})
+	}
+	return packages
+}
+
+// rpmRepo is a repository whose metadata is in the dnf or yum cache.
+type rpmRepo struct {
+	id       string
+	repomd   string
+	priority int
+}
+
+// rpmRepoConfig is a repository section of a .repo file.
+type rpmRepoConfig struct {
+	file     string
+	enabled  bool
+	priority int
+	// url is the baseurl, mirrorlist or metalink of the repository.
+	url      string
+	gpgcheck bool
+}
+
+// dnfCacheSuffix is the hash dnf appends to the cache directory of a repo.
+var dnfCacheSuffix = regexp.MustCompile(`-[0-9a-f]{16}$`)
+
+// findRPMRepos returns the repositories with cached metadata and the package
+// manager that downloaded it. dnf keeps <id>-<hash>/repodata/repomd.xml under
+// /var/cache/dnf (or /var/cache/libdnf5 for dnf5), yum keeps
+// <basearch>/<releasever>/<id>/repomd.xml under /var/cache/yum. Repositories
+// that are disabled or no longer configured in /etc/yum.repos.d are skipped,
+// as dnf would skip them.
+func findRPMRepos(paths Paths) (string, []rpmRepo, error) {
+	configs, err := loadRPMRepoConfigs(paths)
+	if err != nil {
+		return "", nil, err
+	}
+
+	for _, layout := range []struct {
+		manager string
+		pattern string
+		idDir   func(repomd string) string
+	}{
+		{"dnf", "/var/cache/libdnf5/*/repodata/repomd.xml", func(p string) string { return filepath.Dir(filepath.Dir(p)) }},
+		{"dnf", "/var/cache/dnf/*/repodata/repomd.xml", func(p string) string { return filepath.Dir(filepath.Dir(p)) }},
+		{"yum", "/var/cache/yum/*/*/*/repomd.xml", filepath.Dir},
+	} {
+		matches, err := filepath.Glob(paths.rootfs(layout.pattern))
+		if err != nil {
+			return "", nil, err
+		}
+
+		var repos []rpmRepo
+		for _, repomd := range matches {
+			id := dnfCacheSuffix.ReplaceAllString(filepath.Base(layout.idDir(repomd)), "")
+			repo := rpmRepo{id: id, repomd: repomd, priority: rpmDefaultRepoPriority}
+			if configs != nil {
+				config, ok := configs[id]
+				if !ok || !config.enabled {
+					continue
+				}
+				repo.priority = config.priority
+			}
+			repos = append(repos, repo)
+		}
+		if len(repos) > 0 {
+			return layout.manager, repos, nil
+		}
+	}
+	return "", nil, errors.New("no cached repository metadata found, run dnf makecache")
+}
+
+// loadRPMRepoConfigs reads the repository sections of /etc/yum.repos.d/*.repo.
+// It returns nil when there are none, in which case every cached repository
+// is used.
+func loadRPMRepoConfigs(paths Paths) (map[string]rpmRepoConfig, error) {
+	files, err := filepath.Glob(paths.rootfs("/etc/yum.repos.d/*.repo"))
+	if err != nil || len(files) == 0 {
+		return nil, err
+	}
+
+	gpgcheck, err := rpmDefaultGPGCheck(paths)
+	if err != nil {
+		return nil, err
+	}
+	configs := map[string]rpmRepoConfig{}
+	for _, name := range files {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+
+		var section string
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || line[0] == '#' || line[0] == ';' {
+				continue
+			}
+			if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+				section = strings.TrimSpace(line[1 : len(line)-1])
+				configs[section] = rpmRepoConfig{
+					file:     name,
+					enabled:  true,
+					priority: rpmDefaultRepoPriority,
+					gpgcheck: gpgcheck,
+				}
+				continue
+			}
+			key, value, ok := strings.Cut(line, "=")
+			if !ok || section == "" {
+				continue
+			}
+			config := configs[section]
+			switch strings.TrimSpace(key) {
+			case "enabled":
+				config.enabled = isTrueRepoValue(strings.TrimSpace(value))
+			case "priority":
+				if priority, err := strconv.Atoi(strings.TrimSpace(value)); err == nil {
+					config.priority = priority
+				}
+			case "gpgcheck":
+				config.gpgcheck = isTrueRepoValue(strings.TrimSpace(value))
+			case "baseurl", "mirrorlist", "metalink":
+				// A baseurl is used before a mirror list, and may list
+				// several URLs
+				urls := strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' })
+				if len(urls) > 0 && (config.url == "" || strings.TrimSpace(key) == "baseurl") {
+					config.url = urls[0]
+				}
+			}
+			configs[section] = config
+		}
+	}
+	return configs, nil
+}
+
+// rpmDefaultGPGCheck returns the gpgcheck setting of the [main] section of
+// /etc/dnf/dnf.conf, or of /etc/yum.conf on hosts with yum only. Without
+// either, dnf and yum do not check signatures.
+func rpmDefaultGPGCheck(paths Paths) (bool, error) {
+	for _, name := range []string{"/etc/dnf/dnf.conf", "/etc/yum.conf"} {
+		data, err := os.ReadFile(paths.rootfs(name))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		var section string
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+				section = strings.TrimSpace(line[1 : len(line)-1])
+				continue
+			}
+			key, value, ok := strings.Cut(line, "=")
+			if ok && section == "main" && strings.TrimSpace(key) == "gpgcheck" {
+				return isTrueRepoValue(strings.TrimSpace(value)), nil
+			}
+		}
+		return false, nil
+	}
+	return false, nil
+}
+
+func isTrueRepoValue(value string) bool {
+	switch strings.ToLower(value) {
+	case "1", "yes", "true", "on":
+		return true
+	}
+	return false
+}
+
+// repomdXML is the index of a repository's metadata files.
+type repomdXML struct {
+	Data []struct {
+		Type     string `xml:"type,attr"`
+		Location struct {
+			Href string `xml:"href,attr"`
+		} `xml:"location"`
+	} `xml:"data"`
+}
+
+// readRepomd returns the location of every metadata file listed in a
+// repository's repomd.xml, keyed by type.
+func readRepomd(repomd string) (map[string]string, error) {
+	data, err := os.ReadFile(repomd)
+	if err != nil {
+		return nil, err
+	}
+	var index repomdXML
+	if err := xml.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", repomd, err)
+	}
+
+	locations := map[string]string{}
+	for _, d := range index.Data {
+		locations[d.Type] = d.Location.Href
+	}
+	return locations, nil
+}
+
+// readRPMRepo calls fn for every package in a cached repository, reading
+// primary.sqlite when it was downloaded and primary.xml otherwise.
+func readRPMRepo(repo rpmRepo, locations map[string]string, fn func(rpmPackage)) error {
+	// yum decompresses primary.sqlite.bz2 next to the download
+	if href, ok := locations["primary_db"]; ok {
+		if path, ok := findRepoFile(repo.repomd, stripCompressionSuffix(href)); ok {
+			return readPrimarySQLite(path, fn)
+		}
+	}
+	if href, ok := locations["primary"]; ok {
+		if path, ok := findRepoFile(repo.repomd, href); ok {
+			return readPrimaryXML(path, fn)
+		}
+	}
+	return fmt.Errorf("no primary metadata cached for repository %s", repo.id)
+}
+
+// findRepoFile resolves a location from repomd.xml. dnf mirrors the
+// repository layout (repodata/<file>), yum keeps files next to repomd.xml.
+func findRepoFile(repomd, href string) (string, bool) {
+	dir := filepath.Dir(repomd)
+	for _, path := range []string{
+		filepath.Join(filepath.Dir(dir), filepath.FromSlash(href)),
+		filepath.Join(dir, filepath.Base(href)),
+	} {
+		if _, err := os.Stat(path); err == nil {
+			return path, true
+		}
+	}
+	return "", false
+}
+
+func stripCompressionSuffix(name string) string {
+	for _, ext := range []string{".bz2", ".gz", ".xz", ".zst"} {
+		if strings.HasSuffix(name, ext) {
+			return strings.TrimSuffix(name, ext)
+		}
+	}
+	return name
+}
+
+// primaryPackage is a <package> element of primary.xml.
+type primaryPackage struct {
+	Type    string `xml:"type,attr"`
+	Name    string `xml:"name"`
+	Arch    string `xml:"arch"`
+	Version struct {
+		Epoch   string `xml:"epoch,attr"`
+		Version string `xml:"ver,attr"`
+		Release string `xml:"rel,attr"`
+	} `xml:"version"`
+}
+
+// readPrimaryXML streams the packages of a primary.xml file.
+func readPrimaryXML(path string, fn func(rpmPackage)) error {
+	return decodeRepoXML(path, "package", func(decoder *xml.Decoder, start *xml.StartElement) error {
+		var pkg primaryPackage
+		if err := decoder.DecodeElement(&pkg, start); err != nil {
+			return err
+		}
+		if pkg.Type != "" && pkg.Type != "rpm" {
+			return nil
+		}
+		epoch, _ := strconv.Atoi(pkg.Version.Epoch)
+		fn(rpmPackage{
+			name: pkg.Name,
+			arch: pkg.Arch,
+			evr:  rpmEVR{epoch: epoch, version: pkg.Version.Version, release: pkg.Version.Release},
+		})
+		return nil
+	})
+}
+
+// decodeRepoXML calls fn for every element with the given name in a
+// repository metadata file, which may be compressed with gzip, bzip2, xz or
+// zstd. The files are streamed since primary.xml of a large repository
+// decompresses to hundreds of megabytes.
+func decodeRepoXML(path, element string, fn func(*xml.Decoder, *xml.StartElement) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var r io.Reader = file
+	switch filepath.Ext(path) {
+	case ".gz":
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	case ".bz2":
+		r = bzip2.NewReader(file)
+	case ".zst":
+		zr, err := zstd.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	case ".xz":
+		xr, err := xz.NewReader(file)
+		if err != nil {
+			return err
+		}
+		r = xr
+	case ".xml":
+	default:
+		return fmt.Errorf("unsupported compression of %s", filepath.Base(path))
+	}
+
+	decoder := xml.NewDecoder(r)
+	for {
+		token, err := decoder.Token()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("parsing %s: %w", filepath.Base(path), err)
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != element {
+			continue
+		}
+		if err := fn(decoder, &start); err != nil {
+			return fmt.Errorf("parsing %s: %w", filepath.Base(path), err)
+		}
+	}
+}
+
+// readPrimarySQLite reads the packages table of a primary.sqlite database.
+func readPrimarySQLite(path string, fn func(rpmPackage)) error {
+	db, err := sql.Open("sqlite", "file:"+path+"?mode=ro&immutable=1")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT name, arch, epoch, version, release FROM packages")
+	if err != nil {
+		return fmt.Errorf("querying %s: %w", filepath.Base(path), err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name, arch, epoch, version, release sql.NullString
+		if err := rows.Scan(&name, &arch, &epoch, &version, &release); err != nil {
+			return fmt.Errorf("querying %s: %w", filepath.Base(path), err)
+		}
+		e, _ := strconv.Atoi(epoch.String)
+		fn(rpmPackage{
+			name: name.String,
+			arch: arch.String,
+			evr:  rpmEVR{epoch: e, version: version.String, release: release.String},
+		})
+	}
+	return rows.Err()
+}
+
+// rpmUpdate is an installed package with a newer version in an enabled
+// repository.
+type rpmUpdate struct {
+	pkg       rpmPackage
+	candidate rpmEVR
+	// held is packageLockVersionlock when the versionlock plugin keeps the
+	// package from being updated, and "" otherwise.
+	held string
+	updateClassification
+}
+
+// findRPMUpdates compares the installed packages with the cached repository
+// metadata, so it needs no network access and is as fresh as the last
+// dnf makecache. As in dnf, only the repositories with the best priority
+// that offer a package are considered for it, and packages installed in
+// several versions, like kernels, are compared by their newest version.
+// Updates are classified by the advisories in the repositories'
+// updateinfo.xml that they fix. Updates the versionlock plugin does not
+// allow are returned as held.
+func findRPMUpdates(ctx context.Context, paths Paths) (string, []rpmUpdate, error) {
+	manager, repos, err := findRPMRepos(paths)
+	if err != nil {
+		return "", nil, err
+	}
+	packages, err := installedRPMs(ctx, paths)
+	if err != nil {
+		return "", nil, err
+	}
+
+	installed := map[string]rpmPackage{}
+	for _, pkg := range packages {
+		if current, ok := installed[pkg.key()]; !ok || compareRPMEVR(pkg.evr, current.evr) > 0 {
+			installed[pkg.key()] = pkg
+		}
+	}
+
+	type candidate struct {
+		evr      rpmEVR
+		priority int
+	}
+	best := map[string]candidate{}
+	locations := make([]map[string]string, len(repos))
+	for i, repo := range repos {
+		if err := ctx.Err(); err != nil {
+			return "", nil, err
+		}
+		if locations[i], err = readRepomd(repo.repomd); err != nil {
+			return "", nil, fmt.Errorf("reading repository %s: %w", repo.id, err)
+		}
+		err := readRPMRepo(repo, locations[i], func(pkg rpmPackage) {
+			if _, ok := installed[pkg.key()]; !ok {
+				return
+			}
+			current, ok := best[pkg.key()]
+			if !ok || repo.priority < current.priority ||
+				repo.priority == current.priority && compareRPMEVR(pkg.evr, current.evr) > 0 {
+				best[pkg.key()] = candidate{evr: pkg.evr, priority: repo.priority}
+			}
+		})
+		if err != nil {
+			return "", nil, fmt.Errorf("reading repository %s: %w", repo.id, err)
+		}
+	}
+
+	locks, err := loadVersionlocks(paths)
+	if err != nil {
+		return "", nil, err
+	}
+	pending := map[string]*rpmUpdate{}
+	for key, pkg := range installed {
+		if c, ok := best[key]; ok && compareRPMEVR(c.evr, pkg.evr) > 0 {
+			update := &rpmUpdate{pkg: pkg, candidate: c.evr, updateClassification: unclassifiedUpdate}
+			if !versionlockAllows(locks, pkg.name, c.evr, pkg.arch) {
+				update.held = packageLockVersionlock
+			}
+			pending[key] = update
+		}
+	}
+
+	for i, repo := range repos {
+		href, ok := locations[i]["updateinfo"]
+		if !ok {
+			continue
+		}
+		path, ok := findRepoFile(repo.repomd, href)
+		if !ok {
+			continue
+		}
+		err := readUpdateInfo(path, func(advisory rpmAdvisory) {
+			for _, p := range advisory.Packages {
+				update, ok := pending[p.Name+"."+p.Arch]
+				if !ok {
+					continue
+				}
+				epoch, _ := strconv.Atoi(p.Epoch)
+				fixed := rpmEVR{epoch: epoch, version: p.Version, release: p.Release}
+				// The advisory applies when the update installs its fix
+				if compareRPMEVR(fixed, update.pkg.evr) > 0 && compareRPMEVR(fixed, update.candidate) <= 0 {
+					update.updateClassification = update.merge(advisory.classification())
+				}
+			}
+		})
+		if err != nil {
+			return "", nil, fmt.Errorf("reading advisories of repository %s: %w", repo.id, err)
+		}
+	}
+
+	updates := make([]rpmUpdate, 0, len(pending))
+	for _, update := range pending {
+		updates = append(updates, *update)
+	}
+	sort.Slice(updates, func(i, j int) bool {
+		return updates[i].pkg.key() < updates[j].pkg.key()
+	})
+	return manager, updates, nil
+}
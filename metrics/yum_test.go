@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/ulikunitz/xz"
+)
+
+func TestReadPrimaryXMLCompressedWithXZ(t *testing.T) {
+	const gz = "testdata/rootfs/rocky9/var/cache/dnf/baseos-044cae74d71fe9ea/repodata/3d1f-primary.xml.gz"
+	var want []rpmPackage
+	if err := readPrimaryXML(gz, func(pkg rpmPackage) { want = append(want, pkg) }); err != nil {
+		t.Fatal(err)
+	}
+	if len(want) == 0 {
+		t.Fatal("no packages in the gzip fixture")
+	}
+
+	in, err := os.Open(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	gr, err := gzip.NewReader(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "3d1f-primary.xml.xz")
+	out, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xw, err := xz.NewWriter(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(xw, gr); err != nil {
+		t.Fatal(err)
+	}
+	if err := xw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []rpmPackage
+	if err := readPrimaryXML(path, func(pkg rpmPackage) { got = append(got, pkg) }); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
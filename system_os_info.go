@@ -1,36 +1,93 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
+	"log/slog"
 	"math"
 	"net/http"
+	"os"
+	"os/signal"
 	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"system_os_info/metrics"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/exporter-toolkit/web"
 )
 
+// shutdownTimeout is how long in-flight scrapes get to finish after SIGTERM.
+const shutdownTimeout = 15 * time.Second
+
 func main() {
 	// Define command-line flags for address, port, interval, CPU (millicores), and memory limits
 	address := flag.String("address", "0.0.0.0", "Address to bind the HTTP server")
 	port := flag.String("port", "9101", "Port to bind the HTTP server")
-	interval := flag.Int("interval", 30, "Interval (in minutes) to collect metrics")
+	interval := flag.Int("interval", 30, "Interval (in minutes) to cache package metrics between collections")
 	cpuMillicores := flag.Int("resource.cpu", 0, "Maximum CPU usage in millicores (0 for no limit)")
 	memoryLimit := flag.Int64("resource.memory", 0, "Maximum memory usage in MB (0 for no limit)")
 
-	// Add flags for enabling filesystem and process metrics
-	enableFilesystem := flag.Bool("filesystem", false, "Enable collection of filesystem metrics")
-	enableProcess := flag.Bool("process", false, "Enable collection of process metrics")
-
 	// Add a flag for enabling debug mode
 	debugMode := flag.Bool("debug", false, "Enable debug mode with detailed logs")
 
-	// Add flags for enabling auditing files and scheduled jobs metrics
-	enableAuditing := flag.Bool("auditing", false, "Enable collection of auditing files metrics")
-	enableScheduledJobs := flag.Bool("scheduled-jobs", false, "Enable collection of scheduled jobs metrics")
+	// Prefixes under which the host filesystems are mounted, e.g. /host in a container
+	defaultPaths := metrics.DefaultPaths()
+	rootfsPath := flag.String("path.rootfs", defaultPaths.RootFS, "Root directory of the host filesystem")
+	procfsPath := flag.String("path.procfs", defaultPaths.ProcFS, "procfs mountpoint")
+	sysfsPath := flag.String("path.sysfs", defaultPaths.SysFS, "sysfs mountpoint")
+
+	// Collectors run concurrently, and each one is abandoned once its deadline passes
+	scrapeTimeout := flag.Duration("scrape.timeout", 10*time.Second, "Deadline of each collector in a scrape (0 for no deadline)")
+	maxConcurrency := flag.Int("scrape.max-concurrency", 4, "Maximum number of collectors running at once (0 for no limit)")
+
+	// TLS, client certificate and basic auth settings in the Prometheus web config format
+	webConfigFile := flag.String("web.config.file", "", "Path to the web configuration file enabling TLS or authentication")
+
+	configFile := flag.String("config.file", "", "Path to the YAML configuration file (reloaded on SIGHUP or POST /-/reload)")
+
+	// Locally mirrored OSV records and OVAL definitions to match installed packages against
+	vulnDBPath := flag.String("vuln.db-path", "", "Directory of OSV records and OVAL definitions to match installed packages against (empty disables matching)")
+
+	// Hashing package files is spread over scrapes and throttled to spare the disks
+	integrityReadRate := flag.Int64("integrity.read-rate", 10, "Maximum rate in MB/s at which the package_integrity collector reads files (0 for no limit)")
+	integrityMaxDetails := flag.Int("integrity.max-details", 50, "Maximum number of modified files the package_integrity collector lists individually")
+
+	// Generate --collector.<name> and --no-collector.<name> for every registered collector
+	collectorDefaults := metrics.Collectors()
+	collectorNames := make([]string, 0, len(collectorDefaults))
+	for name := range collectorDefaults {
+		collectorNames = append(collectorNames, name)
+	}
+	sort.Strings(collectorNames)
+
+	enableCollector := map[string]*bool{}
+	disableCollector := map[string]*bool{}
+	for _, name := range collectorNames {
+		enableCollector[name] = flag.Bool("collector."+name, collectorDefaults[name], fmt.Sprintf("Enable the %s collector", name))
+		disableCollector[name] = flag.Bool("no-collector."+name, false, fmt.Sprintf("Disable the %s collector", name))
+	}
+
+	// Older flags kept as aliases for --collector.<name>
+	legacyFlags := map[string]string{
+		"filesystem":     "filesystem",
+		"process":        "process",
+		"auditing":       "auditing",
+		"scheduled-jobs": "scheduled_jobs",
+	}
+	legacyEnabled := map[string]*bool{}
+	for legacy, name := range legacyFlags {
+		legacyEnabled[legacy] = flag.Bool(legacy, false, fmt.Sprintf("Deprecated: use --collector.%s", name))
+	}
 	flag.Parse()
 
 	// Set log level based on debug mode
@@ -39,6 +96,28 @@ func main() {
 		log.Println("Debug mode enabled")
 	}
 
+	// Without explicit limits, fall back to the limits of the exporter's own
+	// cgroup so that it throttles itself before the kernel does
+	if *cpuMillicores == 0 || *memoryLimit == 0 {
+		limits, err := metrics.DetectCgroupLimits()
+		if err != nil {
+			if *debugMode {
+				log.Printf("Debug: No cgroup limits detected: %v", err)
+			}
+		} else {
+			if *cpuMillicores == 0 && limits.CPUMillicores > 0 {
+				*cpuMillicores = limits.CPUMillicores
+				log.Printf("Using cgroup CPU limit of %d millicores", limits.CPUMillicores)
+			}
+			// The cgroup limit is enforced by the OOM killer, so the soft
+			// limit leaves room for memory the Go runtime does not manage
+			if *memoryLimit == 0 && limits.MemoryBytes > 0 {
+				*memoryLimit = limits.MemoryBytes * 9 / 10 / (1024 * 1024)
+				log.Printf("Using cgroup memory limit of %d MB", limits.MemoryBytes/(1024*1024))
+			}
+		}
+	}
+
 	// Set CPU limit based on millicores
 	if *cpuMillicores > 0 {
 		numCores := int(math.Ceil(float64(*cpuMillicores) / 1000.0))
@@ -46,106 +125,155 @@ func main() {
 		log.Printf("CPU usage limited to %d millicores (~%d cores)", *cpuMillicores, numCores)
 	}
 
-	// Start a goroutine to monitor memory usage if a limit is set
+	// Apply the memory limit as a soft limit; expensive collectors are skipped
+	// as usage approaches it instead of the process being killed
 	if *memoryLimit > 0 {
-		go func() {
-			memoryLimitBytes := *memoryLimit * 1024 * 1024
-			for {
-				var memStats runtime.MemStats
-				runtime.ReadMemStats(&memStats)
-				if memStats.Alloc > uint64(memoryLimitBytes) {
-					log.Fatalf("Memory usage exceeded the limit of %d MB", *memoryLimit)
-				}
-				time.Sleep(1 * time.Second)
-			}
-		}()
+		metrics.ApplyMemoryLimit(*memoryLimit * 1024 * 1024)
+		log.Printf("Memory usage limited to %d MB", *memoryLimit)
 	}
 
-	// Example debug log
-	if *debugMode {
-		log.Println("Debug: Starting metric collection loop")
+	for legacy, name := range legacyFlags {
+		if *legacyEnabled[legacy] {
+			log.Printf("--%s is deprecated, use --collector.%s", legacy, name)
+			*enableCollector[name] = true
+		}
 	}
 
-	// Conditionally register metrics based on flags
-	if *enableFilesystem {
-		log.Println("Registering filesystem metrics...")
-		metrics.RegisterFilesystemMetrics()
+	var enabledCollectors []string
+	for _, name := range collectorNames {
+		if *enableCollector[name] && !*disableCollector[name] {
+			enabledCollectors = append(enabledCollectors, name)
+		}
 	}
 
-	if *enableProcess {
-		log.Println("Registering process metrics...")
-		metrics.RegisterProcessMetrics()
+	config, err := metrics.LoadConfig(*configFile)
+	if err != nil {
+		log.Fatalf("Error loading configuration: %v", err)
 	}
 
-	if *enableAuditing {
-		log.Println("Registering auditing files metrics...")
-		metrics.RegisterAuditingMetrics()
+	// Fail at startup rather than on the first connection
+	if err := web.Validate(*webConfigFile); err != nil {
+		log.Fatalf("Error loading web configuration: %v", err)
 	}
 
-	if *enableScheduledJobs {
-		log.Println("Registering scheduled jobs metrics...")
-		metrics.RegisterScheduledJobsMetrics()
+	// Package data is expensive to gather, so it is cached between scrapes
+	options := metrics.Options{
+		Debug:               *debugMode,
+		Config:              config,
+		CacheTTL:            time.Duration(*interval) * time.Minute,
+		VulnDBPath:          *vulnDBPath,
+		IntegrityReadRate:   *integrityReadRate * 1024 * 1024,
+		IntegrityMaxDetails: *integrityMaxDetails,
+		CPUMillicores:       *cpuMillicores,
+		Timeout:             *scrapeTimeout,
+		MaxConcurrency:      *maxConcurrency,
+		Paths: metrics.Paths{
+			RootFS: *rootfsPath,
+			ProcFS: *procfsPath,
+			SysFS:  *sysfsPath,
+		},
+	}
+	collectors, err := metrics.NewCollectorSet(options, enabledCollectors)
+	if err != nil {
+		log.Fatalf("Error creating collectors: %v", err)
 	}
+	log.Printf("Enabled collectors: %s", strings.Join(collectors.Names(), ", "))
+	prometheus.MustRegister(collectors)
 
-	// Start a goroutine to periodically collect metrics based on the interval
-	go func() {
-		ticker := time.NewTicker(time.Duration(*interval) * time.Minute)
-		defer ticker.Stop()
+	reloadSuccess := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "system_os_info_config_last_reload_successful",
+		Help: "Whether the last configuration reload attempt was successful",
+	})
+	reloadSuccessTime := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "system_os_info_config_last_reload_success_timestamp_seconds",
+		Help: "Timestamp of the last successful configuration reload",
+	})
+	prometheus.MustRegister(reloadSuccess, reloadSuccessTime)
+	reloadSuccess.Set(1)
+	reloadSuccessTime.SetToCurrentTime()
 
-		for {
-			if *debugMode {
-				log.Println("Debug: Collecting metrics...")
-			}
-			metrics.CollectSystemUserMetrics(*debugMode) // Pass debug flag
-			metrics.CollectPackageVersions(*debugMode)   // Pass debug flag
-			metrics.CollectOSInfo()
-			metrics.CollectPackageUpdateAvailability()
-
-			// Collect filesystem metrics if enabled
-			if *enableFilesystem {
-				if *debugMode {
-					log.Println("Debug: Collecting filesystem metrics...")
-				}
-				metrics.CollectFilesystemMetrics()
-			}
+	// Reload the configuration file and rebuild the collectors with it
+	var reloadMu sync.Mutex
+	reloadConfig := func() error {
+		reloadMu.Lock()
+		defer reloadMu.Unlock()
 
-			// Collect process metrics if enabled
-			if *enableProcess {
-				if *debugMode {
-					log.Println("Debug: Collecting process metrics...")
-				}
-				metrics.CollectProcessMetrics()
-			}
+		config, err := metrics.LoadConfig(*configFile)
+		if err != nil {
+			reloadSuccess.Set(0)
+			return err
+		}
+		options.Config = config
+		collectors.Reload(options)
 
-			if *enableAuditing {
-				if *debugMode {
-					log.Println("Debug: Collecting auditing files metrics...")
-				}
-				metrics.CollectAuditingMetrics()
-			}
+		reloadSuccess.Set(1)
+		reloadSuccessTime.SetToCurrentTime()
+		log.Println("Configuration reloaded")
+		return nil
+	}
+
+	// Goroutines that must finish before the process exits
+	var background sync.WaitGroup
 
-			if *enableScheduledJobs {
-				if *debugMode {
-					log.Println("Debug: Collecting scheduled jobs metrics...")
-				}
-				metrics.CollectScheduledJobsMetrics()
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		for range hup {
+			if err := reloadConfig(); err != nil {
+				log.Printf("Error reloading configuration: %v", err)
 			}
+		}
+	}()
 
-			<-ticker.C
+	// Run one collection at startup so caches are warm and /-/ready turns
+	// true without waiting for the first scrape
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		if _, err := prometheus.DefaultGatherer.Gather(); err != nil {
+			log.Printf("Error in initial collection: %v", err)
 		}
+		log.Println("Initial collection finished")
 	}()
 
-	// Start a goroutine to collect system metrics
-	go metrics.CollectSystemMetrics(*debugMode) // Pass debug flag
+	var shuttingDown atomic.Bool
+	mux := http.NewServeMux()
 
-	// Call any initialization logic from other files
-	// metrics.InitializeSystemMetrics()
+	mux.HandleFunc("/-/healthy", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, "Healthy")
+	})
+	mux.HandleFunc("/-/ready", func(w http.ResponseWriter, r *http.Request) {
+		if shuttingDown.Load() || !collectors.Ready() {
+			http.Error(w, "Not ready", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, "Ready")
+	})
+
+	mux.HandleFunc("/-/reload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Only POST requests allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := reloadConfig(); err != nil {
+			log.Printf("Error reloading configuration: %v", err)
+			http.Error(w, fmt.Sprintf("failed to reload config: %s", err), http.StatusInternalServerError)
+		}
+	})
 
 	// Expose metrics
-	http.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/metrics", promhttp.Handler())
+
+	// Software bill of materials of the host
+	mux.Handle("/api/v1/sbom", collectors.SBOMHandler())
 
 	// Add a handler for the root path
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/html")
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte(`
@@ -158,16 +286,48 @@ func main() {
 				<h1>System OS info Exporter</h1>
 				<p>This exporter collects and exposes system information and package details as Prometheus metrics.</p>
 				<p>Visit the <a href="/metrics">/metrics</a> page to view the metrics.</p>
+				<p>The software bill of materials of the host is at <a href="/api/v1/sbom">/api/v1/sbom</a> (CycloneDX) and <a href="/api/v1/sbom?format=spdx">/api/v1/sbom?format=spdx</a> (SPDX).</p>
 			</body>
 			</html>
 		`))
 	})
 
 	serverAddress := *address + ":" + *port
+	// Every handler on mux sits behind the TLS and authentication settings
+	// of the web config file
+	server := &http.Server{Handler: mux}
+	webFlags := &web.FlagConfig{
+		WebListenAddresses: &[]string{serverAddress},
+		WebConfigFile:      webConfigFile,
+	}
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- web.ListenAndServe(server, webFlags, slog.Default())
+	}()
 	log.Printf("Starting Prometheus exporter on %s", serverAddress)
-	if err := http.ListenAndServe(serverAddress, nil); err != nil {
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	select {
+	case err := <-serverErr:
 		log.Fatalf("Error starting HTTP server: %v", err)
+	case sig := <-stop:
+		log.Printf("Received %s, shutting down", sig)
+	}
+
+	// Fail readiness and cancel collection first, so in-flight scrapes
+	// return promptly and the server can drain them
+	shuttingDown.Store(true)
+	collectors.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("Error shutting down HTTP server: %v", err)
 	}
 
-	log.Println("Application started")
+	signal.Stop(hup)
+	close(hup)
+	background.Wait()
+	log.Println("Exporter stopped")
 }